@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"sync"
 	"syscall"
 	"time"
 
@@ -14,9 +17,17 @@ import (
 	"github.com/hossein1376/kamune"
 )
 
+const dialTimeout = 2 * time.Minute
+
 var errCh = make(chan error)
 var stop = make(chan struct{})
 
+// passphrase asks for the passphrase of the identity key only once, however
+// many times the client redials.
+var passphrase = sync.OnceValues(
+	kamune.PromptPassphrase("Passphrase for the identity key: "),
+)
+
 type Program struct {
 	*tea.Program
 	transport *kamune.Transport
@@ -28,6 +39,13 @@ func NewProgram(p *tea.Program) *Program {
 
 func main() {
 	args := os.Args[1:]
+	if len(args) == 1 && args[0] == "passphrase" {
+		if err := changePassphrase(); err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+		return
+	}
 	if len(args) != 2 {
 		return
 	}
@@ -77,7 +95,9 @@ func serveHandler(t *kamune.Transport) error {
 }
 
 func server(addr string) {
-	srv, err := kamune.NewServer(addr, serveHandler)
+	srv, err := kamune.NewServer(
+		addr, serveHandler, kamune.WithPassphrase(passphrase),
+	)
 	if err != nil {
 		errCh <- fmt.Errorf("starting server: %w", err)
 		return
@@ -90,7 +110,11 @@ func client(addr string) {
 	for {
 		var opErr *net.OpError
 		var err error
-		t, err = kamune.Dial(addr)
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+		t, err = kamune.DialContext(
+			ctx, addr, kamune.WithPassphrase(passphrase),
+		)
+		cancel()
 		if err == nil {
 			break
 		}
@@ -126,6 +150,35 @@ func client(addr string) {
 	}
 }
 
+// changePassphrase sets, changes or removes the passphrase that protects the
+// identity key.
+func changePassphrase() error {
+	ks, err := kamune.DefaultFileKeyStore()
+	if err != nil {
+		return err
+	}
+	current := kamune.PromptPassphrase("Current passphrase: ")
+	newPass, err := kamune.PromptPassphrase(
+		"New passphrase (empty for none): ",
+	)()
+	if err != nil {
+		return err
+	}
+	again, err := kamune.PromptPassphrase("Repeat new passphrase: ")()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(newPass, again) {
+		return errors.New("passphrases do not match")
+	}
+	if err := ks.ChangePassphrase(current, newPass); err != nil {
+		return fmt.Errorf("changing passphrase: %w", err)
+	}
+	fmt.Println("Passphrase has been changed.")
+
+	return nil
+}
+
 type Message struct {
 	prefix string
 	text   string
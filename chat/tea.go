@@ -53,7 +53,11 @@ func initialModel(t *kamune.Transport) model {
 	ta.ShowLineNumbers = false
 
 	vp := viewport.New(30, 5)
-	vp.SetContent(fmt.Sprintf(`Session ID is %s. Happy Chatting!`, t.SessionID()))
+	welcome := fmt.Sprintf(`Session ID is %s.`, t.SessionID())
+	if sas, err := t.SAS(kamune.SASWords); err == nil {
+		welcome += fmt.Sprintf(` Make sure your peer sees "%s".`, sas)
+	}
+	vp.SetContent(welcome + ` Happy Chatting!`)
 	vp.MouseWheelEnabled = true
 	vp.Style = lipgloss.NewStyle().
 		Border(lipgloss.RoundedBorder()).
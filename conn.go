@@ -1,28 +1,61 @@
 package kamune
 
 import (
+	"context"
 	"errors"
 	"net"
+	"sync/atomic"
+	"time"
 )
 
 var (
 	ErrAlreadyClosed = errors.New("connection has already been closed")
 )
 
+// Conn is a net.Conn that may only be closed once. It is safe to close it
+// concurrently; all but the first call return ErrAlreadyClosed.
 type Conn struct {
 	net.Conn
-	isClosed bool
+	closed atomic.Bool
 }
 
 func (c *Conn) Close() error {
-	if c.isClosed {
+	if !c.closed.CompareAndSwap(false, true) {
 		return ErrAlreadyClosed
 	}
-	err := c.Conn.Close()
-	if err != nil {
-		return err
+	return c.Conn.Close()
+}
+
+// aLongTimeAgo is a non-zero time, far in the past, used to immediately
+// unblock pending reads and writes.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// watchContext interrupts pending I/O once ctx is done, by moving the deadline
+// to the past using set. The returned function stops watching ctx, and reports
+// whether ctx has interrupted I/O. In that case, the caller is responsible for
+// restoring the deadline.
+func watchContext(ctx context.Context, set func(time.Time) error) func() bool {
+	done := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(done)
+		_ = set(aLongTimeAgo)
+	})
+
+	return func() bool {
+		if stop() {
+			return false
+		}
+		<-done
+		return true
 	}
-	c.isClosed = true
+}
 
-	return nil
+// acquire takes the semaphore sem, unless ctx is done first.
+func acquire(ctx context.Context, sem chan struct{}) error {
+	select {
+	case sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
@@ -1,63 +1,249 @@
 package kamune
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"net"
+	"time"
 
 	"github.com/hossein1376/kamune/internal/attest"
+	"github.com/hossein1376/kamune/internal/exchange"
 )
 
 type dialer struct {
-	conn         Conn
-	verifyRemote RemoteVerifier
+	conn             *Conn
+	attest           *attest.Attest
+	verifyRemote     PeerVerifier
+	logger           *slog.Logger
+	handshakeTimeout time.Duration
+	suites           []CipherSuite
+	rekey            RekeyPolicy
+	features         uint32
+	addr             string
+	sessions         SessionCache
+	netDialer        *net.Dialer
+	network          string
+	migrationWindow  time.Duration
 }
 
-func newDialer(conn net.Conn, verifier RemoteVerifier) *dialer {
-	return &dialer{conn: Conn{Conn: conn}, verifyRemote: verifier}
+func newDialer(
+	conn net.Conn, addr string, at *attest.Attest, opts *options,
+) *dialer {
+	return &dialer{
+		conn:             &Conn{Conn: conn},
+		attest:           at,
+		verifyRemote:     opts.verifier,
+		logger:           opts.logger,
+		handshakeTimeout: opts.handshakeTimeout,
+		suites:           opts.suites,
+		rekey:            opts.rekey,
+		features:         opts.features,
+		addr:             addr,
+		sessions:         opts.sessions,
+		netDialer:        opts.dialer,
+		network:          opts.network,
+		migrationWindow:  opts.migrationWindow,
+	}
+}
+
+func Dial(addr string, opts ...DialOption) (*Transport, error) {
+	return DialContext(context.Background(), addr, opts...)
 }
 
-func Dial(addr string) (*Transport, error) {
-	conn, err := net.Dial("tcp", addr)
+// DialContext connects to addr and performs the introduction and handshake.
+// If ctx is done before the Transport is established, the connection is
+// closed and the returned error wraps ctx.Err().
+func DialContext(
+	ctx context.Context, addr string, opts ...DialOption,
+) (*Transport, error) {
+	o, err := dialOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	at, err := o.identity()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := o.dialer.DialContext(ctx, o.network, addr)
 	if err != nil {
 		return nil, fmt.Errorf("dial: %w", err)
 	}
-	d := newDialer(conn, defaultRemoteVerifier)
+	d := newDialer(conn, addr, at, o)
+	t, err := d.handshake(ctx)
+	if err != nil {
+		if closeErr := d.conn.Close(); closeErr != nil {
+			d.log(slog.LevelError, "close conn", slog.Any("err", closeErr))
+		}
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Client performs the introduction and handshake as the client, over an
+// already established connection. addr is the address of the server, which
+// the session cache and migration rely on. Unlike DialContext, conn is not
+// closed if the handshake fails.
+func Client(
+	ctx context.Context, conn net.Conn, addr string, opts ...DialOption,
+) (*Transport, error) {
+	o, err := dialOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	at, err := o.identity()
+	if err != nil {
+		return nil, err
+	}
+
+	return newDialer(conn, addr, at, o).handshake(ctx)
+}
+
+// handshake runs dial, and gives up once ctx is done.
+func (d *dialer) handshake(ctx context.Context) (*Transport, error) {
+	stop := watchContext(ctx, d.conn.SetDeadline)
+	t, err := d.dial()
+	if stop() {
+		if err == nil {
+			err = d.conn.SetDeadline(time.Time{})
+		} else {
+			err = fmt.Errorf("dial: %w", ctx.Err())
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	return d.dial()
+	return t, nil
 }
 
-func (d *dialer) dial() (*Transport, error) {
+func (d *dialer) dial() (t *Transport, err error) {
 	defer func() {
-		if err := recover(); err != nil {
-			d.log(slog.LevelError, "dial panic", slog.Any("err", err))
+		if r := recover(); r != nil {
+			d.log(slog.LevelError, "dial panic", slog.Any("err", r))
+			err = fmt.Errorf("dial panic: %v", r)
 		}
 	}()
-	at, err := attest.LoadFromDisk(privKeyPath)
-	if err != nil {
-		return nil, fmt.Errorf("loading certificate: %w", err)
+	if d.handshakeTimeout > 0 {
+		deadline := time.Now().Add(d.handshakeTimeout)
+		if err := d.conn.SetDeadline(deadline); err != nil {
+			return nil, fmt.Errorf("setting deadline: %w", err)
+		}
 	}
 
-	if err = sendIntroduction(d.conn, at); err != nil {
+	features := d.features
+	if d.sessions != nil {
+		features |= featureResumption
+	}
+	local := newIntroduce(d.attest, d.suites, features)
+	sasSalt := randomBytes(sasSaltSize)
+	local.SASCommitment = sasCommit(sasSalt)
+	session := d.session()
+	var (
+		ec    *exchange.ECDH
+		nonce []byte
+	)
+	if session != nil {
+		if ec, nonce, err = resumeIntroduce(local, session); err != nil {
+			return nil, fmt.Errorf("resume: %w", err)
+		}
+	}
+
+	tr := newTranscript()
+	if err = sendIntroduction(d.conn, local, tr); err != nil {
 		return nil, fmt.Errorf("send introduction: %w", err)
 	}
-	remote, err := receiveIntroduction(d.conn)
+	intro, err := receiveIntroduction(d.conn, tr)
 	if err != nil {
 		return nil, fmt.Errorf("receive introduction: %w", err)
 	}
-	if err = d.verifyRemote(remote); err != nil {
-		return nil, fmt.Errorf("verify remote: %w", err)
+	if intro.reattach != nil {
+		return nil, fmt.Errorf("receive introduction: %w", ErrMigrationRefused)
 	}
-
-	pt := &plainTransport{conn: d.conn, attest: at, remote: remote}
-	t, err := requestHandshake(pt)
+	n, err := negotiate(d.suites, intro, true)
 	if err != nil {
-		return nil, fmt.Errorf("request handshake: %w", err)
+		return nil, fmt.Errorf("negotiate: %w", err)
+	}
+	n.features = features & intro.features
+
+	pt := &plainTransport{
+		conn:        d.conn,
+		attest:      d.attest,
+		remote:      intro.remote,
+		negotiation: n,
+		transcript:  tr,
+		rekey:       d.rekey,
+		sasSalt:     sasSalt,
+	}
+	if intro.resumed && session == nil {
+		return nil, fmt.Errorf("resume: %w", ErrInvalidTicket)
+	}
+	// Resumed sessions are verified as well, so that a peer that is no
+	// longer trusted can not carry on with an old ticket.
+	peer := newPeer(intro.remote, d.conn.Conn, Outbound)
+	peer.host = d.addr
+	if err = d.verifyRemote(peer); err != nil {
+		return nil, fmt.Errorf("verify remote: %w", err)
+	}
+	pt.ctx = peer.context(nil)
+	if intro.resumed {
+		// resumeClient makes sure the identity has not changed since the
+		// session was first established.
+		t, err = resumeClient(pt, session, ec, nonce, intro)
+		if err != nil {
+			return nil, fmt.Errorf("resume: %w", err)
+		}
+	} else {
+		t, err = requestHandshake(pt)
+		if err != nil {
+			return nil, fmt.Errorf("request handshake: %w", err)
+		}
+	}
+	if err := peer.establish(); err != nil {
+		return nil, fmt.Errorf("verify remote: %w", err)
+	}
+	if n.features&featureResumption != 0 {
+		s, err := receiveTicket(t)
+		if err != nil {
+			return nil, err
+		}
+		d.sessions.Put(d.addr, s)
+	}
+	if m := t.migration; m != nil {
+		m.window = d.migrationWindow
+		m.redial = func(ctx context.Context) (net.Conn, error) {
+			return d.netDialer.DialContext(ctx, d.network, d.addr)
+		}
+	}
+	if d.handshakeTimeout > 0 {
+		if err := d.conn.SetDeadline(time.Time{}); err != nil {
+			return nil, fmt.Errorf("clearing deadline: %w", err)
+		}
 	}
 
 	return t, nil
 }
 
-func (dialer) log(lvl slog.Level, msg string, args ...any) {
-	slog.Log(nil, lvl, msg, args...)
+// session returns the cached session of the address, if there is one that
+// has not expired yet. Sessions are used only once, as the server issues a
+// new ticket on every connection.
+func (d *dialer) session() *Session {
+	if d.sessions == nil {
+		return nil
+	}
+	s, ok := d.sessions.Get(d.addr)
+	if !ok {
+		return nil
+	}
+	d.sessions.Put(d.addr, nil)
+	if time.Now().After(s.expiry) {
+		return nil
+	}
+
+	return s
+}
+
+func (d *dialer) log(lvl slog.Level, msg string, args ...any) {
+	d.logger.Log(context.Background(), lvl, msg, args...)
 }
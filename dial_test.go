@@ -0,0 +1,111 @@
+package kamune
+
+import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/hossein1376/kamune/internal/attest"
+)
+
+func TestDial_Options(t *testing.T) {
+	a := require.New(t)
+	addr := filepath.Join(t.TempDir(), "kamune.sock")
+
+	serverID, err := attest.New()
+	a.NoError(err)
+	clientID, err := attest.New()
+	a.NoError(err)
+
+	received := make(chan string, 1)
+	srv, err := NewServer(
+		addr,
+		func(t *Transport) error {
+			b := Bytes(nil)
+			if _, err := t.Receive(b); err != nil {
+				return err
+			}
+			received <- string(b.GetValue())
+			return nil
+		},
+		WithIdentity(serverID),
+		WithNetwork("unix"),
+		WithHandshakeTimeout(time.Second),
+		WithRemoteVerifier(func(key *attest.PublicKey) error {
+			if !key.Equal(clientID.PublicKey()) {
+				return ErrVerificationFailed
+			}
+			return nil
+		}),
+	)
+	a.NoError(err)
+
+	l, err := net.Listen("unix", addr)
+	a.NoError(err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		_ = srv.serve(conn)
+	}()
+
+	tr, err := Dial(
+		addr,
+		WithIdentity(clientID),
+		WithNetwork("unix"),
+		WithDialer(&net.Dialer{Timeout: time.Second}),
+		WithRemoteVerifier(func(key *attest.PublicKey) error {
+			if !key.Equal(serverID.PublicKey()) {
+				return ErrVerificationFailed
+			}
+			return nil
+		}),
+	)
+	a.NoError(err)
+	defer tr.Close()
+
+	_, err = tr.Send(Bytes([]byte("hello")))
+	a.NoError(err)
+	a.Equal("hello", <-received)
+}
+
+func TestDial_UnsupportedNetwork(t *testing.T) {
+	a := require.New(t)
+
+	_, err := Dial("localhost:0", WithNetwork("udp"))
+	a.ErrorIs(err, ErrUnsupportedNetwork)
+
+	_, err = NewServer("localhost:0", nil, WithNetwork("ip"))
+	a.ErrorIs(err, ErrUnsupportedNetwork)
+}
+
+func TestDialContext_Cancel(t *testing.T) {
+	a := require.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	a.NoError(err)
+	defer l.Close()
+	go func() {
+		// Accept the connection, but never respond to the introduction.
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = DialContext(
+		ctx, l.Addr().String(), WithKeyStore(NewMemoryKeyStore()),
+	)
+	a.ErrorIs(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,146 @@
+// Package grpccreds provides gRPC transport credentials that secure the
+// connections with kamune, in place of TLS. Both parties are authenticated
+// by their kamune identities, which RPC handlers and interceptors can then
+// authorize with FromContext.
+package grpccreds
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+
+	"github.com/hossein1376/kamune"
+)
+
+// AuthType is the type of AuthInfo, as reported by AuthType.
+const AuthType = "kamune"
+
+// defaultHandshakeTimeout bounds the server handshakes, unless the server has
+// a timeout of its own. It matches the default ConnectionTimeout of gRPC.
+const defaultHandshakeTimeout = 2 * time.Minute
+
+// AuthInfo is the information that the handshake establishes about the
+// remote party.
+type AuthInfo struct {
+	credentials.CommonAuthInfo
+	// PublicKey is the verified identity of the remote party, as a DER
+	// encoded PKIX public key.
+	PublicKey []byte
+	// Fingerprint is that of PublicKey, as returned by kamune.Fingerprint.
+	Fingerprint string
+	// SessionID identifies the kamune session of the connection.
+	SessionID string
+}
+
+// AuthType returns "kamune".
+func (AuthInfo) AuthType() string {
+	return AuthType
+}
+
+// FromContext returns the AuthInfo of the remote party of an RPC, if its
+// connection was secured with kamune.
+func FromContext(ctx context.Context) (AuthInfo, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return AuthInfo{}, false
+	}
+	info, ok := p.AuthInfo.(AuthInfo)
+	return info, ok
+}
+
+type creds struct {
+	dial       []kamune.DialOption
+	server     *kamune.Server
+	serverName string
+	timeout    time.Duration
+}
+
+// NewClientCredentials returns the credentials of a gRPC client. The options
+// are the same as Dial's; in particular, WithRemoteVerifier decides whether
+// the server is trusted.
+func NewClientCredentials(
+	opts ...kamune.DialOption,
+) credentials.TransportCredentials {
+	return &creds{dial: opts}
+}
+
+// NewServerCredentials returns the credentials of a gRPC server. The options
+// are the same as NewServer's; in particular, WithRemoteVerifier decides
+// whether a client is trusted. Handshakes are bounded by WithHandshakeTimeout,
+// and by two minutes regardless.
+func NewServerCredentials(
+	opts ...kamune.ServerOption,
+) (credentials.TransportCredentials, error) {
+	srv, err := kamune.NewServer("", nil, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("creating server: %w", err)
+	}
+	return &creds{server: srv, timeout: defaultHandshakeTimeout}, nil
+}
+
+func (c *creds) ClientHandshake(
+	ctx context.Context, authority string, rawConn net.Conn,
+) (net.Conn, credentials.AuthInfo, error) {
+	t, err := kamune.Client(ctx, rawConn, authority, c.dial...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("kamune handshake: %w", err)
+	}
+	return secured(t)
+}
+
+func (c *creds) ServerHandshake(
+	rawConn net.Conn,
+) (net.Conn, credentials.AuthInfo, error) {
+	if c.server == nil {
+		return nil, nil, fmt.Errorf("kamune handshake: not server credentials")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	t, err := c.server.Handshake(ctx, rawConn)
+	if err != nil {
+		return nil, nil, fmt.Errorf("kamune handshake: %w", err)
+	}
+	return secured(t)
+}
+
+func (c *creds) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{
+		SecurityProtocol: AuthType,
+		SecurityVersion:  fmt.Sprint(kamune.ProtocolVersion),
+		ServerName:       c.serverName,
+	}
+}
+
+func (c *creds) Clone() credentials.TransportCredentials {
+	return &creds{
+		dial:       slices.Clone(c.dial),
+		server:     c.server,
+		serverName: c.serverName,
+		timeout:    c.timeout,
+	}
+}
+
+// OverrideServerName only affects the ProtocolInfo, as kamune identifies
+// servers by their keys rather than their names.
+func (c *creds) OverrideServerName(name string) error {
+	c.serverName = name
+	return nil
+}
+
+func secured(t *kamune.Transport) (net.Conn, credentials.AuthInfo, error) {
+	info := AuthInfo{
+		CommonAuthInfo: credentials.CommonAuthInfo{
+			SecurityLevel: credentials.PrivacyAndIntegrity,
+		},
+		PublicKey:   t.RemotePublicKey().Marshal(),
+		Fingerprint: t.Fingerprint(),
+		SessionID:   t.SessionID(),
+	}
+
+	return t.NetConn(), info, nil
+}
@@ -0,0 +1,124 @@
+package grpccreds
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	"github.com/hossein1376/kamune"
+	"github.com/hossein1376/kamune/internal/attest"
+)
+
+func acceptAll(*attest.PublicKey) error { return nil }
+
+// authorize only lets the allowed identity through.
+func authorize(allowed *attest.PublicKey) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req any,
+		_ *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (any, error) {
+		info, ok := FromContext(ctx)
+		if !ok ||
+			!bytes.Equal(info.PublicKey, allowed.Marshal()) ||
+			info.Fingerprint != kamune.Fingerprint(allowed) ||
+			info.SessionID == "" {
+			return nil, status.Error(codes.PermissionDenied, "unknown peer")
+		}
+		return handler(ctx, req)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	a := require.New(t)
+	allowed, err := attest.New()
+	a.NoError(err)
+
+	serverCreds, err := NewServerCredentials(
+		kamune.WithKeyStore(kamune.NewMemoryKeyStore()),
+		kamune.WithRemoteVerifier(acceptAll),
+	)
+	a.NoError(err)
+	srv := grpc.NewServer(
+		grpc.Creds(serverCreds),
+		grpc.UnaryInterceptor(authorize(allowed.PublicKey())),
+	)
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	a.NoError(err)
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(srv.Stop)
+
+	check := func(id *attest.Attest) error {
+		clientCreds := NewClientCredentials(
+			kamune.WithIdentity(id), kamune.WithRemoteVerifier(acceptAll),
+		)
+		conn, err := grpc.NewClient(
+			l.Addr().String(), grpc.WithTransportCredentials(clientCreds),
+		)
+		a.NoError(err)
+		defer conn.Close()
+
+		resp, err := healthpb.NewHealthClient(conn).Check(
+			t.Context(), &healthpb.HealthCheckRequest{},
+		)
+		if err != nil {
+			return err
+		}
+		a.Equal(healthpb.HealthCheckResponse_SERVING, resp.GetStatus())
+		return nil
+	}
+
+	a.NoError(check(allowed))
+
+	other, err := attest.New()
+	a.NoError(err)
+	a.Equal(codes.PermissionDenied, status.Code(check(other)))
+}
+
+func TestCredentials_Info(t *testing.T) {
+	a := require.New(t)
+	c := NewClientCredentials()
+	a.NoError(c.OverrideServerName("example"))
+	clone := c.Clone()
+	a.Equal(AuthType, clone.Info().SecurityProtocol)
+	a.Equal("example", clone.Info().ServerName)
+
+	_, _, err := c.ServerHandshake(nil)
+	a.Error(err)
+}
+
+func TestCredentials_HandshakeTimeout(t *testing.T) {
+	a := require.New(t)
+	c, err := NewServerCredentials(
+		kamune.WithKeyStore(kamune.NewMemoryKeyStore()),
+		kamune.WithRemoteVerifier(acceptAll),
+	)
+	a.NoError(err)
+	c.(*creds).timeout = 100 * time.Millisecond
+
+	// A client that never speaks does not hold the server forever.
+	server, client := net.Pipe()
+	t.Cleanup(func() { _ = client.Close() })
+	errCh := make(chan error, 1)
+	go func() {
+		_, _, err := c.ServerHandshake(server)
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		a.ErrorIs(err, context.DeadlineExceeded)
+	case <-time.After(5 * time.Second):
+		a.Fail("handshake did not time out")
+	}
+}
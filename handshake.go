@@ -1,158 +1,272 @@
 package kamune
 
 import (
-	"bytes"
+	"crypto/hmac"
 	"crypto/rand"
+	"encoding/binary"
 	"fmt"
 	mathrand "math/rand/v2"
+	"slices"
+	"time"
 
+	"github.com/hossein1376/kamune/internal/attest"
 	"github.com/hossein1376/kamune/internal/box/pb"
 	"github.com/hossein1376/kamune/internal/enigma"
 	"github.com/hossein1376/kamune/internal/exchange"
 )
 
-var motto = [][]byte{
-	[]byte("For those who kept on fighting, against all odds."),
-	[]byte("Nothing is really gone, just forgotten."),
-	[]byte("A beautiful illusion, or an ugly reality? Make your choice."),
-	[]byte("Will you still do it, even if it wouldn't matter in the end?"),
-}
+var hybridLabel = []byte("kamune-x25519-mlkem768")
+
+var (
+	clientFinished  = []byte("kamune client finished")
+	serverFinished  = []byte("kamune server finished")
+	resumptionLabel = []byte("kamune resumption")
+)
 
 func requestHandshake(pt *plainTransport) (*Transport, error) {
 	ml, err := exchange.NewMLKEM()
 	if err != nil {
 		return nil, fmt.Errorf("creating MLKEM keys: %w", err)
 	}
+	ec, err := exchange.NewECDH()
+	if err != nil {
+		return nil, fmt.Errorf("creating ECDH keys: %w", err)
+	}
 	nonce := randomBytes(enigma.BaseNonceSize)
 	req := &pb.Handshake{
 		Key:     ml.PublicKey.Bytes(),
+		ECDH:    ec.MarshalPublicKey(),
 		Nonce:   nonce,
+		Version: pt.negotiation.version,
+		Suite:   uint32(pt.negotiation.suite),
+		Offered: suitesToWire(pt.negotiation.local),
 		Padding: padding(handshakePadding),
 	}
 	reqBytes, _, err := pt.serialize(req, pt.sent.Load())
 	if err != nil {
 		return nil, fmt.Errorf("serializing handshake request: %w", err)
 	}
-	if _, err = pt.conn.Write(reqBytes); err != nil {
+	pt.transcript.add(reqBytes)
+	if err = writeRecord(pt.conn, reqBytes); err != nil {
 		return nil, fmt.Errorf("writing handshake request: %w", err)
 	}
 	pt.sent.Add(1)
 
-	respBytes, err := read(pt.conn)
+	respBytes, err := readRecord(pt.conn)
 	if err != nil {
 		return nil, fmt.Errorf("reading handshake response: %w", err)
 	}
+	pt.transcript.add(respBytes)
 	var resp pb.Handshake
 	if _, err = pt.deserialize(respBytes, &resp, pt.received.Load()); err != nil {
 		return nil, fmt.Errorf("deserializing handshake response: %w", err)
 	}
 	pt.received.Add(1)
-	secret, err := ml.Decapsulate(resp.GetKey())
+	err = pt.negotiation.verify(
+		resp.GetVersion(), resp.GetSuite(), resp.GetOffered(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("verifying negotiation: %w", err)
+	}
+	mlSecret, err := ml.Decapsulate(resp.GetKey())
 	if err != nil {
 		return nil, fmt.Errorf("decapsulating secret: %w", err)
 	}
-
-	encoder, err := enigma.NewEnigma(secret, nonce, enigma.C2S)
+	ecSecret, err := ec.Exchange(resp.GetECDH())
 	if err != nil {
-		return nil, fmt.Errorf("creating encrypter: %w", err)
+		return nil, fmt.Errorf("exchanging ECDH keys: %w", err)
 	}
-	decoder, err := enigma.NewEnigma(secret, resp.GetNonce(), enigma.S2C)
+	th := pt.transcript.sum()
+	secret, err := hybridSecret(th, mlSecret, ecSecret, req, &resp)
 	if err != nil {
-		return nil, fmt.Errorf("creating decrypter: %w", err)
+		return nil, fmt.Errorf("deriving secret: %w", err)
 	}
 
-	t := newTransport(pt, resp.GetSessionID(), encoder, decoder)
-	if err := sendVerification(t); err != nil {
-		return nil, fmt.Errorf("sending verification: %w", err)
+	encoder, decoder, err := clientSealers(
+		pt, secret, nonce, resp.GetNonce(), resp.GetECDH(),
+	)
+	if err != nil {
+		return nil, err
 	}
-	if err := receiveVerification(t); err != nil {
-		return nil, fmt.Errorf("receiving verification: %w", err)
+
+	t := newTransport(pt, resp.GetSessionID(), encoder, decoder)
+	if err := finishHandshake(t, th, secret, true); err != nil {
+		return nil, err
 	}
 
 	return t, nil
 }
 
 func acceptHandshake(pt *plainTransport) (*Transport, error) {
-	reqBytes, err := read(pt.conn)
+	reqBytes, err := readRecord(pt.conn)
 	if err != nil {
 		return nil, fmt.Errorf("reading handshake request: %w", err)
-
 	}
+	pt.transcript.add(reqBytes)
 	var req pb.Handshake
 	if _, err = pt.deserialize(reqBytes, &req, pt.received.Load()); err != nil {
 		return nil, fmt.Errorf("deserializing handshake request: %w", err)
 	}
 	pt.received.Add(1)
-	secret, ct, err := exchange.EncapsulateMLKEM(req.GetKey())
+	err = pt.negotiation.verify(
+		req.GetVersion(), req.GetSuite(), req.GetOffered(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("verifying negotiation: %w", err)
+	}
+	mlSecret, ct, err := exchange.EncapsulateMLKEM(req.GetKey())
 	if err != nil {
 		return nil, fmt.Errorf("encapsulating key: %w", err)
 	}
+	ec, err := exchange.NewECDH()
+	if err != nil {
+		return nil, fmt.Errorf("creating ECDH keys: %w", err)
+	}
+	ecSecret, err := ec.Exchange(req.GetECDH())
+	if err != nil {
+		return nil, fmt.Errorf("exchanging ECDH keys: %w", err)
+	}
 
 	sessionID := rand.Text()
 	nonce := randomBytes(enigma.BaseNonceSize)
 	resp := &pb.Handshake{
 		Key:       ct,
+		ECDH:      ec.MarshalPublicKey(),
 		Nonce:     nonce,
 		SessionID: &sessionID,
+		Version:   pt.negotiation.version,
+		Suite:     uint32(pt.negotiation.suite),
+		Offered:   suitesToWire(pt.negotiation.local),
 		Padding:   padding(handshakePadding),
 	}
 	respBytes, _, err := pt.serialize(resp, pt.sent.Load())
 	if err != nil {
 		return nil, fmt.Errorf("serializing handshake response: %w", err)
 	}
-	if _, err = pt.conn.Write(respBytes); err != nil {
+	pt.transcript.add(respBytes)
+	th := pt.transcript.sum()
+	secret, err := hybridSecret(th, mlSecret, ecSecret, &req, resp)
+	if err != nil {
+		return nil, fmt.Errorf("deriving secret: %w", err)
+	}
+	if err = writeRecord(pt.conn, respBytes); err != nil {
 		return nil, fmt.Errorf("writing handshake response: %w", err)
 	}
 	pt.sent.Add(1)
 
-	encoder, err := enigma.NewEnigma(secret, nonce, enigma.S2C)
+	encoder, decoder, err := serverSealers(
+		pt, secret, nonce, req.GetNonce(), ec,
+	)
 	if err != nil {
-		return nil, fmt.Errorf("creating encrypter: %w", err)
-	}
-	decoder, err := enigma.NewEnigma(secret, req.GetNonce(), enigma.C2S)
-	if err != nil {
-		return nil, fmt.Errorf("creating decrypter: %w", err)
+		return nil, err
 	}
 
 	t := newTransport(pt, sessionID, encoder, decoder)
-	if err := receiveVerification(t); err != nil {
-		return nil, fmt.Errorf("receiving verification: %w", err)
-	}
-	if err := sendVerification(t); err != nil {
-		return nil, fmt.Errorf("sending verification: %w", err)
+	if err := finishHandshake(t, th, secret, false); err != nil {
+		return nil, err
 	}
 
 	return t, nil
 }
 
-func sendVerification(t *Transport) error {
-	m := motto[mathrand.IntN(len(motto))]
-	if _, err := t.Send(Bytes(m)); err != nil {
-		return fmt.Errorf("sending: %w", err)
+// finishHandshake exchanges the finished messages, the client going first.
+// Once both are verified, the resumption secret, and the migration key if
+// negotiated, are derived from the session secret and the transcript hash th.
+func finishHandshake(t *Transport, th, secret []byte, isClient bool) error {
+	t.handshakeHash = th
+	t.client = isClient
+	if isClient {
+		if err := sendFinished(t, clientFinished); err != nil {
+			return fmt.Errorf("sending finished: %w", err)
+		}
+		if err := receiveFinished(t, serverFinished); err != nil {
+			return fmt.Errorf("receiving finished: %w", err)
+		}
+	} else {
+		if err := receiveFinished(t, clientFinished); err != nil {
+			return fmt.Errorf("receiving finished: %w", err)
+		}
+		if err := sendFinished(t, serverFinished); err != nil {
+			return fmt.Errorf("sending finished: %w", err)
+		}
 	}
-	r := Bytes(nil)
-	if _, err := t.Receive(r); err != nil {
-		return fmt.Errorf("receiving: %w", err)
+
+	t.handshakeTime = time.Now()
+
+	resumption, err := enigma.Combine(th, resumptionLabel, secret)
+	if err != nil {
+		return fmt.Errorf("deriving resumption secret: %w", err)
 	}
-	if !bytes.Equal(r.Value, m) {
-		return ErrVerificationFailed
+	t.resumption = resumption
+	if t.negotiation.features&featureMigration != 0 {
+		key, err := enigma.Combine(th, migrationLabel, secret)
+		if err != nil {
+			return fmt.Errorf("deriving migration key: %w", err)
+		}
+		t.migration = newMigration(key)
 	}
 
 	return nil
 }
 
-func receiveVerification(t *Transport) error {
-	r := Bytes(nil)
-	if _, err := t.Receive(r); err != nil {
-		return fmt.Errorf("receiving: %w", err)
+// sendFinished signs the transcript hash, prefixed by the sender's role, with
+// the long-term identity key. It proves possession of the introduced key, and
+// that both parties have seen the same introduction and handshake.
+func sendFinished(t *Transport, label []byte) error {
+	sig, err := t.attest.Sign(slices.Concat(label, t.handshakeHash))
+	if err != nil {
+		return fmt.Errorf("signing transcript: %w", err)
 	}
-	if _, err := t.Send(Bytes(r.Value)); err != nil {
+	// Only the client has a salt, which it reveals once the server can no
+	// longer change its part of the transcript.
+	f := &pb.Finished{Signature: sig, SASSalt: t.sasSalt}
+	if _, err := t.Send(f); err != nil {
 		return fmt.Errorf("sending: %w", err)
 	}
 
 	return nil
 }
 
+// receiveFinished verifies the remote's finished message. The label is that
+// of the remote's role, so a reflected message does not verify.
+func receiveFinished(t *Transport, label []byte) error {
+	var f pb.Finished
+	if _, err := t.Receive(&f); err != nil {
+		return fmt.Errorf("receiving: %w", err)
+	}
+	msg := slices.Concat(label, t.handshakeHash)
+	if !attest.Verify(t.remote, msg, f.GetSignature()) {
+		return ErrVerificationFailed
+	}
+	if t.sasCommitment != nil {
+		salt := f.GetSASSalt()
+		if !hmac.Equal(sasCommit(salt), t.sasCommitment) {
+			return fmt.Errorf(
+				"%w: SAS salt does not match", ErrVerificationFailed,
+			)
+		}
+		t.sasSalt = salt
+	}
+
+	return nil
+}
+
+// hybridSecret combines the ML-KEM and X25519 shared secrets into the session
+// secret. The ML-KEM ciphertext and both X25519 public keys are bound to it as
+// well, so an attacker has to break both exchanges to recover it. So is the
+// negotiated version and suite. The transcript hash is used as the salt.
+func hybridSecret(
+	th, mlSecret, ecSecret []byte, req, resp *pb.Handshake,
+) ([]byte, error) {
+	var params []byte
+	params = binary.BigEndian.AppendUint32(params, resp.GetVersion())
+	params = binary.BigEndian.AppendUint32(params, resp.GetSuite())
+	info := slices.Concat(
+		hybridLabel, params, resp.GetKey(), req.GetECDH(), resp.GetECDH(),
+	)
+	return enigma.Combine(th, info, mlSecret, ecSecret)
+}
+
 func randomBytes(l int) []byte {
 	rnd := make([]byte, l)
 	if _, err := rand.Read(rnd); err != nil {
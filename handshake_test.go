@@ -0,0 +1,214 @@
+package kamune
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/hossein1376/kamune/internal/attest"
+	"github.com/hossein1376/kamune/internal/box/pb"
+	"github.com/hossein1376/kamune/internal/exchange"
+)
+
+// relay forwards records from src to dst. The first record is passed to
+// tamper, if it is not nil.
+func relay(src, dst net.Conn, tamper func([]byte) ([]byte, error)) {
+	defer dst.Close()
+	defer src.Close()
+	for first := true; ; first = false {
+		rec, err := readRecord(src)
+		if err != nil {
+			return
+		}
+		if first && tamper != nil {
+			if rec, err = tamper(rec); err != nil {
+				return
+			}
+		}
+		if err := writeRecord(dst, rec); err != nil {
+			return
+		}
+	}
+}
+
+// resign returns a function that passes a handshake message to tamper, and
+// signs it again with signer, as if the attacker was able to forge the
+// sender's signature.
+func resign(
+	signer *attest.Attest, tamper func(*pb.Handshake),
+) func([]byte) ([]byte, error) {
+	if tamper == nil {
+		return nil
+	}
+	return func(rec []byte) ([]byte, error) {
+		return resignRecord(rec, signer, tamper)
+	}
+}
+
+func resignRecord(
+	rec []byte, signer *attest.Attest, tamper func(*pb.Handshake),
+) ([]byte, error) {
+	var st pb.SignedTransport
+	if err := proto.Unmarshal(rec, &st); err != nil {
+		return nil, err
+	}
+	var hs pb.Handshake
+	if err := proto.Unmarshal(st.GetData(), &hs); err != nil {
+		return nil, err
+	}
+	tamper(&hs)
+	data, err := proto.Marshal(&hs)
+	if err != nil {
+		return nil, err
+	}
+	if st.Signature, err = signer.Sign(data); err != nil {
+		return nil, err
+	}
+	st.Data = data
+
+	return proto.Marshal(&st)
+}
+
+func handshakeThrough(
+	t *testing.T, tamperReq, tamperResp func(*pb.Handshake),
+) (clientErr, serverErr error) {
+	t.Helper()
+	a := require.New(t)
+	client, clientProxy := net.Pipe()
+	server, serverProxy := net.Pipe()
+
+	clientID, err := attest.New()
+	a.NoError(err)
+	serverID, err := attest.New()
+	a.NoError(err)
+
+	go relay(clientProxy, serverProxy, resign(clientID, tamperReq))
+	go relay(serverProxy, clientProxy, resign(serverID, tamperResp))
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := acceptHandshake(&plainTransport{
+			conn:        &Conn{Conn: server},
+			attest:      serverID,
+			remote:      clientID.PublicKey(),
+			negotiation: testNegotiation(),
+			transcript:  newTranscript(),
+		})
+		errCh <- err
+		server.Close()
+	}()
+	_, clientErr = requestHandshake(&plainTransport{
+		conn:        &Conn{Conn: client},
+		attest:      clientID,
+		remote:      serverID.PublicKey(),
+		negotiation: testNegotiation(),
+		transcript:  newTranscript(),
+	})
+	client.Close()
+
+	return clientErr, <-errCh
+}
+
+func TestHandshake_Hybrid(t *testing.T) {
+	freshMLKEM := func(hs *pb.Handshake) {
+		ml, err := exchange.NewMLKEM()
+		require.NoError(t, err)
+		hs.Key = ml.MarshalPublicKey()
+	}
+	freshECDH := func(hs *pb.Handshake) {
+		ec, err := exchange.NewECDH()
+		require.NoError(t, err)
+		hs.ECDH = ec.MarshalPublicKey()
+	}
+	flipCiphertext := func(hs *pb.Handshake) {
+		hs.Key[0] ^= 0xFF
+	}
+
+	t.Run("untouched", func(t *testing.T) {
+		a := require.New(t)
+		clientErr, serverErr := handshakeThrough(t, nil, nil)
+		a.NoError(clientErr)
+		a.NoError(serverErr)
+	})
+
+	tests := []struct {
+		name       string
+		tamperReq  func(*pb.Handshake)
+		tamperResp func(*pb.Handshake)
+	}{
+		{name: "client ML-KEM key", tamperReq: freshMLKEM},
+		{name: "client X25519 share", tamperReq: freshECDH},
+		{name: "server ML-KEM ciphertext", tamperResp: flipCiphertext},
+		{name: "server X25519 share", tamperResp: freshECDH},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			a := require.New(t)
+			clientErr, serverErr := handshakeThrough(
+				t, tc.tamperReq, tc.tamperResp,
+			)
+			a.Error(clientErr)
+			a.Error(serverErr)
+		})
+	}
+}
+
+func TestHandshake_Transcript(t *testing.T) {
+	t.Run("agreed", func(t *testing.T) {
+		a := require.New(t)
+		client, server := newTransportPair(t)
+		a.Len(client.handshakeHash, 64)
+		a.Equal(client.handshakeHash, server.handshakeHash)
+	})
+
+	t.Run("reflected finished", func(t *testing.T) {
+		a := require.New(t)
+		client, server := newTransportPair(t)
+
+		errCh := make(chan error, 1)
+		go func() { errCh <- sendFinished(client, clientFinished) }()
+		err := receiveFinished(server, serverFinished)
+		a.ErrorIs(err, ErrVerificationFailed)
+		a.NoError(<-errCh)
+	})
+
+	t.Run("diverged introduction", func(t *testing.T) {
+		a := require.New(t)
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+
+		clientID, err := attest.New()
+		a.NoError(err)
+		serverID, err := attest.New()
+		a.NoError(err)
+
+		clientTr, serverTr := newTranscript(), newTranscript()
+		clientTr.add([]byte("introduction as the client saw it"))
+		serverTr.add([]byte("introduction as the server saw it"))
+
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := acceptHandshake(&plainTransport{
+				conn:        &Conn{Conn: c2},
+				attest:      serverID,
+				remote:      clientID.PublicKey(),
+				negotiation: testNegotiation(),
+				transcript:  serverTr,
+			})
+			errCh <- err
+			c2.Close()
+		}()
+		_, err = requestHandshake(&plainTransport{
+			conn:        &Conn{Conn: c1},
+			attest:      clientID,
+			remote:      serverID.PublicKey(),
+			negotiation: testNegotiation(),
+			transcript:  clientTr,
+		})
+		a.Error(err)
+		a.Error(<-errCh)
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 )
 
 const (
@@ -18,20 +19,37 @@ var (
 	ErrInvalidKey  = errors.New("invalid key type")
 )
 
-func saveKey(key []byte, kType, path string) error {
-	file, err := os.Create(path)
-	if err != nil {
-		return fmt.Errorf("creating file: %w", err)
-	}
-	defer file.Close()
-
+// saveKey writes key as a PEM block of type kType to path. The file is
+// replaced as a whole, so that a failed write does not lose the old key.
+func saveKey(key []byte, kType, path string, perm os.FileMode) error {
 	block := pem.Block{
 		Bytes: key,
 		Type:  kType,
 	}
-	if err := pem.Encode(file, &block); err != nil {
+	return saveBlock(&block, path, perm)
+}
+
+func saveBlock(block *pem.Block, path string, perm os.FileMode) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("creating file: %w", err)
+	}
+	defer os.Remove(file.Name())
+
+	if err := pem.Encode(file, block); err != nil {
+		_ = file.Close()
 		return fmt.Errorf("encode key: %w", err)
 	}
+	if err := file.Chmod(perm); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("chmod: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("closing file: %w", err)
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return fmt.Errorf("replacing file: %w", err)
+	}
 
 	return nil
 }
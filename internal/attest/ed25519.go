@@ -41,16 +41,22 @@ func (e *Attest) Sign(msg []byte) ([]byte, error) {
 	return ed25519.Sign(e.privateKey, msg), nil
 }
 
+// Save writes the private key to path as unencrypted PKCS #8, and the public
+// key next to it, with a ".pub" suffix.
 func (e *Attest) Save(path string) error {
 	private, err := x509.MarshalPKCS8PrivateKey(e.privateKey)
 	if err != nil {
 		return fmt.Errorf("marshalling key: %w", err)
 	}
-	err = saveKey(private, privateKeyType, path)
+	err = saveKey(private, privateKeyType, path, 0600)
 	if err != nil {
 		return fmt.Errorf("saving private key: %w", err)
 	}
-	err = saveKey(e.MarshalPublicKey(), publicKeyType, path+".pub")
+	return e.savePublicKey(path)
+}
+
+func (e *Attest) savePublicKey(path string) error {
+	err := saveKey(e.MarshalPublicKey(), publicKeyType, path+".pub", 0644)
 	if err != nil {
 		return fmt.Errorf("saving public key: %w", err)
 	}
@@ -95,7 +101,19 @@ func ParsePublicKey(remote []byte) (*PublicKey, error) {
 	return &PublicKey{key: pub}, nil
 }
 
+// LoadFromDisk reads an unencrypted private key from path. It returns
+// ErrEncrypted if the key is encrypted, in which case LoadWithPassphrase
+// should be used instead.
 func LoadFromDisk(path string) (*Attest, error) {
+	return LoadWithPassphrase(path, func() ([]byte, error) {
+		return nil, ErrEncrypted
+	})
+}
+
+// LoadWithPassphrase reads the private key from path. If the key is
+// encrypted, passphrase is called to decrypt it; otherwise, it is not called
+// at all.
+func LoadWithPassphrase(path string, passphrase Passphrase) (*Attest, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
@@ -107,7 +125,28 @@ func LoadFromDisk(path string) (*Attest, error) {
 	if block == nil {
 		return nil, ErrMissingPEM
 	}
-	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+
+	der := block.Bytes
+	switch block.Type {
+	case privateKeyType:
+	case encryptedKeyType:
+		pass, err := passphrase()
+		if err != nil {
+			return nil, fmt.Errorf("reading passphrase: %w", err)
+		}
+		der, err = decryptKey(block, pass)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrInvalidKey, block.Type)
+	}
+
+	return parsePrivateKey(der)
+}
+
+func parsePrivateKey(der []byte) (*Attest, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
 	if err != nil {
 		return nil, fmt.Errorf("parsing key: %w", err)
 	}
@@ -0,0 +1,157 @@
+package attest
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const encryptedKeyType = "KAMUNE ENCRYPTED PRIVATE KEY"
+
+// The encrypted key is stored as a PEM block, whose body is laid out as:
+//
+//	version | time | memory | threads | salt | nonce | sealed PKCS #8 key
+//
+// where time and memory are big-endian uint32s, and the rest of the fields
+// are a single byte, except for the salt and the nonce. Every field before
+// the sealed key is authenticated as additional data.
+const (
+	encryptionVersion = 1
+	saltSize          = 16
+	nonceOffset       = 1 + 4 + 4 + 1 + saltSize
+	headerSize        = nonceOffset + chacha20poly1305.NonceSizeX
+
+	// Argon2id parameters, as recommended by RFC 9106 for memory constrained
+	// environments. Memory is in KiB.
+	argonTime    = 3
+	argonMemory  = 64 * 1024
+	argonThreads = 4
+
+	// Upper bounds of the parameters accepted when decrypting, so that a
+	// crafted file cannot exhaust the machine.
+	maxArgonTime   = 16
+	maxArgonMemory = 1024 * 1024
+)
+
+var (
+	ErrEncrypted         = errors.New("key is encrypted")
+	ErrWrongPassphrase   = errors.New("wrong passphrase")
+	ErrUnsupportedFormat = errors.New("unsupported key format")
+)
+
+// Passphrase returns the passphrase that protects the private key. It is only
+// called when needed, so that the user is not asked for nothing.
+type Passphrase func() ([]byte, error)
+
+// SaveEncrypted writes the private key to path, sealed with a key derived
+// from passphrase with Argon2id, and the public key next to it, with a ".pub"
+// suffix. If passphrase is empty, the key is saved unencrypted, as with Save.
+func (e *Attest) SaveEncrypted(path string, passphrase []byte) error {
+	if len(passphrase) == 0 {
+		return e.Save(path)
+	}
+	private, err := x509.MarshalPKCS8PrivateKey(e.privateKey)
+	if err != nil {
+		return fmt.Errorf("marshalling key: %w", err)
+	}
+	block, err := encryptKey(private, passphrase)
+	if err != nil {
+		return err
+	}
+	if err := saveBlock(block, path, 0600); err != nil {
+		return fmt.Errorf("saving private key: %w", err)
+	}
+	return e.savePublicKey(path)
+}
+
+// ChangePassphrase re-encrypts the private key at path with newPassphrase.
+// The current passphrase is only asked for if the key is encrypted. An empty
+// newPassphrase removes the encryption.
+func ChangePassphrase(
+	path string, old Passphrase, newPassphrase []byte,
+) error {
+	at, err := LoadWithPassphrase(path, old)
+	if err != nil {
+		return fmt.Errorf("loading key: %w", err)
+	}
+	return at.SaveEncrypted(path, newPassphrase)
+}
+
+func encryptKey(der, passphrase []byte) (*pem.Block, error) {
+	header := make([]byte, headerSize)
+	header[0] = encryptionVersion
+	binary.BigEndian.PutUint32(header[1:], argonTime)
+	binary.BigEndian.PutUint32(header[5:], argonMemory)
+	header[9] = argonThreads
+	if _, err := rand.Read(header[10:]); err != nil {
+		return nil, fmt.Errorf("generating salt and nonce: %w", err)
+	}
+
+	aead, err := newKeyAEAD(header, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	nonce := header[nonceOffset:]
+
+	return &pem.Block{
+		Type:  encryptedKeyType,
+		Bytes: aead.Seal(header, nonce, der, header),
+	}, nil
+}
+
+func decryptKey(block *pem.Block, passphrase []byte) ([]byte, error) {
+	data := block.Bytes
+	if len(data) < headerSize {
+		return nil, fmt.Errorf("%w: too short", ErrUnsupportedFormat)
+	}
+	if data[0] != encryptionVersion {
+		return nil, fmt.Errorf(
+			"%w: version %d", ErrUnsupportedFormat, data[0],
+		)
+	}
+	header, sealed := data[:headerSize], data[headerSize:]
+
+	aead, err := newKeyAEAD(header, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	nonce := header[nonceOffset:]
+	der, err := aead.Open(nil, nonce, sealed, header)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+
+	return der, nil
+}
+
+// newKeyAEAD derives the encryption key from passphrase, using the parameters
+// and the salt in header.
+func newKeyAEAD(header, passphrase []byte) (cipher.AEAD, error) {
+	iterations := binary.BigEndian.Uint32(header[1:])
+	memory := binary.BigEndian.Uint32(header[5:])
+	threads := header[9]
+	if iterations == 0 || iterations > maxArgonTime ||
+		memory == 0 || memory > maxArgonMemory ||
+		threads == 0 {
+		return nil, fmt.Errorf(
+			"%w: invalid Argon2id parameters", ErrUnsupportedFormat,
+		)
+	}
+	salt := header[10:nonceOffset]
+
+	size := uint32(chacha20poly1305.KeySize)
+	key := argon2.IDKey(passphrase, salt, iterations, memory, threads, size)
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, fmt.Errorf("creating cipher: %w", err)
+	}
+
+	return aead, nil
+}
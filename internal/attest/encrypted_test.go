@@ -0,0 +1,108 @@
+package attest_test
+
+import (
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/hossein1376/kamune/internal/attest"
+)
+
+func passphrase(p string) attest.Passphrase {
+	return func() ([]byte, error) { return []byte(p), nil }
+}
+
+func TestAttest_SaveEncrypted(t *testing.T) {
+	a := require.New(t)
+	path := filepath.Join(t.TempDir(), "id.key")
+	at, err := attest.New()
+	a.NoError(err)
+	a.NoError(at.SaveEncrypted(path, []byte("correct horse")))
+
+	info, err := os.Stat(path)
+	a.NoError(err)
+	a.Equal(os.FileMode(0600), info.Mode().Perm())
+	a.FileExists(path + ".pub")
+
+	_, err = attest.LoadFromDisk(path)
+	a.ErrorIs(err, attest.ErrEncrypted)
+	_, err = attest.LoadWithPassphrase(path, passphrase("battery staple"))
+	a.ErrorIs(err, attest.ErrWrongPassphrase)
+	failed := errors.New("no terminal")
+	_, err = attest.LoadWithPassphrase(path, func() ([]byte, error) {
+		return nil, failed
+	})
+	a.ErrorIs(err, failed)
+
+	loaded, err := attest.LoadWithPassphrase(path, passphrase("correct horse"))
+	a.NoError(err)
+	a.True(loaded.PublicKey().Equal(at.PublicKey()))
+}
+
+func TestAttest_Unencrypted(t *testing.T) {
+	a := require.New(t)
+	path := filepath.Join(t.TempDir(), "id.key")
+	at, err := attest.New()
+	a.NoError(err)
+	a.NoError(at.Save(path))
+
+	// The passphrase is not asked for an unencrypted key.
+	loaded, err := attest.LoadWithPassphrase(path, func() ([]byte, error) {
+		return nil, errors.New("should not be called")
+	})
+	a.NoError(err)
+	a.True(loaded.PublicKey().Equal(at.PublicKey()))
+}
+
+func TestChangePassphrase(t *testing.T) {
+	a := require.New(t)
+	path := filepath.Join(t.TempDir(), "id.key")
+	at, err := attest.New()
+	a.NoError(err)
+	a.NoError(at.Save(path))
+
+	a.NoError(attest.ChangePassphrase(path, passphrase(""), []byte("first")))
+	_, err = attest.LoadFromDisk(path)
+	a.ErrorIs(err, attest.ErrEncrypted)
+
+	err = attest.ChangePassphrase(path, passphrase("wrong"), []byte("second"))
+	a.ErrorIs(err, attest.ErrWrongPassphrase)
+	err = attest.ChangePassphrase(path, passphrase("first"), []byte("second"))
+	a.NoError(err)
+	_, err = attest.LoadWithPassphrase(path, passphrase("first"))
+	a.ErrorIs(err, attest.ErrWrongPassphrase)
+
+	// An empty passphrase removes the encryption.
+	a.NoError(attest.ChangePassphrase(path, passphrase("second"), nil))
+	loaded, err := attest.LoadFromDisk(path)
+	a.NoError(err)
+	a.True(loaded.PublicKey().Equal(at.PublicKey()))
+}
+
+func TestLoadWithPassphrase_Malformed(t *testing.T) {
+	a := require.New(t)
+	path := filepath.Join(t.TempDir(), "id.key")
+	at, err := attest.New()
+	a.NoError(err)
+	a.NoError(at.SaveEncrypted(path, []byte("pass")))
+
+	// Tampering with the header, such as lowering the Argon2id cost, is
+	// caught as it is authenticated.
+	data, err := os.ReadFile(path)
+	a.NoError(err)
+	block, _ := pem.Decode(data)
+	a.NotNil(block)
+	block.Bytes[4]--
+	a.NoError(os.WriteFile(path, pem.EncodeToMemory(block), 0600))
+	_, err = attest.LoadWithPassphrase(path, passphrase("pass"))
+	a.ErrorIs(err, attest.ErrWrongPassphrase)
+
+	block.Bytes[0] = 2
+	a.NoError(os.WriteFile(path, pem.EncodeToMemory(block), 0600))
+	_, err = attest.LoadWithPassphrase(path, passphrase("pass"))
+	a.ErrorIs(err, attest.ErrUnsupportedFormat)
+}
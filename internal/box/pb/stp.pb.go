@@ -9,6 +9,8 @@ package pb
 import (
 	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
 	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	anypb "google.golang.org/protobuf/types/known/anypb"
+	durationpb "google.golang.org/protobuf/types/known/durationpb"
 	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
 	reflect "reflect"
 	sync "sync"
@@ -22,10 +24,175 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
+type Kind int32
+
+const (
+	Kind_Message Kind = 0
+	Kind_Rekey   Kind = 1
+	Kind_Close   Kind = 2
+)
+
+// Enum value maps for Kind.
+var (
+	Kind_name = map[int32]string{
+		0: "Message",
+		1: "Rekey",
+		2: "Close",
+	}
+	Kind_value = map[string]int32{
+		"Message": 0,
+		"Rekey":   1,
+		"Close":   2,
+	}
+)
+
+func (x Kind) Enum() *Kind {
+	p := new(Kind)
+	*p = x
+	return p
+}
+
+func (x Kind) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Kind) Descriptor() protoreflect.EnumDescriptor {
+	return file_stp_proto_enumTypes[0].Descriptor()
+}
+
+func (Kind) Type() protoreflect.EnumType {
+	return &file_stp_proto_enumTypes[0]
+}
+
+func (x Kind) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Kind.Descriptor instead.
+func (Kind) EnumDescriptor() ([]byte, []int) {
+	return file_stp_proto_rawDescGZIP(), []int{0}
+}
+
+type FrameType int32
+
+const (
+	FrameType_Data         FrameType = 0
+	FrameType_Open         FrameType = 1
+	FrameType_WindowUpdate FrameType = 2
+	FrameType_Fin          FrameType = 3
+	FrameType_Reset        FrameType = 4
+)
+
+// Enum value maps for FrameType.
+var (
+	FrameType_name = map[int32]string{
+		0: "Data",
+		1: "Open",
+		2: "WindowUpdate",
+		3: "Fin",
+		4: "Reset",
+	}
+	FrameType_value = map[string]int32{
+		"Data":         0,
+		"Open":         1,
+		"WindowUpdate": 2,
+		"Fin":          3,
+		"Reset":        4,
+	}
+)
+
+func (x FrameType) Enum() *FrameType {
+	p := new(FrameType)
+	*p = x
+	return p
+}
+
+func (x FrameType) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (FrameType) Descriptor() protoreflect.EnumDescriptor {
+	return file_stp_proto_enumTypes[1].Descriptor()
+}
+
+func (FrameType) Type() protoreflect.EnumType {
+	return &file_stp_proto_enumTypes[1]
+}
+
+func (x FrameType) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use FrameType.Descriptor instead.
+func (FrameType) EnumDescriptor() ([]byte, []int) {
+	return file_stp_proto_rawDescGZIP(), []int{1}
+}
+
+type CallType int32
+
+const (
+	CallType_Request  CallType = 0
+	CallType_Response CallType = 1
+	CallType_Cancel   CallType = 2
+)
+
+// Enum value maps for CallType.
+var (
+	CallType_name = map[int32]string{
+		0: "Request",
+		1: "Response",
+		2: "Cancel",
+	}
+	CallType_value = map[string]int32{
+		"Request":  0,
+		"Response": 1,
+		"Cancel":   2,
+	}
+)
+
+func (x CallType) Enum() *CallType {
+	p := new(CallType)
+	*p = x
+	return p
+}
+
+func (x CallType) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (CallType) Descriptor() protoreflect.EnumDescriptor {
+	return file_stp_proto_enumTypes[2].Descriptor()
+}
+
+func (CallType) Type() protoreflect.EnumType {
+	return &file_stp_proto_enumTypes[2]
+}
+
+func (x CallType) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use CallType.Descriptor instead.
+func (CallType) EnumDescriptor() ([]byte, []int) {
+	return file_stp_proto_rawDescGZIP(), []int{2}
+}
+
 type Introduce struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Padding       []byte                 `protobuf:"bytes,1,opt,name=padding,proto3" json:"padding,omitempty"`
-	Public        []byte                 `protobuf:"bytes,2,opt,name=Public,proto3" json:"Public,omitempty"`
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Padding  []byte                 `protobuf:"bytes,1,opt,name=padding,proto3" json:"padding,omitempty"`
+	Public   []byte                 `protobuf:"bytes,2,opt,name=Public,proto3" json:"Public,omitempty"`
+	Version  uint32                 `protobuf:"varint,3,opt,name=Version,proto3" json:"Version,omitempty"`
+	Suites   []uint32               `protobuf:"varint,4,rep,packed,name=Suites,proto3" json:"Suites,omitempty"`
+	Features uint32                 `protobuf:"varint,5,opt,name=Features,proto3" json:"Features,omitempty"`
+	Ticket   []byte                 `protobuf:"bytes,6,opt,name=Ticket,proto3" json:"Ticket,omitempty"`
+	Nonce    []byte                 `protobuf:"bytes,7,opt,name=Nonce,proto3" json:"Nonce,omitempty"`
+	ECDH     []byte                 `protobuf:"bytes,8,opt,name=ECDH,proto3" json:"ECDH,omitempty"`
+	Resumed  bool                   `protobuf:"varint,9,opt,name=Resumed,proto3" json:"Resumed,omitempty"`
+	Reattach *Reattach              `protobuf:"bytes,10,opt,name=Reattach,proto3" json:"Reattach,omitempty"`
+	// SASCommitment is the client's commitment to the salt that it reveals in
+	// its Finished message, and which is mixed into the short authentication
+	// string.
+	SASCommitment []byte `protobuf:"bytes,11,opt,name=SASCommitment,proto3" json:"SASCommitment,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -74,12 +241,78 @@ func (x *Introduce) GetPublic() []byte {
 	return nil
 }
 
+func (x *Introduce) GetVersion() uint32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *Introduce) GetSuites() []uint32 {
+	if x != nil {
+		return x.Suites
+	}
+	return nil
+}
+
+func (x *Introduce) GetFeatures() uint32 {
+	if x != nil {
+		return x.Features
+	}
+	return 0
+}
+
+func (x *Introduce) GetTicket() []byte {
+	if x != nil {
+		return x.Ticket
+	}
+	return nil
+}
+
+func (x *Introduce) GetNonce() []byte {
+	if x != nil {
+		return x.Nonce
+	}
+	return nil
+}
+
+func (x *Introduce) GetECDH() []byte {
+	if x != nil {
+		return x.ECDH
+	}
+	return nil
+}
+
+func (x *Introduce) GetResumed() bool {
+	if x != nil {
+		return x.Resumed
+	}
+	return false
+}
+
+func (x *Introduce) GetReattach() *Reattach {
+	if x != nil {
+		return x.Reattach
+	}
+	return nil
+}
+
+func (x *Introduce) GetSASCommitment() []byte {
+	if x != nil {
+		return x.SASCommitment
+	}
+	return nil
+}
+
 type SignedTransport struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Data          []byte                 `protobuf:"bytes,1,opt,name=Data,proto3" json:"Data,omitempty"`
 	Signature     []byte                 `protobuf:"bytes,2,opt,name=Signature,proto3" json:"Signature,omitempty"`
 	Metadata      *Metadata              `protobuf:"bytes,3,opt,name=Metadata,proto3" json:"Metadata,omitempty"`
 	Padding       []byte                 `protobuf:"bytes,4,opt,name=padding,proto3" json:"padding,omitempty"`
+	Fragment      *Fragment              `protobuf:"bytes,5,opt,name=Fragment,proto3" json:"Fragment,omitempty"`
+	Kind          Kind                   `protobuf:"varint,6,opt,name=Kind,proto3,enum=box.Kind" json:"Kind,omitempty"`
+	Ack           uint64                 `protobuf:"varint,7,opt,name=Ack,proto3" json:"Ack,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -142,6 +375,147 @@ func (x *SignedTransport) GetPadding() []byte {
 	return nil
 }
 
+func (x *SignedTransport) GetFragment() *Fragment {
+	if x != nil {
+		return x.Fragment
+	}
+	return nil
+}
+
+func (x *SignedTransport) GetKind() Kind {
+	if x != nil {
+		return x.Kind
+	}
+	return Kind_Message
+}
+
+func (x *SignedTransport) GetAck() uint64 {
+	if x != nil {
+		return x.Ack
+	}
+	return 0
+}
+
+type RatchetRecord struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	DH            []byte                 `protobuf:"bytes,1,opt,name=DH,proto3" json:"DH,omitempty"`
+	PN            uint32                 `protobuf:"varint,2,opt,name=PN,proto3" json:"PN,omitempty"`
+	N             uint32                 `protobuf:"varint,3,opt,name=N,proto3" json:"N,omitempty"`
+	Ciphertext    []byte                 `protobuf:"bytes,4,opt,name=Ciphertext,proto3" json:"Ciphertext,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RatchetRecord) Reset() {
+	*x = RatchetRecord{}
+	mi := &file_stp_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RatchetRecord) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RatchetRecord) ProtoMessage() {}
+
+func (x *RatchetRecord) ProtoReflect() protoreflect.Message {
+	mi := &file_stp_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RatchetRecord.ProtoReflect.Descriptor instead.
+func (*RatchetRecord) Descriptor() ([]byte, []int) {
+	return file_stp_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *RatchetRecord) GetDH() []byte {
+	if x != nil {
+		return x.DH
+	}
+	return nil
+}
+
+func (x *RatchetRecord) GetPN() uint32 {
+	if x != nil {
+		return x.PN
+	}
+	return 0
+}
+
+func (x *RatchetRecord) GetN() uint32 {
+	if x != nil {
+		return x.N
+	}
+	return 0
+}
+
+func (x *RatchetRecord) GetCiphertext() []byte {
+	if x != nil {
+		return x.Ciphertext
+	}
+	return nil
+}
+
+type Fragment struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Index         uint32                 `protobuf:"varint,1,opt,name=Index,proto3" json:"Index,omitempty"`
+	Total         uint32                 `protobuf:"varint,2,opt,name=Total,proto3" json:"Total,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Fragment) Reset() {
+	*x = Fragment{}
+	mi := &file_stp_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Fragment) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Fragment) ProtoMessage() {}
+
+func (x *Fragment) ProtoReflect() protoreflect.Message {
+	mi := &file_stp_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Fragment.ProtoReflect.Descriptor instead.
+func (*Fragment) Descriptor() ([]byte, []int) {
+	return file_stp_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *Fragment) GetIndex() uint32 {
+	if x != nil {
+		return x.Index
+	}
+	return 0
+}
+
+func (x *Fragment) GetTotal() uint32 {
+	if x != nil {
+		return x.Total
+	}
+	return 0
+}
+
 type Metadata struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Sequence      uint64                 `protobuf:"varint,1,opt,name=Sequence,proto3" json:"Sequence,omitempty"`
@@ -152,7 +526,7 @@ type Metadata struct {
 
 func (x *Metadata) Reset() {
 	*x = Metadata{}
-	mi := &file_stp_proto_msgTypes[2]
+	mi := &file_stp_proto_msgTypes[4]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -164,7 +538,7 @@ func (x *Metadata) String() string {
 func (*Metadata) ProtoMessage() {}
 
 func (x *Metadata) ProtoReflect() protoreflect.Message {
-	mi := &file_stp_proto_msgTypes[2]
+	mi := &file_stp_proto_msgTypes[4]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -177,7 +551,7 @@ func (x *Metadata) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Metadata.ProtoReflect.Descriptor instead.
 func (*Metadata) Descriptor() ([]byte, []int) {
-	return file_stp_proto_rawDescGZIP(), []int{2}
+	return file_stp_proto_rawDescGZIP(), []int{4}
 }
 
 func (x *Metadata) GetSequence() uint64 {
@@ -200,13 +574,17 @@ type Handshake struct {
 	Key           []byte                 `protobuf:"bytes,2,opt,name=Key,proto3" json:"Key,omitempty"`
 	Nonce         []byte                 `protobuf:"bytes,3,opt,name=Nonce,proto3" json:"Nonce,omitempty"`
 	SessionID     *string                `protobuf:"bytes,4,opt,name=SessionID,proto3,oneof" json:"SessionID,omitempty"`
+	ECDH          []byte                 `protobuf:"bytes,5,opt,name=ECDH,proto3" json:"ECDH,omitempty"`
+	Version       uint32                 `protobuf:"varint,6,opt,name=Version,proto3" json:"Version,omitempty"`
+	Suite         uint32                 `protobuf:"varint,7,opt,name=Suite,proto3" json:"Suite,omitempty"`
+	Offered       []uint32               `protobuf:"varint,8,rep,packed,name=Offered,proto3" json:"Offered,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
 func (x *Handshake) Reset() {
 	*x = Handshake{}
-	mi := &file_stp_proto_msgTypes[3]
+	mi := &file_stp_proto_msgTypes[5]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -218,7 +596,7 @@ func (x *Handshake) String() string {
 func (*Handshake) ProtoMessage() {}
 
 func (x *Handshake) ProtoReflect() protoreflect.Message {
-	mi := &file_stp_proto_msgTypes[3]
+	mi := &file_stp_proto_msgTypes[5]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -231,7 +609,7 @@ func (x *Handshake) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Handshake.ProtoReflect.Descriptor instead.
 func (*Handshake) Descriptor() ([]byte, []int) {
-	return file_stp_proto_rawDescGZIP(), []int{3}
+	return file_stp_proto_rawDescGZIP(), []int{5}
 }
 
 func (x *Handshake) GetPadding() []byte {
@@ -262,29 +640,578 @@ func (x *Handshake) GetSessionID() string {
 	return ""
 }
 
-var File_stp_proto protoreflect.FileDescriptor
+func (x *Handshake) GetECDH() []byte {
+	if x != nil {
+		return x.ECDH
+	}
+	return nil
+}
 
-const file_stp_proto_rawDesc = "" +
-	"\n" +
-	"\tstp.proto\x12\x03box\x1a\x1fgoogle/protobuf/timestamp.proto\"=\n" +
-	"\tIntroduce\x12\x18\n" +
-	"\apadding\x18\x01 \x01(\fR\apadding\x12\x16\n" +
-	"\x06Public\x18\x02 \x01(\fR\x06Public\"\x88\x01\n" +
-	"\x0fSignedTransport\x12\x12\n" +
-	"\x04Data\x18\x01 \x01(\fR\x04Data\x12\x1c\n" +
-	"\tSignature\x18\x02 \x01(\fR\tSignature\x12)\n" +
-	"\bMetadata\x18\x03 \x01(\v2\r.box.MetadataR\bMetadata\x12\x18\n" +
-	"\apadding\x18\x04 \x01(\fR\apadding\"`\n" +
-	"\bMetadata\x12\x1a\n" +
-	"\bSequence\x18\x01 \x01(\x04R\bSequence\x128\n" +
-	"\tTimestamp\x18\x02 \x01(\v2\x1a.google.protobuf.TimestampR\tTimestamp\"~\n" +
-	"\tHandshake\x12\x18\n" +
-	"\apadding\x18\x01 \x01(\fR\apadding\x12\x10\n" +
-	"\x03Key\x18\x02 \x01(\fR\x03Key\x12\x14\n" +
-	"\x05Nonce\x18\x03 \x01(\fR\x05Nonce\x12!\n" +
-	"\tSessionID\x18\x04 \x01(\tH\x00R\tSessionID\x88\x01\x01B\f\n" +
+func (x *Handshake) GetVersion() uint32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *Handshake) GetSuite() uint32 {
+	if x != nil {
+		return x.Suite
+	}
+	return 0
+}
+
+func (x *Handshake) GetOffered() []uint32 {
+	if x != nil {
+		return x.Offered
+	}
+	return nil
+}
+
+type Finished struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Signature     []byte                 `protobuf:"bytes,1,opt,name=Signature,proto3" json:"Signature,omitempty"`
+	SASSalt       []byte                 `protobuf:"bytes,2,opt,name=SASSalt,proto3" json:"SASSalt,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Finished) Reset() {
+	*x = Finished{}
+	mi := &file_stp_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Finished) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Finished) ProtoMessage() {}
+
+func (x *Finished) ProtoReflect() protoreflect.Message {
+	mi := &file_stp_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Finished.ProtoReflect.Descriptor instead.
+func (*Finished) Descriptor() ([]byte, []int) {
+	return file_stp_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *Finished) GetSignature() []byte {
+	if x != nil {
+		return x.Signature
+	}
+	return nil
+}
+
+func (x *Finished) GetSASSalt() []byte {
+	if x != nil {
+		return x.SASSalt
+	}
+	return nil
+}
+
+type Ticket struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Ticket        []byte                 `protobuf:"bytes,1,opt,name=Ticket,proto3" json:"Ticket,omitempty"`
+	Lifetime      uint32                 `protobuf:"varint,2,opt,name=Lifetime,proto3" json:"Lifetime,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Ticket) Reset() {
+	*x = Ticket{}
+	mi := &file_stp_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Ticket) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Ticket) ProtoMessage() {}
+
+func (x *Ticket) ProtoReflect() protoreflect.Message {
+	mi := &file_stp_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Ticket.ProtoReflect.Descriptor instead.
+func (*Ticket) Descriptor() ([]byte, []int) {
+	return file_stp_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *Ticket) GetTicket() []byte {
+	if x != nil {
+		return x.Ticket
+	}
+	return nil
+}
+
+func (x *Ticket) GetLifetime() uint32 {
+	if x != nil {
+		return x.Lifetime
+	}
+	return 0
+}
+
+type TicketState struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Secret        []byte                 `protobuf:"bytes,1,opt,name=Secret,proto3" json:"Secret,omitempty"`
+	Remote        []byte                 `protobuf:"bytes,2,opt,name=Remote,proto3" json:"Remote,omitempty"`
+	Version       uint32                 `protobuf:"varint,3,opt,name=Version,proto3" json:"Version,omitempty"`
+	Suite         uint32                 `protobuf:"varint,4,opt,name=Suite,proto3" json:"Suite,omitempty"`
+	Expiry        int64                  `protobuf:"varint,5,opt,name=Expiry,proto3" json:"Expiry,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TicketState) Reset() {
+	*x = TicketState{}
+	mi := &file_stp_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TicketState) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TicketState) ProtoMessage() {}
+
+func (x *TicketState) ProtoReflect() protoreflect.Message {
+	mi := &file_stp_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TicketState.ProtoReflect.Descriptor instead.
+func (*TicketState) Descriptor() ([]byte, []int) {
+	return file_stp_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *TicketState) GetSecret() []byte {
+	if x != nil {
+		return x.Secret
+	}
+	return nil
+}
+
+func (x *TicketState) GetRemote() []byte {
+	if x != nil {
+		return x.Remote
+	}
+	return nil
+}
+
+func (x *TicketState) GetVersion() uint32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *TicketState) GetSuite() uint32 {
+	if x != nil {
+		return x.Suite
+	}
+	return 0
+}
+
+func (x *TicketState) GetExpiry() int64 {
+	if x != nil {
+		return x.Expiry
+	}
+	return 0
+}
+
+type Reattach struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	SessionID     string                 `protobuf:"bytes,1,opt,name=SessionID,proto3" json:"SessionID,omitempty"`
+	Generation    uint64                 `protobuf:"varint,2,opt,name=Generation,proto3" json:"Generation,omitempty"`
+	Received      uint64                 `protobuf:"varint,3,opt,name=Received,proto3" json:"Received,omitempty"`
+	Proof         []byte                 `protobuf:"bytes,4,opt,name=Proof,proto3" json:"Proof,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Reattach) Reset() {
+	*x = Reattach{}
+	mi := &file_stp_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Reattach) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Reattach) ProtoMessage() {}
+
+func (x *Reattach) ProtoReflect() protoreflect.Message {
+	mi := &file_stp_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Reattach.ProtoReflect.Descriptor instead.
+func (*Reattach) Descriptor() ([]byte, []int) {
+	return file_stp_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *Reattach) GetSessionID() string {
+	if x != nil {
+		return x.SessionID
+	}
+	return ""
+}
+
+func (x *Reattach) GetGeneration() uint64 {
+	if x != nil {
+		return x.Generation
+	}
+	return 0
+}
+
+func (x *Reattach) GetReceived() uint64 {
+	if x != nil {
+		return x.Received
+	}
+	return 0
+}
+
+func (x *Reattach) GetProof() []byte {
+	if x != nil {
+		return x.Proof
+	}
+	return nil
+}
+
+type StreamFrame struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Stream        uint32                 `protobuf:"varint,1,opt,name=Stream,proto3" json:"Stream,omitempty"`
+	Type          FrameType              `protobuf:"varint,2,opt,name=Type,proto3,enum=box.FrameType" json:"Type,omitempty"`
+	Data          []byte                 `protobuf:"bytes,3,opt,name=Data,proto3" json:"Data,omitempty"`
+	Window        uint32                 `protobuf:"varint,4,opt,name=Window,proto3" json:"Window,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StreamFrame) Reset() {
+	*x = StreamFrame{}
+	mi := &file_stp_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StreamFrame) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamFrame) ProtoMessage() {}
+
+func (x *StreamFrame) ProtoReflect() protoreflect.Message {
+	mi := &file_stp_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamFrame.ProtoReflect.Descriptor instead.
+func (*StreamFrame) Descriptor() ([]byte, []int) {
+	return file_stp_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *StreamFrame) GetStream() uint32 {
+	if x != nil {
+		return x.Stream
+	}
+	return 0
+}
+
+func (x *StreamFrame) GetType() FrameType {
+	if x != nil {
+		return x.Type
+	}
+	return FrameType_Data
+}
+
+func (x *StreamFrame) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *StreamFrame) GetWindow() uint32 {
+	if x != nil {
+		return x.Window
+	}
+	return 0
+}
+
+type CallFrame struct {
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	ID      uint64                 `protobuf:"varint,1,opt,name=ID,proto3" json:"ID,omitempty"`
+	Type    CallType               `protobuf:"varint,2,opt,name=Type,proto3,enum=box.CallType" json:"Type,omitempty"`
+	Payload *anypb.Any             `protobuf:"bytes,3,opt,name=Payload,proto3" json:"Payload,omitempty"`
+	// Timeout is the time left until the caller gives up, relative to when the
+	// request was sent, so that it does not depend on the clocks being in sync.
+	Timeout       *durationpb.Duration `protobuf:"bytes,6,opt,name=Timeout,proto3" json:"Timeout,omitempty"`
+	Error         *CallError           `protobuf:"bytes,5,opt,name=Error,proto3" json:"Error,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CallFrame) Reset() {
+	*x = CallFrame{}
+	mi := &file_stp_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CallFrame) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CallFrame) ProtoMessage() {}
+
+func (x *CallFrame) ProtoReflect() protoreflect.Message {
+	mi := &file_stp_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CallFrame.ProtoReflect.Descriptor instead.
+func (*CallFrame) Descriptor() ([]byte, []int) {
+	return file_stp_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *CallFrame) GetID() uint64 {
+	if x != nil {
+		return x.ID
+	}
+	return 0
+}
+
+func (x *CallFrame) GetType() CallType {
+	if x != nil {
+		return x.Type
+	}
+	return CallType_Request
+}
+
+func (x *CallFrame) GetPayload() *anypb.Any {
+	if x != nil {
+		return x.Payload
+	}
+	return nil
+}
+
+func (x *CallFrame) GetTimeout() *durationpb.Duration {
+	if x != nil {
+		return x.Timeout
+	}
+	return nil
+}
+
+func (x *CallFrame) GetError() *CallError {
+	if x != nil {
+		return x.Error
+	}
+	return nil
+}
+
+type CallError struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Code          uint32                 `protobuf:"varint,1,opt,name=Code,proto3" json:"Code,omitempty"`
+	Message       string                 `protobuf:"bytes,2,opt,name=Message,proto3" json:"Message,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CallError) Reset() {
+	*x = CallError{}
+	mi := &file_stp_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CallError) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CallError) ProtoMessage() {}
+
+func (x *CallError) ProtoReflect() protoreflect.Message {
+	mi := &file_stp_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CallError.ProtoReflect.Descriptor instead.
+func (*CallError) Descriptor() ([]byte, []int) {
+	return file_stp_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *CallError) GetCode() uint32 {
+	if x != nil {
+		return x.Code
+	}
+	return 0
+}
+
+func (x *CallError) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+var File_stp_proto protoreflect.FileDescriptor
+
+const file_stp_proto_rawDesc = "" +
+	"\n" +
+	"\tstp.proto\x12\x03box\x1a\x19google/protobuf/any.proto\x1a\x1egoogle/protobuf/duration.proto\x1a\x1fgoogle/protobuf/timestamp.proto\"\xb8\x02\n" +
+	"\tIntroduce\x12\x18\n" +
+	"\apadding\x18\x01 \x01(\fR\apadding\x12\x16\n" +
+	"\x06Public\x18\x02 \x01(\fR\x06Public\x12\x18\n" +
+	"\aVersion\x18\x03 \x01(\rR\aVersion\x12\x16\n" +
+	"\x06Suites\x18\x04 \x03(\rR\x06Suites\x12\x1a\n" +
+	"\bFeatures\x18\x05 \x01(\rR\bFeatures\x12\x16\n" +
+	"\x06Ticket\x18\x06 \x01(\fR\x06Ticket\x12\x14\n" +
+	"\x05Nonce\x18\a \x01(\fR\x05Nonce\x12\x12\n" +
+	"\x04ECDH\x18\b \x01(\fR\x04ECDH\x12\x18\n" +
+	"\aResumed\x18\t \x01(\bR\aResumed\x12)\n" +
+	"\bReattach\x18\n" +
+	" \x01(\v2\r.box.ReattachR\bReattach\x12$\n" +
+	"\rSASCommitment\x18\v \x01(\fR\rSASCommitment\"\xe4\x01\n" +
+	"\x0fSignedTransport\x12\x12\n" +
+	"\x04Data\x18\x01 \x01(\fR\x04Data\x12\x1c\n" +
+	"\tSignature\x18\x02 \x01(\fR\tSignature\x12)\n" +
+	"\bMetadata\x18\x03 \x01(\v2\r.box.MetadataR\bMetadata\x12\x18\n" +
+	"\apadding\x18\x04 \x01(\fR\apadding\x12)\n" +
+	"\bFragment\x18\x05 \x01(\v2\r.box.FragmentR\bFragment\x12\x1d\n" +
+	"\x04Kind\x18\x06 \x01(\x0e2\t.box.KindR\x04Kind\x12\x10\n" +
+	"\x03Ack\x18\a \x01(\x04R\x03Ack\"]\n" +
+	"\rRatchetRecord\x12\x0e\n" +
+	"\x02DH\x18\x01 \x01(\fR\x02DH\x12\x0e\n" +
+	"\x02PN\x18\x02 \x01(\rR\x02PN\x12\f\n" +
+	"\x01N\x18\x03 \x01(\rR\x01N\x12\x1e\n" +
+	"\n" +
+	"Ciphertext\x18\x04 \x01(\fR\n" +
+	"Ciphertext\"6\n" +
+	"\bFragment\x12\x14\n" +
+	"\x05Index\x18\x01 \x01(\rR\x05Index\x12\x14\n" +
+	"\x05Total\x18\x02 \x01(\rR\x05Total\"`\n" +
+	"\bMetadata\x12\x1a\n" +
+	"\bSequence\x18\x01 \x01(\x04R\bSequence\x128\n" +
+	"\tTimestamp\x18\x02 \x01(\v2\x1a.google.protobuf.TimestampR\tTimestamp\"\xdc\x01\n" +
+	"\tHandshake\x12\x18\n" +
+	"\apadding\x18\x01 \x01(\fR\apadding\x12\x10\n" +
+	"\x03Key\x18\x02 \x01(\fR\x03Key\x12\x14\n" +
+	"\x05Nonce\x18\x03 \x01(\fR\x05Nonce\x12!\n" +
+	"\tSessionID\x18\x04 \x01(\tH\x00R\tSessionID\x88\x01\x01\x12\x12\n" +
+	"\x04ECDH\x18\x05 \x01(\fR\x04ECDH\x12\x18\n" +
+	"\aVersion\x18\x06 \x01(\rR\aVersion\x12\x14\n" +
+	"\x05Suite\x18\a \x01(\rR\x05Suite\x12\x18\n" +
+	"\aOffered\x18\b \x03(\rR\aOfferedB\f\n" +
+	"\n" +
+	"_SessionID\"B\n" +
+	"\bFinished\x12\x1c\n" +
+	"\tSignature\x18\x01 \x01(\fR\tSignature\x12\x18\n" +
+	"\aSASSalt\x18\x02 \x01(\fR\aSASSalt\"<\n" +
+	"\x06Ticket\x12\x16\n" +
+	"\x06Ticket\x18\x01 \x01(\fR\x06Ticket\x12\x1a\n" +
+	"\bLifetime\x18\x02 \x01(\rR\bLifetime\"\x85\x01\n" +
+	"\vTicketState\x12\x16\n" +
+	"\x06Secret\x18\x01 \x01(\fR\x06Secret\x12\x16\n" +
+	"\x06Remote\x18\x02 \x01(\fR\x06Remote\x12\x18\n" +
+	"\aVersion\x18\x03 \x01(\rR\aVersion\x12\x14\n" +
+	"\x05Suite\x18\x04 \x01(\rR\x05Suite\x12\x16\n" +
+	"\x06Expiry\x18\x05 \x01(\x03R\x06Expiry\"z\n" +
+	"\bReattach\x12\x1c\n" +
+	"\tSessionID\x18\x01 \x01(\tR\tSessionID\x12\x1e\n" +
+	"\n" +
+	"Generation\x18\x02 \x01(\x04R\n" +
+	"Generation\x12\x1a\n" +
+	"\bReceived\x18\x03 \x01(\x04R\bReceived\x12\x14\n" +
+	"\x05Proof\x18\x04 \x01(\fR\x05Proof\"u\n" +
+	"\vStreamFrame\x12\x16\n" +
+	"\x06Stream\x18\x01 \x01(\rR\x06Stream\x12\"\n" +
+	"\x04Type\x18\x02 \x01(\x0e2\x0e.box.FrameTypeR\x04Type\x12\x12\n" +
+	"\x04Data\x18\x03 \x01(\fR\x04Data\x12\x16\n" +
+	"\x06Window\x18\x04 \x01(\rR\x06Window\"\xd9\x01\n" +
+	"\tCallFrame\x12\x0e\n" +
+	"\x02ID\x18\x01 \x01(\x04R\x02ID\x12!\n" +
+	"\x04Type\x18\x02 \x01(\x0e2\r.box.CallTypeR\x04Type\x12.\n" +
+	"\aPayload\x18\x03 \x01(\v2\x14.google.protobuf.AnyR\aPayload\x123\n" +
+	"\aTimeout\x18\x06 \x01(\v2\x19.google.protobuf.DurationR\aTimeout\x12$\n" +
+	"\x05Error\x18\x05 \x01(\v2\x0e.box.CallErrorR\x05ErrorJ\x04\b\x04\x10\x05R\bDeadline\"9\n" +
+	"\tCallError\x12\x12\n" +
+	"\x04Code\x18\x01 \x01(\rR\x04Code\x12\x18\n" +
+	"\aMessage\x18\x02 \x01(\tR\aMessage*)\n" +
+	"\x04Kind\x12\v\n" +
+	"\aMessage\x10\x00\x12\t\n" +
+	"\x05Rekey\x10\x01\x12\t\n" +
+	"\x05Close\x10\x02*E\n" +
+	"\tFrameType\x12\b\n" +
+	"\x04Data\x10\x00\x12\b\n" +
+	"\x04Open\x10\x01\x12\x10\n" +
+	"\fWindowUpdate\x10\x02\x12\a\n" +
+	"\x03Fin\x10\x03\x12\t\n" +
+	"\x05Reset\x10\x04*1\n" +
+	"\bCallType\x12\v\n" +
+	"\aRequest\x10\x00\x12\f\n" +
+	"\bResponse\x10\x01\x12\n" +
 	"\n" +
-	"_SessionIDB\x06Z\x04./pbb\x06proto3"
+	"\x06Cancel\x10\x02B\x06Z\x04./pbb\x06proto3"
 
 var (
 	file_stp_proto_rawDescOnce sync.Once
@@ -298,22 +1225,45 @@ func file_stp_proto_rawDescGZIP() []byte {
 	return file_stp_proto_rawDescData
 }
 
-var file_stp_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_stp_proto_enumTypes = make([]protoimpl.EnumInfo, 3)
+var file_stp_proto_msgTypes = make([]protoimpl.MessageInfo, 13)
 var file_stp_proto_goTypes = []any{
-	(*Introduce)(nil),             // 0: box.Introduce
-	(*SignedTransport)(nil),       // 1: box.SignedTransport
-	(*Metadata)(nil),              // 2: box.Metadata
-	(*Handshake)(nil),             // 3: box.Handshake
-	(*timestamppb.Timestamp)(nil), // 4: google.protobuf.Timestamp
+	(Kind)(0),                     // 0: box.Kind
+	(FrameType)(0),                // 1: box.FrameType
+	(CallType)(0),                 // 2: box.CallType
+	(*Introduce)(nil),             // 3: box.Introduce
+	(*SignedTransport)(nil),       // 4: box.SignedTransport
+	(*RatchetRecord)(nil),         // 5: box.RatchetRecord
+	(*Fragment)(nil),              // 6: box.Fragment
+	(*Metadata)(nil),              // 7: box.Metadata
+	(*Handshake)(nil),             // 8: box.Handshake
+	(*Finished)(nil),              // 9: box.Finished
+	(*Ticket)(nil),                // 10: box.Ticket
+	(*TicketState)(nil),           // 11: box.TicketState
+	(*Reattach)(nil),              // 12: box.Reattach
+	(*StreamFrame)(nil),           // 13: box.StreamFrame
+	(*CallFrame)(nil),             // 14: box.CallFrame
+	(*CallError)(nil),             // 15: box.CallError
+	(*timestamppb.Timestamp)(nil), // 16: google.protobuf.Timestamp
+	(*anypb.Any)(nil),             // 17: google.protobuf.Any
+	(*durationpb.Duration)(nil),   // 18: google.protobuf.Duration
 }
 var file_stp_proto_depIdxs = []int32{
-	2, // 0: box.SignedTransport.Metadata:type_name -> box.Metadata
-	4, // 1: box.Metadata.Timestamp:type_name -> google.protobuf.Timestamp
-	2, // [2:2] is the sub-list for method output_type
-	2, // [2:2] is the sub-list for method input_type
-	2, // [2:2] is the sub-list for extension type_name
-	2, // [2:2] is the sub-list for extension extendee
-	0, // [0:2] is the sub-list for field type_name
+	12, // 0: box.Introduce.Reattach:type_name -> box.Reattach
+	7,  // 1: box.SignedTransport.Metadata:type_name -> box.Metadata
+	6,  // 2: box.SignedTransport.Fragment:type_name -> box.Fragment
+	0,  // 3: box.SignedTransport.Kind:type_name -> box.Kind
+	16, // 4: box.Metadata.Timestamp:type_name -> google.protobuf.Timestamp
+	1,  // 5: box.StreamFrame.Type:type_name -> box.FrameType
+	2,  // 6: box.CallFrame.Type:type_name -> box.CallType
+	17, // 7: box.CallFrame.Payload:type_name -> google.protobuf.Any
+	18, // 8: box.CallFrame.Timeout:type_name -> google.protobuf.Duration
+	15, // 9: box.CallFrame.Error:type_name -> box.CallError
+	10, // [10:10] is the sub-list for method output_type
+	10, // [10:10] is the sub-list for method input_type
+	10, // [10:10] is the sub-list for extension type_name
+	10, // [10:10] is the sub-list for extension extendee
+	0,  // [0:10] is the sub-list for field type_name
 }
 
 func init() { file_stp_proto_init() }
@@ -321,19 +1271,20 @@ func file_stp_proto_init() {
 	if File_stp_proto != nil {
 		return
 	}
-	file_stp_proto_msgTypes[3].OneofWrappers = []any{}
+	file_stp_proto_msgTypes[5].OneofWrappers = []any{}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_stp_proto_rawDesc), len(file_stp_proto_rawDesc)),
-			NumEnums:      0,
-			NumMessages:   4,
+			NumEnums:      3,
+			NumMessages:   13,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
 		GoTypes:           file_stp_proto_goTypes,
 		DependencyIndexes: file_stp_proto_depIdxs,
+		EnumInfos:         file_stp_proto_enumTypes,
 		MessageInfos:      file_stp_proto_msgTypes,
 	}.Build()
 	File_stp_proto = out.File
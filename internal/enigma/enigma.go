@@ -1,6 +1,7 @@
 package enigma
 
 import (
+	"crypto/aes"
 	"crypto/cipher"
 	"crypto/sha512"
 	"encoding/binary"
@@ -14,6 +15,7 @@ import (
 )
 
 const (
+	keySize       = chacha20poly1305.KeySize
 	nonceSize     = chacha20poly1305.NonceSize
 	uint64Size    = int(unsafe.Sizeof(uint64(0)))
 	BaseNonceSize = nonceSize - uint64Size
@@ -22,31 +24,68 @@ const (
 var (
 	ErrInvalidNonceLength = errors.New("bad nonce length")
 
-	C2S    = []byte("client-to-server-cipher")
-	S2C    = []byte("server-to-client-cipher")
-	hasher = sha512.New
+	C2S       = []byte("client-to-server-cipher")
+	S2C       = []byte("server-to-client-cipher")
+	keyUpdate = []byte("kamune key update")
+	hasher    = sha512.New
+)
+
+// Cipher creates an AEAD from a 256-bit key. Its nonce must be nonceSize
+// bytes long.
+type Cipher func(key []byte) (cipher.AEAD, error)
+
+var (
+	ChaCha20Poly1305 Cipher = chacha20poly1305.New
+	AES256GCM        Cipher = newAESGCM
 )
 
 type Enigma struct {
+	cipher    Cipher
+	key       []byte
 	aead      cipher.AEAD
 	baseNonce []byte
 }
 
+// NewEnigma creates an Enigma that uses ChaCha20-Poly1305.
 func NewEnigma(secret, baseNonce, info []byte) (*Enigma, error) {
+	return NewEnigmaWith(ChaCha20Poly1305, secret, baseNonce, info)
+}
+
+// NewEnigmaWith creates an Enigma that uses the given cipher.
+func NewEnigmaWith(c Cipher, secret, baseNonce, info []byte) (*Enigma, error) {
 	if len(baseNonce) != BaseNonceSize {
 		return nil, ErrInvalidNonceLength
 	}
-	r := hkdf.Expand(hasher, secret, info)
-	key := make([]byte, chacha20poly1305.KeySize)
-	if _, err := io.ReadFull(r, key); err != nil {
-		return nil, fmt.Errorf("read key: %w", err)
+	key, err := expand(secret, info)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := c(key)
+	if err != nil {
+		return nil, fmt.Errorf("creating cipher: %w", err)
+	}
+
+	return &Enigma{cipher: c, key: key, aead: aead, baseNonce: baseNonce}, nil
+}
+
+// Ratchet replaces the key with a new one, derived from the current key
+// through HKDF. The current key is wiped, so messages that were encrypted
+// before the call can no longer be decrypted, and the new key reveals nothing
+// about the old one. Both parties must ratchet at the same point of the stream.
+func (e *Enigma) Ratchet() error {
+	key, err := expand(e.key, keyUpdate)
+	if err != nil {
+		return err
 	}
-	aead, err := chacha20poly1305.New(key)
+	aead, err := e.cipher(key)
 	if err != nil {
-		return nil, fmt.Errorf("chacha20poly1305: %w", err)
+		clear(key)
+		return fmt.Errorf("creating cipher: %w", err)
 	}
+	clear(e.key)
+	e.key, e.aead = key, aead
 
-	return &Enigma{aead: aead, baseNonce: baseNonce}, nil
+	return nil
 }
 
 func (e *Enigma) Encrypt(plaintext []byte, counter uint64) []byte {
@@ -57,9 +96,44 @@ func (e *Enigma) Decrypt(ciphertext []byte, counter uint64) ([]byte, error) {
 	return e.aead.Open(nil, e.nonce(counter), ciphertext, nil)
 }
 
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func expand(secret, info []byte) ([]byte, error) {
+	r := hkdf.Expand(hasher, secret, info)
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, fmt.Errorf("read key: %w", err)
+	}
+	return key, nil
+}
+
 func (e *Enigma) nonce(counter uint64) []byte {
 	nonce := make([]byte, nonceSize)
 	copy(nonce[:BaseNonceSize], e.baseNonce)
 	binary.LittleEndian.PutUint64(nonce[BaseNonceSize:], counter)
 	return nonce
 }
+
+// Combine derives a single secret from the shared secrets of several key
+// exchanges. The result stays secret as long as at least one of the inputs
+// does. salt and info bind the secret to its context, such as the handshake
+// transcript and the exchanged public keys.
+func Combine(salt, info []byte, secrets ...[]byte) ([]byte, error) {
+	var ikm []byte
+	for _, s := range secrets {
+		ikm = append(ikm, s...)
+	}
+	r := hkdf.New(hasher, ikm, salt, info)
+	secret := make([]byte, hasher().Size())
+	if _, err := io.ReadFull(r, secret); err != nil {
+		return nil, fmt.Errorf("read secret: %w", err)
+	}
+
+	return secret, nil
+}
@@ -7,6 +7,29 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+func TestAES256GCM(t *testing.T) {
+	a := require.New(t)
+	msg := []byte("May tomorrow be a better day")
+	secret := []byte("let this be our secret")
+	baseNonce := make([]byte, BaseNonceSize)
+	rand.Read(baseNonce)
+
+	eng, err := NewEnigmaWith(AES256GCM, secret, baseNonce, C2S)
+	a.NoError(err)
+	a.NotNil(eng)
+
+	encrypted := eng.Encrypt(msg, 1)
+	a.NotNil(encrypted)
+	a.NotEqual(msg, encrypted)
+
+	decrypted, err := eng.Decrypt(encrypted, 1)
+	a.NoError(err)
+	a.Equal(msg, decrypted)
+
+	_, err = eng.Decrypt(encrypted, 2)
+	a.Error(err)
+}
+
 func TestChaCha20Poly1305(t *testing.T) {
 	a := require.New(t)
 	msg := []byte("May tomorrow be a better day")
@@ -27,3 +50,59 @@ func TestChaCha20Poly1305(t *testing.T) {
 	a.NotNil(decrypted)
 	a.Equal(msg, decrypted)
 }
+
+func TestCombine(t *testing.T) {
+	a := require.New(t)
+	s1, s2 := []byte("first secret"), []byte("second secret")
+	salt, info := []byte("transcript"), []byte("context")
+
+	c1, err := Combine(salt, info, s1, s2)
+	a.NoError(err)
+	a.Len(c1, hasher().Size())
+
+	c2, err := Combine(salt, info, s1, s2)
+	a.NoError(err)
+	a.Equal(c1, c2)
+
+	c3, err := Combine(salt, info, s1, []byte("other secret"))
+	a.NoError(err)
+	a.NotEqual(c1, c3)
+
+	c4, err := Combine(salt, []byte("other context"), s1, s2)
+	a.NoError(err)
+	a.NotEqual(c1, c4)
+
+	c5, err := Combine([]byte("other transcript"), info, s1, s2)
+	a.NoError(err)
+	a.NotEqual(c1, c5)
+}
+
+func TestRatchet(t *testing.T) {
+	a := require.New(t)
+	msg := []byte("May tomorrow be a better day")
+	secret := []byte("let this be our secret")
+	baseNonce := make([]byte, BaseNonceSize)
+	rand.Read(baseNonce)
+
+	sender, err := NewEnigma(secret, baseNonce, C2S)
+	a.NoError(err)
+	receiver, err := NewEnigma(secret, baseNonce, C2S)
+	a.NoError(err)
+
+	old := sender.key
+	before := sender.Encrypt(msg, 1)
+	a.NoError(sender.Ratchet())
+	a.Equal(make([]byte, keySize), old)
+	after := sender.Encrypt(msg, 1)
+	a.NotEqual(before, after)
+
+	_, err = receiver.Decrypt(after, 1)
+	a.Error(err)
+	a.NoError(receiver.Ratchet())
+	decrypted, err := receiver.Decrypt(after, 1)
+	a.NoError(err)
+	a.Equal(msg, decrypted)
+
+	_, err = receiver.Decrypt(before, 1)
+	a.Error(err)
+}
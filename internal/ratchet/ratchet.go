@@ -0,0 +1,321 @@
+// Package ratchet implements the Double Ratchet algorithm. Every message is
+// encrypted with a key of its own, which is deleted once used. Keys are
+// derived from symmetric chains that are themselves reseeded by a
+// Diffie-Hellman ratchet on X25519 whenever the direction of the conversation
+// changes. See https://signal.org/docs/specifications/doubleratchet/.
+package ratchet
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/hossein1376/kamune/internal/enigma"
+	"github.com/hossein1376/kamune/internal/exchange"
+)
+
+const (
+	keySize = 32
+
+	// DefaultMaxSkip is the default number of message keys that are kept for
+	// the messages that have not arrived yet.
+	DefaultMaxSkip = 1000
+)
+
+var (
+	ErrTooManySkipped = errors.New("too many skipped messages")
+	ErrNotReady       = errors.New("no message has been received yet")
+	ErrDecryption     = errors.New("message authentication failed")
+
+	rootLabel    = []byte("kamune double ratchet root")
+	ratchetLabel = []byte("kamune double ratchet")
+	hasher       = sha512.New
+)
+
+// Header is sent in the clear alongside each message. It carries the sender's
+// current ratchet public key, the length of its previous sending chain, and
+// the number of the message in the current chain.
+type Header struct {
+	DH []byte
+	PN uint32
+	N  uint32
+}
+
+func (h Header) bytes() []byte {
+	b := slices.Clone(h.DH)
+	b = binary.BigEndian.AppendUint32(b, h.PN)
+	return binary.BigEndian.AppendUint32(b, h.N)
+}
+
+type skippedKey struct {
+	dh string
+	n  uint32
+}
+
+type state struct {
+	dh      *exchange.ECDH
+	remote  []byte
+	root    []byte
+	send    []byte
+	recv    []byte
+	ns, nr  uint32
+	pn      uint32
+	skipped map[skippedKey][]byte
+	order   []skippedKey
+}
+
+func (s *state) clone() *state {
+	c := *s
+	c.skipped = maps.Clone(s.skipped)
+	c.order = slices.Clone(s.order)
+	return &c
+}
+
+// Ratchet is one party's end of a double ratchet session. It is safe for
+// concurrent use.
+type Ratchet struct {
+	mu      sync.Mutex
+	cipher  enigma.Cipher
+	maxSkip int
+	st      *state
+}
+
+// NewInitiator creates the ratchet of the party that sends the first message.
+// remote is the other party's initial ratchet public key.
+func NewInitiator(
+	c enigma.Cipher, secret, remote []byte, maxSkip int,
+) (*Ratchet, error) {
+	dh, err := exchange.NewECDH()
+	if err != nil {
+		return nil, fmt.Errorf("creating ratchet key: %w", err)
+	}
+	root, err := rootKey(secret)
+	if err != nil {
+		return nil, err
+	}
+	st := &state{
+		dh:      dh,
+		remote:  slices.Clone(remote),
+		skipped: make(map[skippedKey][]byte),
+	}
+	out, err := dh.Exchange(remote)
+	if err != nil {
+		return nil, fmt.Errorf("exchanging ratchet keys: %w", err)
+	}
+	if st.root, st.send, err = kdfRoot(root, out); err != nil {
+		return nil, err
+	}
+
+	return &Ratchet{cipher: c, maxSkip: maxSkip, st: st}, nil
+}
+
+// NewResponder creates the ratchet of the party that receives the first
+// message. own is the key pair whose public key the initiator was given.
+func NewResponder(
+	c enigma.Cipher, secret []byte, own *exchange.ECDH, maxSkip int,
+) (*Ratchet, error) {
+	root, err := rootKey(secret)
+	if err != nil {
+		return nil, err
+	}
+	st := &state{
+		dh:      own,
+		root:    root,
+		skipped: make(map[skippedKey][]byte),
+	}
+
+	return &Ratchet{cipher: c, maxSkip: maxSkip, st: st}, nil
+}
+
+// Encrypt encrypts plaintext with the next message key of the sending chain.
+// ad is authenticated, but not encrypted.
+func (r *Ratchet) Encrypt(plaintext, ad []byte) (Header, []byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.st.send == nil {
+		return Header{}, nil, ErrNotReady
+	}
+
+	send, mk := kdfChain(r.st.send)
+	clear(r.st.send)
+	r.st.send = send
+	h := Header{DH: r.st.dh.MarshalPublicKey(), PN: r.st.pn, N: r.st.ns}
+	r.st.ns++
+	ct, err := r.seal(mk, plaintext, slices.Concat(ad, h.bytes()))
+	if err != nil {
+		return Header{}, nil, err
+	}
+
+	return h, ct, nil
+}
+
+// Decrypt decrypts a message, advancing the ratchet as needed. Keys of the
+// messages that were skipped along the way are kept, so they can still be
+// decrypted if they arrive later. The state is only updated if the message
+// is authentic.
+func (r *Ratchet) Decrypt(h Header, ciphertext, ad []byte) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ad = slices.Concat(ad, h.bytes())
+
+	key := skippedKey{dh: string(h.DH), n: h.N}
+	if mk, ok := r.st.skipped[key]; ok {
+		plaintext, err := r.open(mk, ciphertext, ad)
+		if err != nil {
+			return nil, err
+		}
+		delete(r.st.skipped, key)
+		r.st.order = slices.DeleteFunc(r.st.order, func(k skippedKey) bool {
+			return k == key
+		})
+		clear(mk)
+		return plaintext, nil
+	}
+
+	st := r.st.clone()
+	if !bytes.Equal(h.DH, st.remote) {
+		if err := r.skip(st, h.PN); err != nil {
+			return nil, err
+		}
+		if err := st.step(h); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.skip(st, h.N); err != nil {
+		return nil, err
+	}
+	recv, mk := kdfChain(st.recv)
+	st.recv = recv
+	st.nr++
+	plaintext, err := r.open(mk, ciphertext, ad)
+	clear(mk)
+	if err != nil {
+		return nil, err
+	}
+	r.st = st
+	r.st.evict(r.maxSkip)
+
+	return plaintext, nil
+}
+
+// skip stores the keys of the messages of the receiving chain, up to until.
+func (r *Ratchet) skip(st *state, until uint32) error {
+	if st.recv == nil {
+		return nil
+	}
+	if until < st.nr {
+		return ErrDecryption
+	}
+	if until-st.nr > uint32(r.maxSkip) {
+		return ErrTooManySkipped
+	}
+	for st.nr < until {
+		recv, mk := kdfChain(st.recv)
+		st.recv = recv
+		key := skippedKey{dh: string(st.remote), n: st.nr}
+		st.skipped[key] = mk
+		st.order = append(st.order, key)
+		st.nr++
+	}
+
+	return nil
+}
+
+// evict drops the oldest skipped keys, so at most max of them are kept.
+func (st *state) evict(max int) {
+	for len(st.order) > max {
+		clear(st.skipped[st.order[0]])
+		delete(st.skipped, st.order[0])
+		st.order = st.order[1:]
+	}
+}
+
+// step performs a Diffie-Hellman ratchet step, once the remote party has
+// moved to a new ratchet key.
+func (st *state) step(h Header) error {
+	st.pn, st.ns, st.nr = st.ns, 0, 0
+	st.remote = slices.Clone(h.DH)
+
+	out, err := st.dh.Exchange(st.remote)
+	if err != nil {
+		return fmt.Errorf("exchanging ratchet keys: %w", err)
+	}
+	if st.root, st.recv, err = kdfRoot(st.root, out); err != nil {
+		return err
+	}
+	if st.dh, err = exchange.NewECDH(); err != nil {
+		return fmt.Errorf("creating ratchet key: %w", err)
+	}
+	if out, err = st.dh.Exchange(st.remote); err != nil {
+		return fmt.Errorf("exchanging ratchet keys: %w", err)
+	}
+	if st.root, st.send, err = kdfRoot(st.root, out); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// seal encrypts with a message key. As each key is only ever used once, the
+// nonce is fixed.
+func (r *Ratchet) seal(mk, plaintext, ad []byte) ([]byte, error) {
+	defer clear(mk)
+	aead, err := r.cipher(mk)
+	if err != nil {
+		return nil, fmt.Errorf("creating cipher: %w", err)
+	}
+	return aead.Seal(nil, make([]byte, aead.NonceSize()), plaintext, ad), nil
+}
+
+func (r *Ratchet) open(mk, ciphertext, ad []byte) ([]byte, error) {
+	aead, err := r.cipher(mk)
+	if err != nil {
+		return nil, fmt.Errorf("creating cipher: %w", err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	plaintext, err := aead.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		return nil, ErrDecryption
+	}
+	return plaintext, nil
+}
+
+func rootKey(secret []byte) ([]byte, error) {
+	root := make([]byte, keySize)
+	r := hkdf.Expand(hasher, secret, rootLabel)
+	if _, err := io.ReadFull(r, root); err != nil {
+		return nil, fmt.Errorf("deriving root key: %w", err)
+	}
+	return root, nil
+}
+
+// kdfRoot mixes the output of a Diffie-Hellman exchange into the root key,
+// returning the next root key and a new chain key.
+func kdfRoot(root, dhOut []byte) (nextRoot, chain []byte, err error) {
+	out := make([]byte, 2*keySize)
+	r := hkdf.New(hasher, dhOut, root, ratchetLabel)
+	if _, err := io.ReadFull(r, out); err != nil {
+		return nil, nil, fmt.Errorf("deriving root key: %w", err)
+	}
+	return out[:keySize], out[keySize:], nil
+}
+
+// kdfChain returns the next chain key and a message key.
+func kdfChain(chain []byte) (next, mk []byte) {
+	return mac(chain, 0x02), mac(chain, 0x01)
+}
+
+func mac(key []byte, b byte) []byte {
+	m := hmac.New(hasher, key)
+	m.Write([]byte{b})
+	return m.Sum(nil)[:keySize]
+}
@@ -0,0 +1,148 @@
+package ratchet
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/hossein1376/kamune/internal/enigma"
+	"github.com/hossein1376/kamune/internal/exchange"
+)
+
+type sealed struct {
+	h  Header
+	ct []byte
+}
+
+func newPair(t *testing.T, maxSkip int) (alice, bob *Ratchet) {
+	t.Helper()
+	a := require.New(t)
+	secret := []byte("shared secret of the handshake")
+	bobKey, err := exchange.NewECDH()
+	a.NoError(err)
+
+	alice, err = NewInitiator(
+		enigma.ChaCha20Poly1305, secret, bobKey.MarshalPublicKey(), maxSkip,
+	)
+	a.NoError(err)
+	bob, err = NewResponder(enigma.ChaCha20Poly1305, secret, bobKey, maxSkip)
+	a.NoError(err)
+
+	return alice, bob
+}
+
+func encrypt(t *testing.T, r *Ratchet, msg string) sealed {
+	t.Helper()
+	h, ct, err := r.Encrypt([]byte(msg), nil)
+	require.NoError(t, err)
+	return sealed{h: h, ct: ct}
+}
+
+func TestRatchet_Conversation(t *testing.T) {
+	a := require.New(t)
+	alice, bob := newPair(t, DefaultMaxSkip)
+
+	_, _, err := bob.Encrypt([]byte("too early"), nil)
+	a.ErrorIs(err, ErrNotReady)
+
+	var keys []string
+	for round := range 5 {
+		for i := range round + 1 {
+			msg := fmt.Sprintf("alice %d.%d", round, i)
+			s := encrypt(t, alice, msg)
+			keys = append(keys, string(s.h.DH))
+			got, err := bob.Decrypt(s.h, s.ct, nil)
+			a.NoError(err)
+			a.Equal(msg, string(got))
+		}
+		msg := fmt.Sprintf("bob %d", round)
+		s := encrypt(t, bob, msg)
+		got, err := alice.Decrypt(s.h, s.ct, nil)
+		a.NoError(err)
+		a.Equal(msg, string(got))
+	}
+
+	// Alice moves to a new ratchet key after each of Bob's replies.
+	a.NotEqual(keys[0], keys[len(keys)-1])
+}
+
+func TestRatchet_OutOfOrder(t *testing.T) {
+	a := require.New(t)
+	alice, bob := newPair(t, DefaultMaxSkip)
+
+	var msgs []sealed
+	for i := range 5 {
+		msgs = append(msgs, encrypt(t, alice, fmt.Sprint(i)))
+	}
+	for _, i := range []int{3, 0, 4, 2, 1} {
+		got, err := bob.Decrypt(msgs[i].h, msgs[i].ct, nil)
+		a.NoError(err)
+		a.Equal(fmt.Sprint(i), string(got))
+	}
+
+	// Message keys are deleted once used.
+	_, err := bob.Decrypt(msgs[2].h, msgs[2].ct, nil)
+	a.Error(err)
+
+	// Skipped messages of a previous chain are still accepted.
+	late := encrypt(t, alice, "late")
+	reply := encrypt(t, bob, "reply")
+	_, err = alice.Decrypt(reply.h, reply.ct, nil)
+	a.NoError(err)
+	next := encrypt(t, alice, "next")
+	got, err := bob.Decrypt(next.h, next.ct, nil)
+	a.NoError(err)
+	a.Equal("next", string(got))
+	got, err = bob.Decrypt(late.h, late.ct, nil)
+	a.NoError(err)
+	a.Equal("late", string(got))
+}
+
+func TestRatchet_MaxSkip(t *testing.T) {
+	a := require.New(t)
+	alice, bob := newPair(t, 3)
+
+	var msgs []sealed
+	for i := range 9 {
+		msgs = append(msgs, encrypt(t, alice, fmt.Sprint(i)))
+	}
+	_, err := bob.Decrypt(msgs[8].h, msgs[8].ct, nil)
+	a.ErrorIs(err, ErrTooManySkipped)
+
+	_, err = bob.Decrypt(msgs[3].h, msgs[3].ct, nil)
+	a.NoError(err)
+	_, err = bob.Decrypt(msgs[7].h, msgs[7].ct, nil)
+	a.NoError(err)
+	a.Len(bob.st.skipped, 3)
+
+	// The oldest skipped keys were evicted to keep the cache bounded.
+	_, err = bob.Decrypt(msgs[0].h, msgs[0].ct, nil)
+	a.Error(err)
+	_, err = bob.Decrypt(msgs[4].h, msgs[4].ct, nil)
+	a.NoError(err)
+}
+
+func TestRatchet_Tampered(t *testing.T) {
+	a := require.New(t)
+	alice, bob := newPair(t, DefaultMaxSkip)
+
+	s := encrypt(t, alice, "authentic")
+	ct := append([]byte(nil), s.ct...)
+	ct[0] ^= 0xFF
+	_, err := bob.Decrypt(s.h, ct, nil)
+	a.ErrorIs(err, ErrDecryption)
+
+	h := s.h
+	h.N++
+	_, err = bob.Decrypt(h, s.ct, nil)
+	a.ErrorIs(err, ErrDecryption)
+
+	_, err = bob.Decrypt(s.h, s.ct, []byte("other context"))
+	a.ErrorIs(err, ErrDecryption)
+
+	// Failed attempts leave the state untouched.
+	got, err := bob.Decrypt(s.h, s.ct, nil)
+	a.NoError(err)
+	a.Equal("authentic", string(got))
+}
@@ -2,11 +2,12 @@ package kamune
 
 import (
 	"bufio"
-	"encoding/base64"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
 
+	"golang.org/x/term"
 	"google.golang.org/protobuf/proto"
 
 	"github.com/hossein1376/kamune/internal/attest"
@@ -15,11 +16,51 @@ import (
 
 type RemoteVerifier func(key *attest.PublicKey) (err error)
 
-func defaultRemoteVerifier(remote *attest.PublicKey) error {
-	key := base64.StdEncoding.EncodeToString(remote.Marshal())
-	keyBytes := []byte(key)
-	fmt.Printf("Peer's public key: %s\n", key)
-	known := isPeerKnown(keyBytes)
+// peer adapts v to a PeerVerifier.
+func (v RemoteVerifier) peer() PeerVerifier {
+	return func(p *Peer) error { return v(p.PublicKey()) }
+}
+
+// keyChangedWarning is shown when a known host presents a different key.
+const keyChangedWarning = `@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@
+@         WARNING: REMOTE IDENTITY HAS CHANGED!             @
+@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@
+Someone could be impersonating the peer, or the peer has replaced its key.
+If the change is expected, remove the old key from the trusted list.`
+
+// askToTrust asks the user on the terminal whether the remote party is
+// trusted, and pins the key of trusted peers in ts. A host that presents a
+// different key than the pinned one is refused without asking. If there is no
+// terminal to ask on, only the known peers are trusted.
+func askToTrust(ts *TrustStore, p *Peer) error {
+	key := p.PublicKey()
+	interactive := isTerminal(os.Stdin)
+	if interactive {
+		fmt.Printf("Peer's public key: %s\n", p.Fingerprint())
+	}
+
+	var known bool
+	host := pinHost(p)
+	if p.Direction() == Inbound || p.Host() == "" {
+		// Clients of a server have no stable address, so they are only
+		// recognized by their keys.
+		known = ts.Known(key)
+	} else {
+		err := ts.Check(host, key)
+		switch {
+		case err == nil:
+			known = true
+		case errors.Is(err, ErrKeyChanged):
+			fmt.Println(keyChangedWarning)
+			return reject(p, ReasonKeyChanged, err)
+		}
+	}
+	if !interactive {
+		if known {
+			return nil
+		}
+		return reject(p, ReasonDeclined, errors.New("no terminal to ask on"))
+	}
 	if !known {
 		fmt.Println("Peer is not known. They will be added to the trusted list if you continue.")
 	}
@@ -29,50 +70,108 @@ func defaultRemoteVerifier(remote *attest.PublicKey) error {
 	b.Scan()
 	answer := strings.TrimSpace(strings.ToLower(b.Text()))
 	if !(answer == "y" || answer == "yes") {
-		return ErrVerificationFailed
+		return reject(p, ReasonDeclined, nil)
 	}
 
 	if !known {
-		if err := trustPeer(keyBytes); err != nil {
-			fmt.Printf("Error adding peer to the trusted list: %s\n", err)
+		// The key is pinned once the peer has proven that it holds it.
+		p.onEstablished(func() error {
+			if err := ts.Replace(host, key, ""); err != nil {
+				fmt.Printf("Error adding peer to the trusted list: %s\n", err)
+				return nil
+			}
+			fmt.Println("Peer was added to the trusted list.")
 			return nil
-		}
-		fmt.Println("Peer was added to the trusted list.")
+		})
 	}
 
 	return nil
 }
 
-func sendIntroduction(conn Conn, at *attest.Attest) error {
-	intro := &pb.Introduce{
-		Public:  at.MarshalPublicKey(),
-		Padding: padding(introducePadding),
+// isTerminal reports whether f is an interactive terminal.
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// introduction is what the remote party has advertised about itself.
+type introduction struct {
+	remote   *attest.PublicKey
+	version  uint32
+	suites   []uint32
+	features uint32
+	// ticket, nonce and ecdh are set when resumption is attempted, and
+	// resumed is set by the server once it accepts it.
+	ticket  []byte
+	nonce   []byte
+	ecdh    []byte
+	resumed bool
+	// sasCommitment is the client's commitment to its SAS salt.
+	sasCommitment []byte
+	// reattach is set when a client moves an existing session to this
+	// connection. No other field is set then.
+	reattach *pb.Reattach
+}
+
+// newIntroduce creates the introduction message that advertises the identity,
+// the supported suites and the optional features.
+func newIntroduce(
+	at *attest.Attest, suites []CipherSuite, features uint32,
+) *pb.Introduce {
+	return &pb.Introduce{
+		Public:   at.MarshalPublicKey(),
+		Version:  ProtocolVersion,
+		Suites:   suitesToWire(suites),
+		Features: features,
 	}
+}
+
+func sendIntroduction(
+	conn *Conn, intro *pb.Introduce, tr *transcript,
+) error {
+	intro.Padding = padding(introducePadding)
 	introBytes, err := proto.Marshal(intro)
 	if err != nil {
 		return fmt.Errorf("marshalling: %w", err)
 	}
-	if _, err := conn.Write(introBytes); err != nil {
+	tr.add(introBytes)
+	if err := writeRecord(conn, introBytes); err != nil {
 		return fmt.Errorf("writing: %w", err)
 	}
 
 	return nil
 }
 
-func receiveIntroduction(conn Conn) (*attest.PublicKey, error) {
-	payload, err := read(conn)
+func receiveIntroduction(
+	conn *Conn, tr *transcript,
+) (*introduction, error) {
+	payload, err := readRecord(conn)
 	if err != nil {
 		return nil, fmt.Errorf("reading payload: %w", err)
 	}
+	tr.add(payload)
 	var introduce pb.Introduce
 	err = proto.Unmarshal(payload, &introduce)
 	if err != nil {
 		return nil, fmt.Errorf("deserializing: %w", err)
 	}
+	if r := introduce.GetReattach(); r != nil {
+		return &introduction{reattach: r}, nil
+	}
 	remote, err := attest.ParsePublicKey(introduce.GetPublic())
 	if err != nil {
 		return nil, fmt.Errorf("parsing advertised key: %w", err)
 	}
 
-	return remote, nil
+	return &introduction{
+		remote:   remote,
+		version:  introduce.GetVersion(),
+		suites:   introduce.GetSuites(),
+		features: introduce.GetFeatures(),
+		ticket:   introduce.GetTicket(),
+		nonce:    introduce.GetNonce(),
+		ecdh:     introduce.GetECDH(),
+		resumed:  introduce.GetResumed(),
+
+		sasCommitment: introduce.GetSASCommitment(),
+	}, nil
 }
@@ -0,0 +1,196 @@
+package kamune
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/term"
+
+	"github.com/hossein1376/kamune/internal/attest"
+)
+
+var (
+	ErrKeyNotFound = errors.New("identity key not found")
+	// ErrKeyEncrypted is returned when the identity key is encrypted, but no
+	// passphrase has been provided.
+	ErrKeyEncrypted    = attest.ErrEncrypted
+	ErrWrongPassphrase = attest.ErrWrongPassphrase
+)
+
+// PassphraseFunc returns the passphrase that protects the identity key. It is
+// only called when needed, that is, when an encrypted key is loaded or a new
+// key is saved.
+type PassphraseFunc func() ([]byte, error)
+
+// PromptPassphrase returns a PassphraseFunc that reads the passphrase from
+// the terminal, without echoing it. It fails if stdin is not a terminal.
+func PromptPassphrase(prompt string) PassphraseFunc {
+	return func() ([]byte, error) {
+		if !isTerminal(os.Stdin) {
+			return nil, errors.New("stdin is not a terminal")
+		}
+		fmt.Fprint(os.Stderr, prompt)
+		pass, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, fmt.Errorf("reading passphrase: %w", err)
+		}
+		return pass, nil
+	}
+}
+
+// KeyStore persists the local identity. Load must return ErrKeyNotFound if
+// no identity has been saved yet, so a new one can be created on demand.
+type KeyStore interface {
+	Load() (*attest.Attest, error)
+	Save(at *attest.Attest) error
+}
+
+// FileKeyStore keeps the identity as a PEM encoded file inside a directory.
+// The directory is only created once an identity is saved. The key is stored
+// unencrypted, unless a passphrase is set with SetPassphrase.
+type FileKeyStore struct {
+	dir        string
+	passphrase PassphraseFunc
+}
+
+// NewFileKeyStore returns a FileKeyStore that uses dir.
+func NewFileKeyStore(dir string) *FileKeyStore {
+	return &FileKeyStore{dir: dir}
+}
+
+// DefaultFileKeyStore returns a FileKeyStore in $XDG_CONFIG_HOME/kamune, or in
+// ~/.config/kamune if the variable is not set.
+func DefaultFileKeyStore() (*FileKeyStore, error) {
+	dir, err := configDir()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewFileKeyStore(dir), nil
+}
+
+// Dir returns the directory the keys are stored in.
+func (fs *FileKeyStore) Dir() string {
+	return fs.dir
+}
+
+// SetPassphrase sets the function that provides the passphrase. An encrypted
+// key is decrypted with it, and a new key is encrypted with it, unless it
+// returns an empty passphrase.
+func (fs *FileKeyStore) SetPassphrase(fn PassphraseFunc) {
+	fs.passphrase = fn
+}
+
+func (fs *FileKeyStore) Load() (*attest.Attest, error) {
+	at, err := attest.LoadWithPassphrase(fs.path(), toAttest(fs.passphrase))
+	if err != nil {
+		if errors.Is(err, attest.ErrMissingFile) {
+			return nil, ErrKeyNotFound
+		}
+		return nil, err
+	}
+
+	return at, nil
+}
+
+func (fs *FileKeyStore) Save(at *attest.Attest) error {
+	var pass []byte
+	if fs.passphrase != nil {
+		var err error
+		if pass, err = fs.passphrase(); err != nil {
+			return fmt.Errorf("reading passphrase: %w", err)
+		}
+	}
+	if err := os.MkdirAll(fs.dir, 0700); err != nil {
+		return fmt.Errorf("MkdirAll: %w", err)
+	}
+	if err := at.SaveEncrypted(fs.path(), pass); err != nil {
+		return fmt.Errorf("saving key: %w", err)
+	}
+
+	return nil
+}
+
+// ChangePassphrase re-encrypts the stored key with newPassphrase. The current
+// passphrase is taken from old, which is only called if the key is encrypted.
+// An empty newPassphrase removes the encryption.
+func (fs *FileKeyStore) ChangePassphrase(
+	old PassphraseFunc, newPassphrase []byte,
+) error {
+	err := attest.ChangePassphrase(
+		fs.path(), toAttest(old), newPassphrase,
+	)
+	if errors.Is(err, attest.ErrMissingFile) {
+		return ErrKeyNotFound
+	}
+	return err
+}
+
+// toAttest converts fn, which may be nil, for use with the attest package.
+// A nil fn reports the key as encrypted.
+func toAttest(fn PassphraseFunc) attest.Passphrase {
+	if fn == nil {
+		return func() ([]byte, error) { return nil, ErrKeyEncrypted }
+	}
+	return attest.Passphrase(fn)
+}
+
+func (fs *FileKeyStore) path() string {
+	return filepath.Join(fs.dir, keyName)
+}
+
+// MemoryKeyStore keeps the identity in memory only. It is mostly useful for
+// tests and short-lived processes.
+type MemoryKeyStore struct {
+	mu     sync.Mutex
+	attest *attest.Attest
+}
+
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{}
+}
+
+func (ms *MemoryKeyStore) Load() (*attest.Attest, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.attest == nil {
+		return nil, ErrKeyNotFound
+	}
+
+	return ms.attest, nil
+}
+
+func (ms *MemoryKeyStore) Save(at *attest.Attest) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.attest = at
+
+	return nil
+}
+
+// loadOrCreate loads the identity from the store, and creates and saves a new
+// one if it does not exist yet.
+func loadOrCreate(ks KeyStore) (*attest.Attest, error) {
+	at, err := ks.Load()
+	switch {
+	case err == nil:
+		return at, nil
+	case errors.Is(err, ErrKeyNotFound):
+	default:
+		return nil, fmt.Errorf("loading key: %w", err)
+	}
+
+	at, err = attest.New()
+	if err != nil {
+		return nil, fmt.Errorf("new attest: %w", err)
+	}
+	if err := ks.Save(at); err != nil {
+		return nil, fmt.Errorf("saving key: %w", err)
+	}
+
+	return at, nil
+}
@@ -0,0 +1,95 @@
+package kamune
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileKeyStore(t *testing.T) {
+	a := require.New(t)
+	dir := filepath.Join(t.TempDir(), "nested", "kamune")
+	ks := NewFileKeyStore(dir)
+
+	_, err := ks.Load()
+	a.ErrorIs(err, ErrKeyNotFound)
+
+	created, err := loadOrCreate(ks)
+	a.NoError(err)
+	a.FileExists(filepath.Join(dir, keyName))
+
+	loaded, err := loadOrCreate(ks)
+	a.NoError(err)
+	a.True(loaded.PublicKey().Equal(created.PublicKey()))
+}
+
+func TestFileKeyStore_Passphrase(t *testing.T) {
+	a := require.New(t)
+	dir := t.TempDir()
+	pass := func(p string) PassphraseFunc {
+		return func() ([]byte, error) { return []byte(p), nil }
+	}
+	ks := NewFileKeyStore(dir)
+	ks.SetPassphrase(pass("first"))
+
+	created, err := loadOrCreate(ks)
+	a.NoError(err)
+	_, err = NewFileKeyStore(dir).Load()
+	a.ErrorIs(err, ErrKeyEncrypted)
+	ks.SetPassphrase(pass("wrong"))
+	_, err = ks.Load()
+	a.ErrorIs(err, ErrWrongPassphrase)
+
+	a.NoError(ks.ChangePassphrase(pass("first"), []byte("second")))
+	ks.SetPassphrase(pass("second"))
+	loaded, err := ks.Load()
+	a.NoError(err)
+	a.True(loaded.PublicKey().Equal(created.PublicKey()))
+
+	// The identity file is decrypted with the same passphrase.
+	o := &options{
+		identityPath: filepath.Join(dir, keyName),
+		passphrase:   pass("second"),
+	}
+	at, err := o.identity()
+	a.NoError(err)
+	a.True(at.PublicKey().Equal(created.PublicKey()))
+
+	a.NoError(ks.ChangePassphrase(pass("second"), nil))
+	_, err = NewFileKeyStore(dir).Load()
+	a.NoError(err)
+	a.ErrorIs(
+		NewFileKeyStore(t.TempDir()).ChangePassphrase(nil, nil),
+		ErrKeyNotFound,
+	)
+}
+
+func TestDefaultFileKeyStore(t *testing.T) {
+	a := require.New(t)
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+
+	ks, err := DefaultFileKeyStore()
+	a.NoError(err)
+	a.Equal(filepath.Join(dir, "kamune"), ks.Dir())
+
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("HOME", "")
+	_, err = DefaultFileKeyStore()
+	a.Error(err)
+}
+
+func TestMemoryKeyStore(t *testing.T) {
+	a := require.New(t)
+	ks := NewMemoryKeyStore()
+
+	_, err := ks.Load()
+	a.ErrorIs(err, ErrKeyNotFound)
+
+	created, err := loadOrCreate(ks)
+	a.NoError(err)
+	loaded, err := ks.Load()
+	a.NoError(err)
+	a.Same(created, loaded)
+}
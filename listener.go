@@ -0,0 +1,127 @@
+package kamune
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/hossein1376/kamune/internal/attest"
+)
+
+// Listener is a net.Listener whose connections have already completed the
+// introduction and the handshake. The verified identity of the remote party
+// of each connection is available through PeerKey. It lets servers that work
+// with a net.Listener, such as http.Server, serve over kamune.
+type Listener struct {
+	l    net.Listener
+	addr *Addr
+
+	conns chan net.Conn
+	once  sync.Once
+	done  chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+// Listen listens on addr, and returns a Listener that performs the handshake
+// with every incoming connection. The options are the same as NewServer's.
+func Listen(addr string, opts ...ServerOption) (*Listener, error) {
+	o, err := serverOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen(o.network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s: %w", addr, err)
+	}
+	kl, err := NewListener(l, opts...)
+	if err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+
+	return kl, nil
+}
+
+// NewListener is like Listen, but accepts the connections of l. The Listener
+// takes ownership of l.
+func NewListener(l net.Listener, opts ...ServerOption) (*Listener, error) {
+	kl := &Listener{
+		l:     l,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	srv, err := NewServer(l.Addr().String(), kl.handle, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("creating new server: %w", err)
+	}
+	kl.addr = &Addr{key: srv.attest.PublicKey(), addr: l.Addr()}
+	go func() {
+		err := srv.Serve(l)
+		kl.mu.Lock()
+		kl.err = err
+		kl.mu.Unlock()
+		kl.close()
+	}()
+
+	return kl, nil
+}
+
+// Accept waits for the next connection that has completed the handshake.
+// Connections that fail the handshake, or whose remote party is not trusted,
+// are dropped without being returned.
+func (kl *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-kl.conns:
+		return c, nil
+	case <-kl.done:
+		kl.mu.Lock()
+		defer kl.mu.Unlock()
+		if kl.err != nil && !errors.Is(kl.err, ErrServerClosed) {
+			return nil, kl.err
+		}
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops listening. Connections that were already accepted are not
+// affected, but the ones still in the handshake are dropped.
+func (kl *Listener) Close() error {
+	kl.close()
+	return kl.l.Close()
+}
+
+// Addr returns the address of the Listener, which carries the server's
+// public key.
+func (kl *Listener) Addr() net.Addr {
+	return kl.addr
+}
+
+func (kl *Listener) close() {
+	kl.once.Do(func() { close(kl.done) })
+}
+
+// handle hands the connection over to Accept, and keeps the Transport alive
+// until it is closed.
+func (kl *Listener) handle(t *Transport) error {
+	select {
+	case kl.conns <- t.NetConn():
+	case <-kl.done:
+		return nil
+	}
+	<-t.Context().Done()
+
+	return nil
+}
+
+// PeerKey returns the verified public key of the remote party of c, if c was
+// returned by a Listener or by Transport.NetConn.
+func PeerKey(c net.Conn) (*attest.PublicKey, bool) {
+	nc, ok := c.(*netConn)
+	if !ok {
+		return nil, false
+	}
+	return nc.t.remote, true
+}
@@ -0,0 +1,105 @@
+package kamune
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/hossein1376/kamune/internal/attest"
+)
+
+type peerKeyCtx struct{}
+
+func TestListener_HTTP(t *testing.T) {
+	a := require.New(t)
+	l, err := Listen(
+		"127.0.0.1:0",
+		WithKeyStore(NewMemoryKeyStore()),
+		WithRemoteVerifier(acceptAll),
+	)
+	a.NoError(err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		key := r.Context().Value(peerKeyCtx{}).(*attest.PublicKey)
+		enc := base64.StdEncoding.EncodeToString(key.Marshal())
+		_, _ = io.WriteString(w, enc)
+	}
+	srv := &http.Server{
+		Handler: http.HandlerFunc(handler),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			key, ok := PeerKey(c)
+			a.True(ok)
+			return context.WithValue(ctx, peerKeyCtx{}, key)
+		},
+	}
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(func() { _ = srv.Close() })
+
+	clientID, err := attest.New()
+	a.NoError(err)
+	addr := l.Addr().(*Addr).Underlying().String()
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		tr, err := DialContext(
+			ctx, addr, WithIdentity(clientID), WithRemoteVerifier(acceptAll),
+		)
+		if err != nil {
+			return nil, err
+		}
+		return tr.NetConn(), nil
+	}
+	hc := &http.Client{Transport: &http.Transport{DialContext: dial}}
+	t.Cleanup(hc.CloseIdleConnections)
+
+	resp, err := hc.Get("http://kamune/whoami")
+	a.NoError(err)
+	body, err := io.ReadAll(resp.Body)
+	a.NoError(err)
+	a.NoError(resp.Body.Close())
+	want := base64.StdEncoding.EncodeToString(clientID.PublicKey().Marshal())
+	a.Equal(want, string(body))
+}
+
+func TestListener_Rejected(t *testing.T) {
+	a := require.New(t)
+	l, err := Listen(
+		"127.0.0.1:0",
+		WithKeyStore(NewMemoryKeyStore()),
+		WithRemoteVerifier(func(*attest.PublicKey) error {
+			return ErrVerificationFailed
+		}),
+	)
+	a.NoError(err)
+	addr := l.Addr().(*Addr).Underlying().String()
+
+	accepted := make(chan error, 1)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			_ = c.Close()
+		}
+		accepted <- err
+	}()
+	_, err = Dial(
+		addr,
+		WithKeyStore(NewMemoryKeyStore()),
+		WithRemoteVerifier(acceptAll),
+		WithHandshakeTimeout(time.Second),
+	)
+	a.Error(err)
+
+	select {
+	case err := <-accepted:
+		a.Failf("rejected connection was accepted", "err: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	a.NoError(l.Close())
+	a.True(errors.Is(<-accepted, net.ErrClosed))
+}
@@ -0,0 +1,447 @@
+package kamune
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/hossein1376/kamune/internal/box/pb"
+)
+
+const (
+	// DefaultMigrationWindow is how long a session waits to be reattached,
+	// unless set otherwise by WithMigration.
+	DefaultMigrationWindow = 30 * time.Second
+
+	// maxRetransmitSize bounds the records that are kept until the remote
+	// party acknowledges them.
+	maxRetransmitSize = 4 * 1024 * 1024
+)
+
+var (
+	ErrMigrationFailed  = errors.New("session could not be reattached")
+	ErrMigrationRefused = errors.New("session reattachment was refused")
+
+	migrationLabel = []byte("kamune migration")
+	clientReattach = []byte("kamune client reattach")
+	serverReattach = []byte("kamune server reattach")
+
+	// errReattached tells Server.serve that the connection now belongs to an
+	// existing session.
+	errReattached = errors.New("connection reattached to an existing session")
+)
+
+// migration lets a session survive the loss of its connection. Sent records
+// are kept until the remote party acknowledges them, and once a new
+// connection is attached to the session, the ones that did not make it are
+// sent again. Clients redial on their own; servers wait for the client to
+// come back.
+type migration struct {
+	key    []byte
+	window time.Duration
+	redial func(ctx context.Context) (net.Conn, error)
+	buffer retransmitBuffer
+
+	mu      sync.Mutex
+	gen     uint64
+	busy    bool
+	changed chan struct{}
+	err     error
+}
+
+func newMigration(key []byte) *migration {
+	return &migration{
+		key:     key,
+		window:  DefaultMigrationWindow,
+		buffer:  retransmitBuffer{limit: maxRetransmitSize},
+		changed: make(chan struct{}),
+	}
+}
+
+// fail stops the session from being reattached, and wakes up everyone who
+// is waiting for it.
+func (m *migration) fail(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return
+	}
+	m.err = err
+	close(m.changed)
+}
+
+// proof authenticates a reattach message with the key of the session.
+func (m *migration) proof(role []byte, r *pb.Reattach) []byte {
+	mac := hmac.New(sha512.New, m.key)
+	mac.Write(role)
+	mac.Write([]byte(r.GetSessionID()))
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], r.GetGeneration())
+	binary.BigEndian.PutUint64(b[8:], r.GetReceived())
+	mac.Write(b[:])
+	return mac.Sum(nil)
+}
+
+// Reattach moves the session to a new connection to the same address, even
+// if the current one still seems to be alive. It is useful when the caller
+// knows better, for example after the network has changed. It is only
+// available to clients whose session has negotiated migration.
+func (t *Transport) Reattach(ctx context.Context) error {
+	m := t.migration
+	if m == nil || m.redial == nil {
+		return fmt.Errorf("%w: migration is not enabled", ErrMigrationFailed)
+	}
+	_, gen := t.connection()
+	return t.redial(ctx, gen, nil)
+}
+
+// connection returns the current connection and its generation.
+func (t *Transport) connection() (net.Conn, uint64) {
+	m := t.migration
+	if m == nil {
+		return t.conn.Conn, 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return t.conn.Conn, m.gen
+}
+
+// recoverable reports whether err is caused by the loss of the connection,
+// rather than by a deadline or by the Transport being closed. Clients can only
+// recover once the Transport is handed over to the caller.
+func (t *Transport) recoverable(err error) bool {
+	m := t.migration
+	return m != nil &&
+		(!t.client || m.redial != nil) &&
+		t.ctx.Err() == nil &&
+		!errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// recover is called once I/O on the connection of generation gen has failed
+// with cause. It returns nil once a new connection is attached.
+func (t *Transport) recover(gen uint64, cause error) error {
+	if t.client {
+		ctx, cancel := context.WithTimeout(t.ctx, t.migration.window)
+		defer cancel()
+		return t.redial(ctx, gen, cause)
+	}
+	return t.awaitReattach(gen, cause)
+}
+
+// redial connects to the server again, retrying until ctx is done, and
+// reattaches the session to the new connection.
+func (t *Transport) redial(
+	ctx context.Context, gen uint64, cause error,
+) error {
+	m := t.migration
+	m.mu.Lock()
+	switch {
+	case m.err != nil:
+		m.mu.Unlock()
+		return m.err
+	case m.gen != gen:
+		m.mu.Unlock()
+		return nil
+	case m.busy:
+		changed := m.changed
+		m.mu.Unlock()
+		return t.awaitChange(ctx, changed, cause)
+	}
+	m.busy = true
+	old := t.conn.Conn
+	m.mu.Unlock()
+	// Unblock whoever is still using the old connection.
+	_ = old.Close()
+
+	var err error
+	for delay := time.Duration(0); ; {
+		var conn net.Conn
+		if conn, err = m.redial(ctx); err == nil {
+			if err = t.reattach(ctx, conn); err == nil {
+				return nil
+			}
+			_ = conn.Close()
+			if errors.Is(err, ErrMigrationRefused) ||
+				errors.Is(err, ErrMigrationFailed) {
+				break
+			}
+		}
+		delay = min(max(2*delay, 50*time.Millisecond), 2*time.Second)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			err = errors.Join(ctx.Err(), err)
+		case <-timer.C:
+			continue
+		}
+		break
+	}
+
+	err = fmt.Errorf("%w: %w", ErrMigrationFailed, errors.Join(cause, err))
+	m.fail(err)
+	return err
+}
+
+// reattach performs the client's side of the reattach exchange on conn.
+func (t *Transport) reattach(ctx context.Context, conn net.Conn) error {
+	t.rmu.Lock()
+	defer t.rmu.Unlock()
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+
+	c := &Conn{Conn: conn}
+	stop := watchContext(ctx, conn.SetDeadline)
+	received, err := t.requestReattach(c)
+	if stop() {
+		return errors.Join(ctx.Err(), err)
+	}
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return fmt.Errorf("clearing deadline: %w", err)
+	}
+
+	return t.attach(c, received)
+}
+
+// requestReattach asks the server to move the session to conn, and returns
+// the number of records that the server has received.
+func (t *Transport) requestReattach(conn *Conn) (uint64, error) {
+	m := t.migration
+	req := &pb.Reattach{
+		SessionID:  t.sessionID,
+		Generation: m.gen + 1,
+		Received:   t.received.Load(),
+	}
+	req.Proof = m.proof(clientReattach, req)
+	introBytes, err := proto.Marshal(&pb.Introduce{
+		Reattach: req,
+		Padding:  padding(introducePadding),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("marshalling: %w", err)
+	}
+	if err := writeRecord(conn, introBytes); err != nil {
+		return 0, fmt.Errorf("writing: %w", err)
+	}
+	payload, err := readRecord(conn)
+	if err != nil {
+		return 0, fmt.Errorf("reading: %w", err)
+	}
+	var resp pb.Reattach
+	if err := proto.Unmarshal(payload, &resp); err != nil {
+		return 0, fmt.Errorf("unmarshalling: %w", err)
+	}
+	if len(resp.GetProof()) == 0 {
+		return 0, ErrMigrationRefused
+	}
+	if resp.GetSessionID() != req.GetSessionID() ||
+		resp.GetGeneration() != req.GetGeneration() ||
+		!hmac.Equal(resp.GetProof(), m.proof(serverReattach, &resp)) {
+		return 0, fmt.Errorf("%w: invalid proof", ErrMigrationFailed)
+	}
+
+	return resp.GetReceived(), nil
+}
+
+// awaitReattach waits for the client to reattach the session, for as long as
+// the migration window allows.
+func (t *Transport) awaitReattach(gen uint64, cause error) error {
+	m := t.migration
+	m.mu.Lock()
+	switch {
+	case m.err != nil:
+		m.mu.Unlock()
+		return m.err
+	case m.gen != gen:
+		m.mu.Unlock()
+		return nil
+	}
+	changed, old := m.changed, t.conn.Conn
+	m.mu.Unlock()
+	_ = old.Close()
+
+	ctx, cancel := context.WithTimeout(t.ctx, m.window)
+	defer cancel()
+	return t.awaitChange(ctx, changed, cause)
+}
+
+// awaitChange waits for changed to be closed, which happens once a new
+// connection is attached or the migration fails.
+func (t *Transport) awaitChange(
+	ctx context.Context, changed <-chan struct{}, cause error,
+) error {
+	m := t.migration
+	select {
+	case <-changed:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.err
+	case <-ctx.Done():
+		err := fmt.Errorf("%w: %w", ErrMigrationFailed, cause)
+		if t.ctx.Err() == nil {
+			m.fail(err)
+		}
+		return err
+	}
+}
+
+// adopt performs the server's side of the reattach exchange, once req has
+// arrived on conn.
+func (t *Transport) adopt(conn *Conn, req *pb.Reattach) error {
+	m := t.migration
+	if !hmac.Equal(req.GetProof(), m.proof(clientReattach, req)) {
+		return fmt.Errorf("%w: invalid proof", ErrMigrationRefused)
+	}
+	m.mu.Lock()
+	switch {
+	case m.err != nil:
+		m.mu.Unlock()
+		return m.err
+	case m.busy, req.GetGeneration() != m.gen+1:
+		m.mu.Unlock()
+		return fmt.Errorf("%w: stale generation", ErrMigrationRefused)
+	}
+	m.busy = true
+	old := t.conn.Conn
+	m.mu.Unlock()
+	_ = old.Close()
+
+	t.rmu.Lock()
+	defer t.rmu.Unlock()
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+
+	resp := &pb.Reattach{
+		SessionID:  req.GetSessionID(),
+		Generation: req.GetGeneration(),
+		Received:   t.received.Load(),
+	}
+	resp.Proof = m.proof(serverReattach, resp)
+	err := writeMessage(conn, resp)
+	if err == nil {
+		err = t.attach(conn, req.GetReceived())
+	}
+	if err != nil {
+		m.mu.Lock()
+		m.busy = false
+		m.mu.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+// attach sends the records that the remote party has not received yet over
+// conn, and makes it the connection of the session. Both the read and write
+// locks must be held.
+func (t *Transport) attach(conn *Conn, remoteReceived uint64) error {
+	m := t.migration
+	records, ok := m.buffer.since(remoteReceived, t.sent.Load())
+	if !ok {
+		return fmt.Errorf("%w: records are no longer buffered", ErrMigrationFailed)
+	}
+	for _, rec := range records {
+		if err := writeRecord(conn, rec); err != nil {
+			return fmt.Errorf("retransmitting: %w", err)
+		}
+	}
+	if err := conn.SetReadDeadline(t.deadlines.read()); err != nil {
+		return fmt.Errorf("setting deadline: %w", err)
+	}
+	if err := conn.SetWriteDeadline(t.deadlines.write()); err != nil {
+		return fmt.Errorf("setting deadline: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	t.conn = conn
+	t.reader = &recordReader{r: conn}
+	t.writeErr = nil
+	m.gen++
+	m.busy = false
+	close(m.changed)
+	m.changed = make(chan struct{})
+
+	return nil
+}
+
+// refuseReattach tells the client that its session cannot be reattached.
+func refuseReattach(conn *Conn) error {
+	return writeMessage(conn, &pb.Reattach{})
+}
+
+func writeMessage(w io.Writer, msg proto.Message) error {
+	b, err := proto.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshalling: %w", err)
+	}
+	return writeRecord(w, b)
+}
+
+// retransmitBuffer keeps the encrypted records that were sent, until the
+// remote party acknowledges them. Once it grows beyond its limit, the oldest
+// records are dropped, and the session can no longer be reattached if any of
+// them turns out to be missing.
+type retransmitBuffer struct {
+	mu      sync.Mutex
+	limit   int
+	size    int
+	records []bufferedRecord
+}
+
+type bufferedRecord struct {
+	seq  uint64
+	data []byte
+}
+
+func (b *retransmitBuffer) add(seq uint64, data []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.records = append(b.records, bufferedRecord{seq: seq, data: data})
+	b.size += len(data)
+	for b.size > b.limit && len(b.records) > 0 {
+		b.size -= len(b.records[0].data)
+		b.records = b.records[1:]
+	}
+}
+
+// ack drops the records that the remote party has received, that is, the
+// ones before received.
+func (b *retransmitBuffer) ack(received uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for len(b.records) > 0 && b.records[0].seq < received {
+		b.size -= len(b.records[0].data)
+		b.records = b.records[1:]
+	}
+}
+
+// since returns the records from received up to, but not including, sent.
+// It reports false if any of them has already been dropped.
+func (b *retransmitBuffer) since(received, sent uint64) ([][]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out [][]byte
+	for _, r := range b.records {
+		if r.seq >= received {
+			out = append(out, r.data)
+		}
+	}
+	return out, uint64(len(out)) == sent-received
+}
@@ -0,0 +1,186 @@
+package kamune
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// proxy forwards connections to addr, and can cut all of them at once, as a
+// change of network would.
+type proxy struct {
+	l     net.Listener
+	mu    sync.Mutex
+	links []net.Conn
+}
+
+func newProxy(t *testing.T, addr string) *proxy {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	p := &proxy{l: l}
+	t.Cleanup(func() {
+		_ = l.Close()
+		p.cut()
+	})
+	go func() {
+		for {
+			src, err := l.Accept()
+			if err != nil {
+				return
+			}
+			dst, err := net.Dial("tcp", addr)
+			if err != nil {
+				_ = src.Close()
+				continue
+			}
+			p.mu.Lock()
+			p.links = append(p.links, src, dst)
+			p.mu.Unlock()
+			go func() { _, _ = io.Copy(dst, src); _ = dst.Close() }()
+			go func() { _, _ = io.Copy(src, dst); _ = src.Close() }()
+		}
+	}()
+
+	return p
+}
+
+func (p *proxy) addr() string {
+	return p.l.Addr().String()
+}
+
+func (p *proxy) cut() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.links {
+		_ = c.Close()
+	}
+	p.links = nil
+}
+
+func TestMigration(t *testing.T) {
+	a := require.New(t)
+	_, addr, _ := startServer(t, echo, WithMigration(0))
+	p := newProxy(t, addr)
+	tr := dialServer(t, p.addr(), WithMigration(5*time.Second))
+	a.True(tr.Migration())
+
+	const count = 200
+	errCh := make(chan error, 1)
+	go func() {
+		for i := range count {
+			msg := []byte(fmt.Sprintf("message %d", i))
+			if _, err := tr.Send(Bytes(msg)); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		errCh <- nil
+	}()
+	for i := range count {
+		if i%50 == 25 {
+			p.cut()
+		}
+		b := Bytes(nil)
+		_, err := tr.Receive(b)
+		a.NoError(err, "message %d", i)
+		a.Equal(fmt.Sprintf("message %d", i), string(b.GetValue()))
+	}
+	a.NoError(<-errCh)
+	_, gen := tr.connection()
+	a.NotZero(gen)
+
+	a.NoError(tr.Reattach(t.Context()))
+	_, next := tr.connection()
+	a.Equal(gen+1, next)
+	roundTrip(t, tr, "after an explicit reattach")
+}
+
+func TestMigration_NotNegotiated(t *testing.T) {
+	a := require.New(t)
+	_, addr, _ := startServer(t, echo)
+	p := newProxy(t, addr)
+	tr := dialServer(t, p.addr(), WithMigration(0))
+	a.False(tr.Migration())
+	a.ErrorIs(tr.Reattach(t.Context()), ErrMigrationFailed)
+
+	roundTrip(t, tr, "before")
+	p.cut()
+	_, err := tr.Receive(Bytes(nil))
+	a.Error(err)
+}
+
+func TestMigration_InvalidProof(t *testing.T) {
+	a := require.New(t)
+	_, addr, _ := startServer(t, echo, WithMigration(0))
+	p := newProxy(t, addr)
+	tr := dialServer(t, p.addr(), WithMigration(5*time.Second))
+	roundTrip(t, tr, "before")
+
+	tr.migration.key = bytes.Repeat([]byte{1}, len(tr.migration.key))
+	p.cut()
+	start := time.Now()
+	_, err := tr.Receive(Bytes(nil))
+	a.ErrorIs(err, ErrMigrationFailed)
+	a.ErrorIs(err, ErrMigrationRefused)
+	a.Less(time.Since(start), 5*time.Second)
+
+	_, err = tr.Send(Bytes([]byte("after")))
+	a.ErrorIs(err, ErrMigrationFailed)
+}
+
+func TestMigration_Close(t *testing.T) {
+	a := require.New(t)
+	handled := make(chan error, 1)
+	_, addr, _ := startServer(t, func(t *Transport) error {
+		_, err := t.Receive(Bytes(nil))
+		handled <- err
+		return err
+	}, WithMigration(time.Minute))
+	tr := dialServer(t, addr, WithMigration(time.Minute))
+	a.True(tr.Migration())
+
+	a.NoError(tr.Close())
+	select {
+	case err := <-handled:
+		a.ErrorIs(err, ErrConnClosedByRemote)
+	case <-time.After(5 * time.Second):
+		a.Fail("server is still waiting for the session to be reattached")
+	}
+}
+
+func TestRetransmitBuffer(t *testing.T) {
+	a := require.New(t)
+	b := retransmitBuffer{limit: 30}
+	for i := range uint64(3) {
+		b.add(i, bytes.Repeat([]byte{byte(i)}, 10))
+	}
+
+	records, ok := b.since(1, 3)
+	a.True(ok)
+	a.Equal(
+		[][]byte{bytes.Repeat([]byte{1}, 10), bytes.Repeat([]byte{2}, 10)},
+		records,
+	)
+
+	b.ack(2)
+	_, ok = b.since(1, 3)
+	a.False(ok)
+	records, ok = b.since(3, 3)
+	a.True(ok)
+	a.Empty(records)
+
+	b.add(3, make([]byte, 10))
+	b.add(4, make([]byte, 20))
+	_, ok = b.since(2, 5)
+	a.False(ok, "the oldest record should have been dropped")
+	records, ok = b.since(3, 5)
+	a.True(ok)
+	a.Len(records, 2)
+}
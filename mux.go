@@ -0,0 +1,421 @@
+package kamune
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/hossein1376/kamune/internal/box/pb"
+)
+
+const (
+	// DefaultStreamWindow is the number of bytes that a stream may receive
+	// before the reader has consumed them.
+	DefaultStreamWindow = 256 * 1024
+
+	// maxFrameData is the largest chunk of a stream that is sent in a single
+	// frame, so that a frame always fits in a single record.
+	maxFrameData = 8 * 1024
+
+	acceptBacklog = 64
+)
+
+var (
+	ErrMuxClosed       = errors.New("multiplexer is closed")
+	ErrStreamReset     = errors.New("stream was reset")
+	ErrStreamClosed    = errors.New("stream is closed for writing")
+	ErrProtocolFailure = errors.New("stream protocol violation")
+)
+
+// Mux multiplexes independent streams over a single Transport. Each stream
+// is ordered and flow-controlled on its own, so a slow or busy stream does
+// not hold the others back. Once a Transport is handed to a Mux, it must no
+// longer be used directly.
+//
+// Streams opened by the client have odd IDs, and the ones opened by the
+// server even IDs, so both parties can open streams at the same time.
+type Mux struct {
+	t      *Transport
+	window uint32
+	// parity is that of the IDs of the locally opened streams.
+	parity uint32
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	err     error
+
+	accept chan *Stream
+	done   chan struct{}
+}
+
+// NewMux starts multiplexing streams over t. Both parties must do so.
+func NewMux(t *Transport) *Mux {
+	m := &Mux{
+		t:       t,
+		window:  DefaultStreamWindow,
+		streams: make(map[uint32]*Stream),
+		nextID:  2,
+		accept:  make(chan *Stream, acceptBacklog),
+		done:    make(chan struct{}),
+	}
+	if t.client {
+		m.nextID = 1
+	}
+	m.parity = m.nextID % 2
+	go m.run()
+
+	return m
+}
+
+// OpenStream opens a new stream. The remote party receives it from
+// AcceptStream.
+func (m *Mux) OpenStream() (*Stream, error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+	id := m.nextID
+	m.nextID += 2
+	s := newStream(m, id)
+	m.streams[id] = s
+	m.mu.Unlock()
+
+	err := m.send(&pb.StreamFrame{
+		Stream: id, Type: pb.FrameType_Open, Window: m.window,
+	})
+	if err != nil {
+		m.remove(id)
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// AcceptStream waits for the remote party to open a stream, and returns it.
+func (m *Mux) AcceptStream() (*Stream, error) {
+	select {
+	case s := <-m.accept:
+		return s, nil
+	case <-m.done:
+		return nil, m.Err()
+	}
+}
+
+// Close closes the Transport, and with it, all streams.
+func (m *Mux) Close() error {
+	m.fail(ErrMuxClosed)
+	return m.t.Close()
+}
+
+// Err returns the reason the Mux has stopped, if it has.
+func (m *Mux) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// run reads the incoming frames, and passes them to their streams.
+func (m *Mux) run() {
+	for {
+		var f pb.StreamFrame
+		if _, err := m.t.Receive(&f); err != nil {
+			m.fail(fmt.Errorf("%w: %w", ErrMuxClosed, err))
+			return
+		}
+		if err := m.handle(&f); err != nil {
+			m.fail(err)
+			_ = m.t.Close()
+			return
+		}
+	}
+}
+
+func (m *Mux) handle(f *pb.StreamFrame) error {
+	id := f.GetStream()
+	if f.GetType() == pb.FrameType_Open {
+		// The remote party must use IDs of its own parity.
+		if id%2 == m.parity {
+			return protocolError(id, "ID of the wrong parity")
+		}
+		m.mu.Lock()
+		_, exists := m.streams[id]
+		s := newStream(m, id)
+		s.sendWindow = f.GetWindow()
+		if !exists {
+			m.streams[id] = s
+		}
+		m.mu.Unlock()
+		if exists {
+			return protocolError(id, "already exists")
+		}
+		select {
+		case m.accept <- s:
+		default:
+			m.remove(id)
+			return m.send(&pb.StreamFrame{Stream: id, Type: pb.FrameType_Reset})
+		}
+		return nil
+	}
+
+	m.mu.Lock()
+	s, ok := m.streams[id]
+	m.mu.Unlock()
+	if !ok {
+		// The stream may have just been reset or closed locally.
+		if f.GetType() == pb.FrameType_Reset {
+			return nil
+		}
+		return m.send(&pb.StreamFrame{Stream: id, Type: pb.FrameType_Reset})
+	}
+
+	switch f.GetType() {
+	case pb.FrameType_Data:
+		if err := s.receive(f.GetData()); err != nil {
+			m.remove(id)
+			s.reset(err)
+			return m.send(&pb.StreamFrame{Stream: id, Type: pb.FrameType_Reset})
+		}
+	case pb.FrameType_WindowUpdate:
+		if err := s.grow(f.GetWindow()); err != nil {
+			return err
+		}
+	case pb.FrameType_Fin:
+		s.finish()
+	case pb.FrameType_Reset:
+		m.remove(id)
+		s.reset(ErrStreamReset)
+	}
+
+	return nil
+}
+
+func (m *Mux) send(f *pb.StreamFrame) error {
+	if _, err := m.t.Send(f); err != nil {
+		return fmt.Errorf("sending frame: %w", err)
+	}
+	return nil
+}
+
+func (m *Mux) remove(id uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.streams, id)
+}
+
+// fail stops the Mux, and all of its streams, with err.
+func (m *Mux) fail(err error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return
+	}
+	m.err = err
+	streams := m.streams
+	m.streams = make(map[uint32]*Stream)
+	close(m.done)
+	m.mu.Unlock()
+
+	for _, s := range streams {
+		s.reset(err)
+	}
+}
+
+// Stream is a single, ordered and reliable stream of bytes within a Mux.
+type Stream struct {
+	id uint32
+	m  *Mux
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	buf        bytes.Buffer
+	recvWindow uint32
+	consumed   uint32
+	sendWindow uint32
+	finRecv    bool
+	finSent    bool
+	err        error
+}
+
+func newStream(m *Mux, id uint32) *Stream {
+	s := &Stream{id: id, m: m, recvWindow: m.window, sendWindow: m.window}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// ID returns the ID of the stream, which is unique within its Mux.
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+// Read reads the data that the remote party has written to the stream. It
+// returns io.EOF once the remote party has closed the stream, and all of its
+// data was read.
+func (s *Stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for s.buf.Len() == 0 && !s.finRecv && s.err == nil {
+		s.cond.Wait()
+	}
+	switch {
+	case s.buf.Len() > 0:
+	case s.err != nil:
+		defer s.mu.Unlock()
+		return 0, s.err
+	default:
+		s.mu.Unlock()
+		return 0, io.EOF
+	}
+	n, _ := s.buf.Read(p)
+	s.consumed += uint32(n)
+	// Give the window back in large enough chunks, rather than after every
+	// read.
+	var update uint32
+	if s.consumed >= s.m.window/2 {
+		update = s.consumed
+		s.recvWindow += s.consumed
+		s.consumed = 0
+	}
+	s.mu.Unlock()
+
+	if update > 0 {
+		err := s.m.send(&pb.StreamFrame{
+			Stream: s.id, Type: pb.FrameType_WindowUpdate, Window: update,
+		})
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// Write writes p to the stream. It blocks while the remote party's window is
+// exhausted, that is, until it reads what was written before.
+func (s *Stream) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		s.mu.Lock()
+		for s.sendWindow == 0 && !s.finSent && s.err == nil {
+			s.cond.Wait()
+		}
+		switch {
+		case s.err != nil:
+			defer s.mu.Unlock()
+			return written, s.err
+		case s.finSent:
+			s.mu.Unlock()
+			return written, ErrStreamClosed
+		}
+		n := min(len(p), int(s.sendWindow), maxFrameData)
+		s.sendWindow -= uint32(n)
+		s.mu.Unlock()
+
+		err := s.m.send(&pb.StreamFrame{
+			Stream: s.id, Type: pb.FrameType_Data, Data: p[:n],
+		})
+		if err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// Close closes the stream for writing. The remote party reads io.EOF once it
+// has read everything written before, and the stream can still be read from
+// until the remote party closes it as well.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if s.finSent || s.err != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.finSent = true
+	done := s.finRecv
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	if done {
+		s.m.remove(s.id)
+	}
+	return s.m.send(&pb.StreamFrame{Stream: s.id, Type: pb.FrameType_Fin})
+}
+
+// Reset abruptly closes the stream in both directions. Data that was not read
+// yet is dropped, and pending and future reads and writes, on both ends, fail
+// with ErrStreamReset.
+func (s *Stream) Reset() error {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Unlock()
+	s.reset(ErrStreamReset)
+	s.m.remove(s.id)
+
+	return s.m.send(&pb.StreamFrame{Stream: s.id, Type: pb.FrameType_Reset})
+}
+
+// receive buffers incoming data. The remote party must not send more than
+// the window allows.
+func (s *Stream) receive(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.finRecv:
+		return protocolError(s.id, "data after FIN")
+	case uint32(len(data)) > s.recvWindow:
+		return protocolError(s.id, "window exceeded")
+	}
+	s.recvWindow -= uint32(len(data))
+	s.buf.Write(data)
+	s.cond.Broadcast()
+
+	return nil
+}
+
+func (s *Stream) grow(n uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n > math.MaxUint32-s.sendWindow {
+		return protocolError(s.id, "window overflow")
+	}
+	s.sendWindow += n
+	s.cond.Broadcast()
+
+	return nil
+}
+
+func (s *Stream) finish() {
+	s.mu.Lock()
+	s.finRecv = true
+	done := s.finSent
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	if done {
+		s.m.remove(s.id)
+	}
+}
+
+// reset fails the stream with err, and drops whatever was not read yet.
+func (s *Stream) reset(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.buf.Reset()
+	s.cond.Broadcast()
+}
+
+func protocolError(id uint32, reason string) error {
+	return fmt.Errorf("%w: stream %d: %s", ErrProtocolFailure, id, reason)
+}
@@ -0,0 +1,205 @@
+package kamune
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newMuxPair(t *testing.T) (client, server *Mux) {
+	t.Helper()
+	c, s := newTransportPair(t)
+	client, server = NewMux(c), NewMux(s)
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	return client, server
+}
+
+func TestMux_Streams(t *testing.T) {
+	a := require.New(t)
+	client, server := newMuxPair(t)
+
+	const count = 8
+	payloads := make([][]byte, count)
+	for i := range payloads {
+		payloads[i] = make([]byte, 100*1024+i)
+		_, _ = rand.Read(payloads[i])
+	}
+
+	// The server echoes every stream back.
+	go func() {
+		for {
+			s, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(s, s)
+				_ = s.Close()
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, count)
+	for i := range count {
+		s, err := client.OpenStream()
+		a.NoError(err)
+		a.EqualValues(1, s.ID()%2)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			go func() {
+				_, _ = s.Write(payloads[i])
+				_ = s.Close()
+			}()
+			got, err := io.ReadAll(s)
+			if err == nil && !bytes.Equal(payloads[i], got) {
+				err = io.ErrUnexpectedEOF
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		a.NoError(err)
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	a.Empty(client.streams, "finished streams should be forgotten")
+}
+
+func TestMux_OpenFromBothEnds(t *testing.T) {
+	a := require.New(t)
+	client, server := newMuxPair(t)
+
+	// Both parties open streams at the same time, while accepting the ones
+	// opened by the other.
+	const count = 16
+	var wg sync.WaitGroup
+	errs := make(chan error, 4*count)
+	for _, m := range []*Mux{client, server} {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for range count {
+				_, err := m.OpenStream()
+				errs <- err
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range count {
+				_, err := m.AcceptStream()
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		a.NoError(err)
+	}
+	a.NoError(client.Err())
+	a.NoError(server.Err())
+}
+
+func TestMux_FlowControl(t *testing.T) {
+	a := require.New(t)
+	client, server := newMuxPair(t)
+
+	slow, err := client.OpenStream()
+	a.NoError(err)
+	remoteSlow, err := server.AcceptStream()
+	a.NoError(err)
+
+	// Nobody reads the slow stream, so its writer runs out of window.
+	written := make(chan int, 1)
+	go func() {
+		n, _ := slow.Write(make([]byte, 2*DefaultStreamWindow))
+		written <- n
+	}()
+	select {
+	case <-written:
+		a.Fail("write should block once the window is exhausted")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Other streams are not held back.
+	fast, err := server.OpenStream()
+	a.NoError(err)
+	a.EqualValues(0, fast.ID()%2)
+	remoteFast, err := client.AcceptStream()
+	a.NoError(err)
+	_, err = fast.Write([]byte("not blocked"))
+	a.NoError(err)
+	a.NoError(fast.Close())
+	got, err := io.ReadAll(remoteFast)
+	a.NoError(err)
+	a.Equal("not blocked", string(got))
+
+	n, err := io.CopyN(io.Discard, remoteSlow, 2*DefaultStreamWindow)
+	a.NoError(err)
+	a.EqualValues(2*DefaultStreamWindow, n)
+	a.Equal(2*DefaultStreamWindow, <-written)
+}
+
+func TestMux_Reset(t *testing.T) {
+	a := require.New(t)
+	client, server := newMuxPair(t)
+
+	s, err := client.OpenStream()
+	a.NoError(err)
+	remote, err := server.AcceptStream()
+	a.NoError(err)
+
+	_, err = s.Write([]byte("lost"))
+	a.NoError(err)
+	a.NoError(remote.Reset())
+	_, err = remote.Read(make([]byte, 10))
+	a.ErrorIs(err, ErrStreamReset)
+
+	a.Eventually(func() bool {
+		_, err := s.Write([]byte("after reset"))
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+	_, err = s.Read(make([]byte, 10))
+	a.ErrorIs(err, ErrStreamReset)
+
+	// The Mux itself keeps working.
+	other, err := client.OpenStream()
+	a.NoError(err)
+	_, err = server.AcceptStream()
+	a.NoError(err)
+	a.NoError(other.Close())
+	_, err = other.Write([]byte("closed"))
+	a.ErrorIs(err, ErrStreamClosed)
+}
+
+func TestMux_Close(t *testing.T) {
+	a := require.New(t)
+	client, server := newMuxPair(t)
+
+	s, err := client.OpenStream()
+	a.NoError(err)
+	_, err = server.AcceptStream()
+	a.NoError(err)
+
+	a.NoError(client.Close())
+	_, err = s.Read(make([]byte, 1))
+	a.ErrorIs(err, ErrMuxClosed)
+	_, err = client.OpenStream()
+	a.ErrorIs(err, ErrMuxClosed)
+	_, err = server.AcceptStream()
+	a.ErrorIs(err, ErrMuxClosed)
+}
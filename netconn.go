@@ -0,0 +1,150 @@
+package kamune
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hossein1376/kamune/internal/attest"
+)
+
+// netConnChunk is the largest chunk of a byte stream that is sent in a single
+// message, so that it fits in a single record alongside its encoding.
+const netConnChunk = maxFragmentSize - 16
+
+// Addr is the address of a party of a kamune session. It consists of the
+// party's identity, and the address of the underlying connection.
+type Addr struct {
+	key  *attest.PublicKey
+	addr net.Addr
+}
+
+// Network returns "kamune".
+func (a *Addr) Network() string {
+	return "kamune"
+}
+
+// String returns the public key of the party, followed by the address of the
+// underlying connection, such as "MCowBQYDK2VwAyEA...@127.0.0.1:9000".
+func (a *Addr) String() string {
+	key := base64.StdEncoding.EncodeToString(a.key.Marshal())
+	if a.addr == nil {
+		return key
+	}
+	return key + "@" + a.addr.String()
+}
+
+// PublicKey returns the public key of the party.
+func (a *Addr) PublicKey() *attest.PublicKey {
+	return a.key
+}
+
+// Underlying returns the address of the underlying connection.
+func (a *Addr) Underlying() net.Addr {
+	return a.addr
+}
+
+// NetConn returns a net.Conn that reads and writes a stream of bytes over t.
+// Writes are sent as encrypted messages, and reads return their content in
+// order, regardless of how they were split. It lets protocols that expect a
+// net.Conn, such as HTTP, run over the session.
+//
+// Once the returned connection is in use, t must not be used to send or
+// receive messages directly. Closing either of them closes both.
+func (t *Transport) NetConn() net.Conn {
+	return &netConn{t: t}
+}
+
+type netConn struct {
+	t *Transport
+
+	rmu     sync.Mutex
+	pending []byte
+
+	wmu sync.Mutex
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func (c *netConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for len(c.pending) == 0 {
+		b := Bytes(nil)
+		if _, err := c.t.Receive(b); err != nil {
+			return 0, netConnError(err)
+		}
+		c.pending = b.GetValue()
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+
+	return n, nil
+}
+
+func (c *netConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	var written int
+	for len(p) > 0 {
+		n := min(len(p), netConnChunk)
+		if _, err := c.t.Send(Bytes(p[:n])); err != nil {
+			return written, netConnError(err)
+		}
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// Close closes the Transport. It is safe to call concurrently, as net.Conn
+// requires.
+func (c *netConn) Close() error {
+	c.closeOnce.Do(func() { c.closeErr = c.t.Close() })
+	return c.closeErr
+}
+
+func (c *netConn) LocalAddr() net.Addr {
+	conn, _ := c.t.connection()
+	return &Addr{key: c.t.attest.PublicKey(), addr: conn.LocalAddr()}
+}
+
+func (c *netConn) RemoteAddr() net.Addr {
+	conn, _ := c.t.connection()
+	return &Addr{key: c.t.remote, addr: conn.RemoteAddr()}
+}
+
+func (c *netConn) SetDeadline(d time.Time) error {
+	return c.t.SetDeadline(d)
+}
+
+func (c *netConn) SetReadDeadline(d time.Time) error {
+	return c.t.SetReadDeadline(d)
+}
+
+func (c *netConn) SetWriteDeadline(d time.Time) error {
+	return c.t.SetWriteDeadline(d)
+}
+
+// netConnError translates the errors of the Transport into the ones that
+// users of a net.Conn expect.
+func netConnError(err error) error {
+	switch {
+	case errors.Is(err, ErrConnClosedByRemote):
+		return io.EOF
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return os.ErrDeadlineExceeded
+	case errors.Is(err, net.ErrClosed):
+		return net.ErrClosed
+	}
+	return err
+}
@@ -0,0 +1,149 @@
+package kamune
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// connListener hands out a single connection, then blocks until closed.
+type connListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	addr  net.Addr
+}
+
+func newConnListener(c net.Conn) *connListener {
+	l := &connListener{
+		conns: make(chan net.Conn, 1),
+		done:  make(chan struct{}),
+		addr:  c.LocalAddr(),
+	}
+	l.conns <- c
+	return l
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	select {
+	case <-l.done:
+	default:
+		close(l.done)
+	}
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr { return l.addr }
+
+func TestNetConn_Stream(t *testing.T) {
+	a := require.New(t)
+	client, server := newTransportPair(t)
+	cc, sc := client.NetConn(), server.NetConn()
+
+	data := make([]byte, 3*maxFragmentSize+123)
+	_, err := rand.Read(data)
+	a.NoError(err)
+	go func() {
+		_, _ = cc.Write(data)
+		_ = cc.Close()
+	}()
+
+	// Read in small and odd sizes, to cross message boundaries.
+	var got bytes.Buffer
+	buf := make([]byte, 1000)
+	for {
+		n, err := sc.Read(buf)
+		got.Write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		a.NoError(err)
+	}
+	a.Equal(data, got.Bytes())
+}
+
+func TestNetConn_Deadline(t *testing.T) {
+	a := require.New(t)
+	client, server := newTransportPair(t)
+	cc, sc := client.NetConn(), server.NetConn()
+
+	a.NoError(sc.SetReadDeadline(time.Now().Add(20 * time.Millisecond)))
+	_, err := sc.Read(make([]byte, 10))
+	a.ErrorIs(err, os.ErrDeadlineExceeded)
+	var ne net.Error
+	a.ErrorAs(err, &ne)
+	a.True(ne.Timeout())
+
+	a.NoError(sc.SetReadDeadline(time.Time{}))
+	go func() { _, _ = cc.Write([]byte("in time")) }()
+	buf := make([]byte, 10)
+	n, err := sc.Read(buf)
+	a.NoError(err)
+	a.Equal("in time", string(buf[:n]))
+}
+
+func TestNetConn_Addr(t *testing.T) {
+	a := require.New(t)
+	client, server := newTransportPair(t)
+	cc := client.NetConn()
+
+	local, ok := cc.LocalAddr().(*Addr)
+	a.True(ok)
+	a.Equal("kamune", local.Network())
+	a.True(local.PublicKey().Equal(server.remote))
+	remote, ok := cc.RemoteAddr().(*Addr)
+	a.True(ok)
+	a.True(remote.PublicKey().Equal(client.remote))
+
+	key := base64.StdEncoding.EncodeToString(client.remote.Marshal())
+	a.True(strings.HasPrefix(remote.String(), key+"@"))
+	a.Equal(key+"@"+remote.Underlying().String(), remote.String())
+}
+
+func TestNetConn_HTTP(t *testing.T) {
+	a := require.New(t)
+	client, server := newTransportPair(t)
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(append([]byte("echo: "), body...))
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(handler)}
+	l := newConnListener(server.NetConn())
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(func() { _ = srv.Close() })
+
+	dial := func(context.Context, string, string) (net.Conn, error) {
+		return client.NetConn(), nil
+	}
+	hc := &http.Client{Transport: &http.Transport{DialContext: dial}}
+	for _, msg := range []string{"first", "second"} {
+		resp, err := hc.Post(
+			"http://kamune/", "text/plain", strings.NewReader(msg),
+		)
+		a.NoError(err)
+		body, err := io.ReadAll(resp.Body)
+		a.NoError(err)
+		a.NoError(resp.Body.Close())
+		a.Equal(http.StatusOK, resp.StatusCode)
+		a.Equal("echo: "+msg, string(body))
+	}
+}
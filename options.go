@@ -0,0 +1,313 @@
+package kamune
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/hossein1376/kamune/internal/attest"
+)
+
+var ErrUnsupportedNetwork = errors.New("unsupported network")
+
+type options struct {
+	attest           *attest.Attest
+	identityPath     string
+	passphrase       PassphraseFunc
+	keyStore         KeyStore
+	verifier         PeerVerifier
+	peerVerifier     PeerVerifier
+	remoteVerifier   RemoteVerifier
+	trustStore       *TrustStore
+	logger           *slog.Logger
+	handshakeTimeout time.Duration
+	network          string
+	dialer           *net.Dialer
+	suites           []CipherSuite
+	rekey            RekeyPolicy
+	features         uint32
+	sessions         SessionCache
+	ticketLifetime   time.Duration
+	migrationWindow  time.Duration
+}
+
+// DialOption configures how Dial establishes a connection.
+type DialOption interface {
+	applyDial(*options)
+}
+
+// ServerOption configures the Server created by NewServer.
+type ServerOption interface {
+	applyServer(*options)
+}
+
+// Option is accepted by both Dial and NewServer.
+type Option interface {
+	DialOption
+	ServerOption
+}
+
+type option func(*options)
+
+func (o option) applyDial(opts *options)   { o(opts) }
+func (o option) applyServer(opts *options) { o(opts) }
+
+type dialOption func(*options)
+
+func (o dialOption) applyDial(opts *options) { o(opts) }
+
+type serverOption func(*options)
+
+func (o serverOption) applyServer(opts *options) { o(opts) }
+
+// WithIdentity uses the given identity, instead of loading one from disk.
+func WithIdentity(at *attest.Attest) Option {
+	return option(func(o *options) { o.attest = at })
+}
+
+// WithIdentityFile loads the identity from the private key stored at path.
+// Unlike WithKeyStore, the file must already exist.
+func WithIdentityFile(path string) Option {
+	return option(func(o *options) { o.identityPath = path })
+}
+
+// WithPassphrase sets the function that provides the passphrase of the
+// identity key, used by WithIdentityFile and by the default key store. It is
+// only called if the key is encrypted, or if a new one is created; see
+// FileKeyStore.SetPassphrase.
+func WithPassphrase(fn PassphraseFunc) Option {
+	return option(func(o *options) { o.passphrase = fn })
+}
+
+// WithKeyStore loads the identity from ks, and creates and saves a new one if
+// the store is empty. By default, the store returned by DefaultFileKeyStore
+// is used.
+func WithKeyStore(ks KeyStore) Option {
+	return option(func(o *options) { o.keyStore = ks })
+}
+
+// WithRemoteVerifier sets the function that decides whether the remote
+// party's public key is trusted.
+func WithRemoteVerifier(v RemoteVerifier) Option {
+	return option(func(o *options) {
+		o.verifier, o.peerVerifier, o.remoteVerifier = nil, nil, v
+		if v != nil {
+			o.verifier = v.peer()
+		}
+	})
+}
+
+// WithPeerVerifier is like WithRemoteVerifier, but the verifier is given the
+// whole Peer. Values it sets on the Peer are carried by the context of the
+// Transport. Resumed sessions are verified again, and carry the values just
+// the same. Ready-made verifiers, such as Allowlist, TOFU and
+// AllowFingerprints, can be combined with And and Or.
+//
+// By default, the user is asked on the terminal, and the trusted keys are
+// pinned in the trust store. Without a terminal, only the pinned keys are
+// trusted.
+func WithPeerVerifier(v PeerVerifier) Option {
+	return option(func(o *options) {
+		o.verifier, o.peerVerifier, o.remoteVerifier = v, v, nil
+	})
+}
+
+// WithTrustStore sets the store in which the default verifier pins the keys
+// of the trusted peers. By default, the store returned by DefaultTrustStore
+// is used. It has no effect once a verifier is set.
+func WithTrustStore(ts *TrustStore) Option {
+	return option(func(o *options) { o.trustStore = ts })
+}
+
+// WithLogger sets the logger. By default, slog.Default is used.
+func WithLogger(l *slog.Logger) Option {
+	return option(func(o *options) { o.logger = l })
+}
+
+// WithHandshakeTimeout bounds the time it takes for the introduction and the
+// handshake to complete. Zero, the default, means no timeout.
+func WithHandshakeTimeout(d time.Duration) Option {
+	return option(func(o *options) { o.handshakeTimeout = d })
+}
+
+// WithNetwork sets the network to dial or listen on. It must be one of "tcp",
+// "tcp4", "tcp6" or "unix". Default is "tcp".
+func WithNetwork(network string) Option {
+	return option(func(o *options) { o.network = network })
+}
+
+// WithCipherSuites sets the cipher suites that are offered during the
+// introduction, in the order of preference. The dialer's preference decides
+// which common suite is used. By default, all suites returned by CipherSuites
+// are offered.
+func WithCipherSuites(suites ...CipherSuite) Option {
+	return option(func(o *options) { o.suites = suites })
+}
+
+// WithRekeyPolicy sets when the keys of a Transport are replaced. By default,
+// DefaultRekeyPolicy is used. The zero RekeyPolicy disables rekeying.
+func WithRekeyPolicy(p RekeyPolicy) Option {
+	return option(func(o *options) { o.rekey = p })
+}
+
+// WithDoubleRatchet enables the double ratchet, if the remote party enables it
+// as well. Instead of a single key per direction, every message is then
+// encrypted with a key of its own, which is deleted right after use. Keys are
+// continuously refreshed through new X25519 exchanges, as the conversation
+// goes back and forth. A key that leaks therefore reveals neither the past
+// messages, nor, once the ratchet has moved on, the future ones.
+//
+// It is meant for conversational workloads, such as chats. The rekey policy
+// has no effect on sessions that use it.
+func WithDoubleRatchet() Option {
+	return option(func(o *options) { o.features |= featureDoubleRatchet })
+}
+
+// WithMigration lets sessions survive the loss of their connection, if the
+// remote party enables it as well. When the connection breaks, for example
+// because the network has changed, the client dials the same address again
+// and reattaches the session to the new connection, proving that it holds
+// the session's keys. Records that were lost in transit are sent again, so
+// the Transport carries on as if nothing had happened. Sessions that are not
+// reattached within window are given up on. Zero means
+// DefaultMigrationWindow.
+//
+// Sent records are kept until the remote party acknowledges them, which it
+// does with every record it sends. A session whose traffic only flows one
+// way may therefore not be reattached, once too many records are pending.
+func WithMigration(window time.Duration) Option {
+	return option(func(o *options) {
+		if window <= 0 {
+			window = DefaultMigrationWindow
+		}
+		o.features |= featureMigration
+		o.migrationWindow = window
+	})
+}
+
+// WithSessionCache stores the resumption tickets issued by servers in c. On
+// the next Dial to the same address, the session is resumed, which skips the
+// key exchange. The server's identity is still verified as usual, and
+// resumption only succeeds if the server still holds the same identity.
+func WithSessionCache(c SessionCache) DialOption {
+	return dialOption(func(o *options) { o.sessions = c })
+}
+
+// WithSessionTickets makes the server issue resumption tickets to the clients
+// that ask for them. Tickets are valid for lifetime, and the keys that
+// encrypt them are rotated as often. Zero means DefaultTicketLifetime.
+func WithSessionTickets(lifetime time.Duration) ServerOption {
+	return serverOption(func(o *options) {
+		if lifetime <= 0 {
+			lifetime = DefaultTicketLifetime
+		}
+		o.ticketLifetime = lifetime
+	})
+}
+
+// WithDialer sets the dialer used to establish the underlying connection.
+func WithDialer(d *net.Dialer) DialOption {
+	return dialOption(func(o *options) { o.dialer = d })
+}
+
+func newOptions() *options {
+	o := &options{
+		logger:  slog.Default(),
+		network: "tcp",
+		dialer:  &net.Dialer{},
+		suites:  defaultSuites,
+		rekey:   DefaultRekeyPolicy,
+	}
+	o.verifier = o.defaultVerifier
+
+	return o
+}
+
+// defaultVerifier asks the user whether to trust the remote party, and
+// remembers the answer in the trust store.
+func (o *options) defaultVerifier(p *Peer) error {
+	ts := o.trustStore
+	if ts == nil {
+		var err error
+		if ts, err = DefaultTrustStore(); err != nil {
+			return fmt.Errorf("opening trust store: %w", err)
+		}
+	}
+	return askToTrust(ts, p)
+}
+
+func dialOptions(opts []DialOption) (*options, error) {
+	o := newOptions()
+	for _, opt := range opts {
+		opt.applyDial(o)
+	}
+	return o, o.validate()
+}
+
+func serverOptions(opts []ServerOption) (*options, error) {
+	o := newOptions()
+	for _, opt := range opts {
+		opt.applyServer(o)
+	}
+	return o, o.validate()
+}
+
+func (o *options) validate() error {
+	switch o.network {
+	case "tcp", "tcp4", "tcp6", "unix":
+	default:
+		return fmt.Errorf("%w: %q", ErrUnsupportedNetwork, o.network)
+	}
+	if len(o.suites) == 0 {
+		return ErrNoCommonSuite
+	}
+	for _, s := range o.suites {
+		if !s.supported() {
+			return fmt.Errorf("unsupported cipher suite: %s", s)
+		}
+	}
+	if o.verifier == nil {
+		return errors.New("remote verifier is nil")
+	}
+	if o.logger == nil {
+		o.logger = slog.Default()
+	}
+	if o.dialer == nil {
+		o.dialer = &net.Dialer{}
+	}
+
+	return nil
+}
+
+func (o *options) identity() (*attest.Attest, error) {
+	switch {
+	case o.attest != nil:
+		return o.attest, nil
+	case o.identityPath != "":
+		at, err := attest.LoadWithPassphrase(
+			o.identityPath, toAttest(o.passphrase),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("loading identity: %w", err)
+		}
+		return at, nil
+	}
+
+	ks := o.keyStore
+	if ks == nil {
+		fs, err := DefaultFileKeyStore()
+		if err != nil {
+			return nil, fmt.Errorf("opening key store: %w", err)
+		}
+		fs.SetPassphrase(o.passphrase)
+		ks = fs
+	}
+	at, err := loadOrCreate(ks)
+	if err != nil {
+		return nil, fmt.Errorf("loading identity: %w", err)
+	}
+
+	return at, nil
+}
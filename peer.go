@@ -1,85 +1,158 @@
 package kamune
 
 import (
-	"bytes"
-	"errors"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
 
 	"github.com/hossein1376/kamune/internal/attest"
 )
 
-var baseDir, privKeyPath string
+const keyName = "id.key"
+
+// Direction tells which party has initiated a connection.
+type Direction uint8
 
 const (
-	keyName        = "id.key"
-	knownPeersName = "known"
+	// Outbound connections are dialed by this party.
+	Outbound Direction = iota + 1
+	// Inbound connections are accepted by this party's Server.
+	Inbound
 )
 
-func init() {
-	home, err := os.UserHomeDir()
-	if err != nil {
-		panic(fmt.Errorf("getting home dir: %w", err))
-	}
-	baseDir = filepath.Join(home, ".config", "kamune")
-	privKeyPath = filepath.Join(baseDir, keyName)
-
-	_, err = os.Stat(privKeyPath)
-	switch {
-	case err == nil:
-		return
-	case errors.Is(err, os.ErrNotExist):
-		if err := newCert(); err != nil {
-			panic(fmt.Errorf("creating certificate: %w", err))
-		}
+func (d Direction) String() string {
+	switch d {
+	case Outbound:
+		return "outbound"
+	case Inbound:
+		return "inbound"
 	default:
-		panic(fmt.Errorf("checking private key's existence: %w", err))
+		return fmt.Sprintf("Direction(%d)", uint8(d))
 	}
 }
 
-func isPeerKnown(claim []byte) bool {
-	peers, err := os.ReadFile(filepath.Join(baseDir, knownPeersName))
-	if err != nil {
-		return false
+// PeerVerifier decides whether the remote party is trusted. Unlike
+// RemoteVerifier, it is given the whole Peer, and may attach values to the
+// connection.
+type PeerVerifier func(p *Peer) error
+
+// Peer is the remote party of a connection, as introduced before the
+// handshake.
+type Peer struct {
+	key    *attest.PublicKey
+	host   string
+	dir    Direction
+	local  net.Addr
+	remote net.Addr
+	values []peerValue
+	// established holds the functions to call once the handshake succeeds.
+	established []func() error
+}
+
+type peerValue struct {
+	key, value any
+}
+
+func newPeer(key *attest.PublicKey, conn net.Conn, dir Direction) *Peer {
+	return &Peer{
+		key:    key,
+		dir:    dir,
+		local:  conn.LocalAddr(),
+		remote: conn.RemoteAddr(),
 	}
-	for _, peer := range bytes.Split(peers, []byte("\n")) {
-		if bytes.Compare(peer, claim) == 0 {
-			return true
+}
+
+// PublicKey returns the public key that the remote party has introduced.
+func (p *Peer) PublicKey() *attest.PublicKey {
+	return p.key
+}
+
+// Fingerprint returns the fingerprint of the remote party's public key.
+func (p *Peer) Fingerprint() string {
+	return Fingerprint(p.key)
+}
+
+// Host returns the address that was dialed to reach the remote party. It is
+// empty for the clients of a Server, as they have no stable address.
+func (p *Peer) Host() string {
+	return p.host
+}
+
+// Direction tells whether the connection was dialed or accepted.
+func (p *Peer) Direction() Direction {
+	return p.dir
+}
+
+// LocalAddr returns the local address of the connection.
+func (p *Peer) LocalAddr() net.Addr {
+	return p.local
+}
+
+// RemoteAddr returns the remote address of the connection.
+func (p *Peer) RemoteAddr() net.Addr {
+	return p.remote
+}
+
+// SetValue attaches value to the connection under key. Once the Transport is
+// established, it is available from its context, as with context.WithValue.
+// It lets a verifier pass what it has learned about the remote party, such
+// as its role, on to the handler.
+func (p *Peer) SetValue(key, value any) {
+	p.values = append(p.values, peerValue{key: key, value: value})
+}
+
+// onEstablished registers fn to be called once the handshake has succeeded,
+// that is, once the remote party has proven that it holds its key. Verifiers
+// use it to defer the changes that should only outlive a trusted connection.
+func (p *Peer) onEstablished(fn func() error) {
+	p.established = append(p.established, fn)
+}
+
+// establish calls the functions registered by onEstablished, in order, and
+// stops at the first error.
+func (p *Peer) establish() error {
+	for _, fn := range p.established {
+		if err := fn(); err != nil {
+			return err
 		}
 	}
-
-	return false
+	return nil
 }
 
-func trustPeer(peer []byte) error {
-	f, err := os.OpenFile(
-		filepath.Join(baseDir, knownPeersName),
-		os.O_CREATE|os.O_APPEND|os.O_WRONLY,
-		0600,
-	)
-	if err != nil {
-		return fmt.Errorf("opening file: %w", err)
+// context returns parent, carrying the values that were set.
+func (p *Peer) context(parent context.Context) context.Context {
+	if parent == nil {
+		parent = context.Background()
 	}
-	defer f.Close()
-	if _, err := f.Write(append(peer, '\n')); err != nil {
-		return fmt.Errorf("writing to file: %w", err)
+	for _, v := range p.values {
+		parent = context.WithValue(parent, v.key, v.value)
 	}
+	return parent
+}
 
-	return nil
+// Fingerprint returns a short, printable digest of key, such as
+// "SHA256:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU". It is meant for
+// comparing keys by eye, and for storing them in lists of known peers.
+func Fingerprint(key *attest.PublicKey) string {
+	sum := sha256.Sum256(key.Marshal())
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
 }
 
-func newCert() error {
-	if err := os.MkdirAll(baseDir, 0700); err != nil {
-		return fmt.Errorf("MkdirAll: %w", err)
+// configDir returns the directory in which kamune keeps its files. It is
+// $XDG_CONFIG_HOME/kamune if the variable is set, and ~/.config/kamune
+// otherwise.
+func configDir() (string, error) {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "kamune"), nil
 	}
-	id, err := attest.New()
+	home, err := os.UserHomeDir()
 	if err != nil {
-		return fmt.Errorf("new attest: %w", err)
-	}
-	if err := id.Save(privKeyPath); err != nil {
-		return fmt.Errorf("saving cert: %w", err)
+		return "", fmt.Errorf("getting home dir: %w", err)
 	}
 
-	return nil
+	return filepath.Join(home, ".config", "kamune"), nil
 }
@@ -0,0 +1,98 @@
+package kamune
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/hossein1376/kamune/internal/attest"
+)
+
+type roleKey struct{}
+
+func TestTransport_PeerInfo(t *testing.T) {
+	a := require.New(t)
+	clientID, err := attest.New()
+	a.NoError(err)
+
+	type seen struct {
+		key         *attest.PublicKey
+		fingerprint string
+		local       net.Addr
+		remote      net.Addr
+		role        any
+		handshake   time.Time
+	}
+	handled := make(chan seen, 1)
+	srv, addr, _ := startServer(t, func(t *Transport) error {
+		handled <- seen{
+			key:         t.RemotePublicKey(),
+			fingerprint: t.Fingerprint(),
+			local:       t.LocalAddr(),
+			remote:      t.RemoteAddr(),
+			role:        t.Context().Value(roleKey{}),
+			handshake:   t.HandshakeTime(),
+		}
+		return nil
+	}, WithPeerVerifier(func(p *Peer) error {
+		if !p.PublicKey().Equal(clientID.PublicKey()) {
+			return ErrVerificationFailed
+		}
+		p.SetValue(roleKey{}, "admin")
+		return nil
+	}))
+
+	start := time.Now()
+	tr := dialServer(t, addr, WithIdentity(clientID))
+	a.True(tr.RemotePublicKey().Equal(srv.attest.PublicKey()))
+	a.Equal(Fingerprint(srv.attest.PublicKey()), tr.Fingerprint())
+	a.Equal(addr, tr.RemoteAddr().String())
+	a.Equal(defaultSuites[0], tr.CipherSuite())
+	a.False(tr.HandshakeTime().Before(start))
+
+	s := <-handled
+	a.True(s.key.Equal(clientID.PublicKey()))
+	a.Equal(Fingerprint(clientID.PublicKey()), s.fingerprint)
+	a.Equal(addr, s.local.String())
+	a.Equal(tr.LocalAddr().String(), s.remote.String())
+	a.Equal("admin", s.role)
+	a.False(s.handshake.Before(start))
+}
+
+func TestPeerVerifier_Rejects(t *testing.T) {
+	a := require.New(t)
+	reject := errors.New("not on the list")
+	_, addr, _ := startServer(t, echo)
+
+	var peer *Peer
+	_, err := Dial(
+		addr,
+		WithKeyStore(NewMemoryKeyStore()),
+		WithPeerVerifier(func(p *Peer) error {
+			peer = p
+			return reject
+		}),
+	)
+	a.ErrorIs(err, reject)
+	a.Equal(addr, peer.RemoteAddr().String())
+	a.NotNil(peer.LocalAddr())
+	a.Equal(Fingerprint(peer.PublicKey()), peer.Fingerprint())
+}
+
+func TestFingerprint(t *testing.T) {
+	a := require.New(t)
+	id, err := attest.New()
+	a.NoError(err)
+	other, err := attest.New()
+	a.NoError(err)
+
+	fp := Fingerprint(id.PublicKey())
+	a.True(strings.HasPrefix(fp, "SHA256:"))
+	a.Len(fp, len("SHA256:")+43)
+	a.Equal(fp, Fingerprint(id.PublicKey()))
+	a.NotEqual(fp, Fingerprint(other.PublicKey()))
+}
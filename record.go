@@ -0,0 +1,87 @@
+package kamune
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Every message on the wire is carried by a record: a 4 byte big-endian
+// length header followed by exactly that many bytes of payload. The payload
+// of a record can never exceed maxTransportSize.
+const recordHeaderSize = 4
+
+var (
+	ErrRecordTooLarge  = errors.New("record exceeds the maximum size")
+	ErrTruncatedRecord = errors.New("record is truncated")
+)
+
+// writeRecord frames the payload and writes it with a single call to Write,
+// so that concurrent readers on the other side always see whole records.
+func writeRecord(w io.Writer, payload []byte) error {
+	if len(payload) > maxTransportSize {
+		return ErrRecordTooLarge
+	}
+	buf := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(len(payload)))
+	copy(buf[recordHeaderSize:], payload)
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// readRecord reads exactly one record from r. It returns io.EOF only if the
+// stream ended cleanly on a record boundary.
+func readRecord(r io.Reader) ([]byte, error) {
+	rr := recordReader{r: r}
+	return rr.next()
+}
+
+// recordReader reads consecutive records from r. A record that could not be
+// read completely, because of a deadline for example, is kept and the next
+// call resumes from where the previous one stopped, so the framing of the
+// stream is never lost.
+type recordReader struct {
+	r       io.Reader
+	header  [recordHeaderSize]byte
+	payload []byte
+	n       int
+}
+
+func (rr *recordReader) next() ([]byte, error) {
+	for rr.n < recordHeaderSize {
+		n, err := rr.r.Read(rr.header[rr.n:])
+		rr.n += n
+		if err != nil && rr.n < recordHeaderSize {
+			if errors.Is(err, io.EOF) && rr.n > 0 {
+				return nil, ErrTruncatedRecord
+			}
+			return nil, err
+		}
+	}
+	if rr.payload == nil {
+		size := binary.BigEndian.Uint32(rr.header[:])
+		if size > maxTransportSize {
+			return nil, fmt.Errorf("%w: %d bytes", ErrRecordTooLarge, size)
+		}
+		rr.payload = make([]byte, size)
+	}
+	for read := rr.n - recordHeaderSize; read < len(rr.payload); {
+		n, err := rr.r.Read(rr.payload[read:])
+		rr.n += n
+		read += n
+		if err != nil && read < len(rr.payload) {
+			if errors.Is(err, io.EOF) {
+				return nil, ErrTruncatedRecord
+			}
+			return nil, err
+		}
+	}
+	payload := rr.payload
+	rr.payload, rr.n = nil, 0
+
+	return payload, nil
+}
@@ -0,0 +1,140 @@
+package kamune
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecord_BackToBack(t *testing.T) {
+	a := require.New(t)
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	var payloads [][]byte
+	for i := range 50 {
+		payloads = append(payloads, bytes.Repeat([]byte{byte(i)}, i*97))
+	}
+	payloads = append(payloads, bytes.Repeat([]byte("x"), maxTransportSize))
+
+	errCh := make(chan error, 1)
+	go func() {
+		for _, p := range payloads {
+			if err := writeRecord(c1, p); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		errCh <- c1.Close()
+	}()
+
+	for _, want := range payloads {
+		got, err := readRecord(c2)
+		a.NoError(err)
+		a.Equal(len(want), len(got))
+		a.Equal(want, got)
+	}
+	_, err := readRecord(c2)
+	a.ErrorIs(err, io.EOF)
+	a.NoError(<-errCh)
+}
+
+func TestRecord_ByteByByte(t *testing.T) {
+	a := require.New(t)
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	var stream bytes.Buffer
+	var payloads [][]byte
+	for i := range 5 {
+		p := []byte(fmt.Sprintf("record number %d", i))
+		payloads = append(payloads, p)
+		a.NoError(writeRecord(&stream, p))
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		for _, b := range stream.Bytes() {
+			if _, err := c1.Write([]byte{b}); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		errCh <- nil
+	}()
+
+	for _, want := range payloads {
+		got, err := readRecord(c2)
+		a.NoError(err)
+		a.Equal(want, got)
+	}
+	a.NoError(<-errCh)
+}
+
+func TestRecord_TooLarge(t *testing.T) {
+	a := require.New(t)
+
+	var buf bytes.Buffer
+	err := writeRecord(&buf, make([]byte, maxTransportSize+1))
+	a.ErrorIs(err, ErrRecordTooLarge)
+	a.Zero(buf.Len())
+
+	header := make([]byte, recordHeaderSize)
+	binary.BigEndian.PutUint32(header, maxTransportSize+1)
+	_, err = readRecord(bytes.NewReader(header))
+	a.ErrorIs(err, ErrRecordTooLarge)
+}
+
+func TestRecord_Truncated(t *testing.T) {
+	a := require.New(t)
+
+	var buf bytes.Buffer
+	a.NoError(writeRecord(&buf, []byte("this will not make it")))
+	full := buf.Bytes()
+
+	t.Run("header", func(t *testing.T) {
+		_, err := readRecord(bytes.NewReader(full[:recordHeaderSize-1]))
+		a.ErrorIs(err, ErrTruncatedRecord)
+	})
+	t.Run("payload", func(t *testing.T) {
+		_, err := readRecord(bytes.NewReader(full[:len(full)-1]))
+		a.ErrorIs(err, ErrTruncatedRecord)
+	})
+	t.Run("empty", func(t *testing.T) {
+		_, err := readRecord(bytes.NewReader(nil))
+		a.ErrorIs(err, io.EOF)
+	})
+}
+
+func TestRecord_ResumeAfterDeadline(t *testing.T) {
+	a := require.New(t)
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	var buf bytes.Buffer
+	a.NoError(writeRecord(&buf, []byte("interrupted, but not lost")))
+	full := buf.Bytes()
+	half := len(full) / 2
+
+	go func() { _, _ = c1.Write(full[:half]) }()
+	rr := &recordReader{r: c2}
+	a.NoError(c2.SetReadDeadline(time.Now().Add(50 * time.Millisecond)))
+	_, err := rr.next()
+	a.ErrorIs(err, os.ErrDeadlineExceeded)
+
+	go func() { _, _ = c1.Write(full[half:]) }()
+	a.NoError(c2.SetReadDeadline(time.Time{}))
+	got, err := rr.next()
+	a.NoError(err)
+	a.Equal("interrupted, but not lost", string(got))
+}
@@ -0,0 +1,62 @@
+package kamune
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrSequenceExhausted is returned once the sequence numbers of a direction
+// have run out. As they are part of the nonce, they must never wrap around;
+// a new session must be established instead.
+var ErrSequenceExhausted = errors.New("sequence numbers are exhausted")
+
+// RekeyPolicy decides how long each key of a Transport is used for. Once any
+// of the limits is reached, the sender moves to a new key, derived from the
+// current one, and tells the remote party to do the same. Each direction is
+// rekeyed on its own, according to the sender's policy. A zero limit disables
+// that trigger.
+type RekeyPolicy struct {
+	// Messages is the number of records, either whole messages or fragments
+	// of them, that are encrypted with a single key.
+	Messages uint64
+	// Bytes is the amount of data that is encrypted with a single key.
+	Bytes uint64
+	// Interval is how long a single key is used for.
+	Interval time.Duration
+}
+
+// DefaultRekeyPolicy is used unless WithRekeyPolicy is given.
+var DefaultRekeyPolicy = RekeyPolicy{
+	Messages: 1 << 24,
+	Bytes:    1 << 34,
+	Interval: time.Hour,
+}
+
+// keyUsage tracks how much a key has been used since it was created.
+type keyUsage struct {
+	messages uint64
+	bytes    uint64
+	since    time.Time
+}
+
+func newKeyUsage() keyUsage {
+	return keyUsage{since: time.Now()}
+}
+
+func (u *keyUsage) add(size int) {
+	u.messages++
+	u.bytes += uint64(size)
+}
+
+// due reports whether the key has reached any of the limits of p.
+func (p RekeyPolicy) due(u keyUsage) bool {
+	switch {
+	case p.Messages > 0 && u.messages >= p.Messages:
+		return true
+	case p.Bytes > 0 && u.bytes >= p.Bytes:
+		return true
+	case p.Interval > 0 && time.Since(u.since) >= p.Interval:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package kamune
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransport_Rekey(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RekeyPolicy
+		size   int
+		rekeys uint64
+	}{
+		{name: "disabled", policy: RekeyPolicy{}, size: 10},
+		{name: "messages", policy: RekeyPolicy{Messages: 3}, size: 10, rekeys: 3},
+		{name: "bytes", policy: RekeyPolicy{Bytes: 100}, size: 40, rekeys: 4},
+		{name: "interval", policy: RekeyPolicy{Interval: time.Nanosecond}, size: 10, rekeys: 10},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			a := require.New(t)
+			client, server := newTransportPair(t)
+			client.rekey, server.rekey = tc.policy, tc.policy
+
+			const count = 10
+			errCh := make(chan error, 1)
+			go func() {
+				for i := range count {
+					msg := bytes.Repeat([]byte{byte(i)}, tc.size)
+					if _, err := client.Send(Bytes(msg)); err != nil {
+						errCh <- err
+						return
+					}
+				}
+				errCh <- nil
+			}()
+			for i := range count {
+				b := Bytes(nil)
+				_, err := server.Receive(b)
+				a.NoError(err)
+				a.Equal(bytes.Repeat([]byte{byte(i)}, tc.size), b.GetValue())
+			}
+			a.NoError(<-errCh)
+
+			// The handshake and finished messages, the test messages and the rekey
+			// records.
+			a.Equal(2+count+tc.rekeys, client.sent.Load())
+			a.Equal(client.sent.Load(), server.received.Load())
+
+			go func() {
+				_, err := server.Send(Bytes([]byte("other direction")))
+				errCh <- err
+			}()
+			b := Bytes(nil)
+			_, err := client.Receive(b)
+			a.NoError(err)
+			a.Equal("other direction", string(b.GetValue()))
+			a.NoError(<-errCh)
+		})
+	}
+}
+
+func TestTransport_SequenceExhausted(t *testing.T) {
+	a := require.New(t)
+	client, server := newTransportPair(t)
+
+	client.sent.Store(math.MaxUint64)
+	_, err := client.Send(Bytes([]byte("one too many")))
+	a.ErrorIs(err, ErrSequenceExhausted)
+
+	server.received.Store(math.MaxUint64)
+	_, err = server.Receive(Bytes(nil))
+	a.ErrorIs(err, ErrSequenceExhausted)
+}
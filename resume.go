@@ -0,0 +1,346 @@
+package kamune
+
+import (
+	"crypto/cipher"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/hossein1376/kamune/internal/attest"
+	"github.com/hossein1376/kamune/internal/box/pb"
+	"github.com/hossein1376/kamune/internal/enigma"
+	"github.com/hossein1376/kamune/internal/exchange"
+)
+
+const (
+	// DefaultTicketLifetime is how long a resumption ticket is valid for,
+	// unless set otherwise by WithSessionTickets.
+	DefaultTicketLifetime = 12 * time.Hour
+
+	ticketKeyNameSize = 16
+)
+
+var (
+	ErrInvalidTicket = errors.New("invalid resumption ticket")
+
+	resumeLabel = []byte("kamune resumed session")
+)
+
+// Session is what a client needs to resume a session with a server, without
+// going through the handshake again.
+type Session struct {
+	ticket  []byte
+	secret  []byte
+	remote  *attest.PublicKey
+	version uint32
+	suite   CipherSuite
+	expiry  time.Time
+}
+
+// Expiry returns the time after which the server no longer accepts the
+// session.
+func (s *Session) Expiry() time.Time {
+	return s.expiry
+}
+
+// SessionCache stores the sessions of the clients, so that they can resume
+// them later. Keys are the dialed addresses.
+type SessionCache interface {
+	// Get returns the session of key, if there is one.
+	Get(key string) (*Session, bool)
+	// Put stores the session of key. A nil session removes it.
+	Put(key string, s *Session)
+}
+
+// MemorySessionCache keeps sessions in memory.
+type MemorySessionCache struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func NewMemorySessionCache() *MemorySessionCache {
+	return &MemorySessionCache{sessions: make(map[string]*Session)}
+}
+
+func (mc *MemorySessionCache) Get(key string) (*Session, bool) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	s, ok := mc.sessions[key]
+	return s, ok
+}
+
+func (mc *MemorySessionCache) Put(key string, s *Session) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if s == nil {
+		delete(mc.sessions, key)
+		return
+	}
+	mc.sessions[key] = s
+}
+
+// ticketKeys encrypts the tickets issued by a Server. A new key is created
+// once the current one is older than the ticket lifetime. The previous key is
+// kept around for decryption only, so that every ticket stays valid for its
+// whole lifetime.
+type ticketKeys struct {
+	mu       sync.Mutex
+	lifetime time.Duration
+	keys     []ticketKey
+}
+
+type ticketKey struct {
+	name    []byte
+	aead    cipher.AEAD
+	created time.Time
+}
+
+func newTicketKeys(lifetime time.Duration) *ticketKeys {
+	return &ticketKeys{lifetime: lifetime}
+}
+
+// rotate creates a new key, and drops all but the previous one.
+func (tk *ticketKeys) rotate() {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+	tk.rotateLocked()
+}
+
+func (tk *ticketKeys) rotateLocked() {
+	aead, err := chacha20poly1305.NewX(randomBytes(chacha20poly1305.KeySize))
+	if err != nil {
+		panic(fmt.Errorf("creating ticket key: %w", err))
+	}
+	key := ticketKey{
+		name:    randomBytes(ticketKeyNameSize),
+		aead:    aead,
+		created: time.Now(),
+	}
+	tk.keys = append([]ticketKey{key}, tk.keys[:min(len(tk.keys), 1)]...)
+}
+
+func (tk *ticketKeys) seal(state *pb.TicketState) ([]byte, error) {
+	plaintext, err := proto.Marshal(state)
+	if err != nil {
+		return nil, fmt.Errorf("marshalling ticket: %w", err)
+	}
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+	if len(tk.keys) == 0 || time.Since(tk.keys[0].created) >= tk.lifetime {
+		tk.rotateLocked()
+	}
+	key := tk.keys[0]
+	nonce := randomBytes(key.aead.NonceSize())
+	ticket := slices.Concat(key.name, nonce)
+
+	return key.aead.Seal(ticket, nonce, plaintext, key.name), nil
+}
+
+func (tk *ticketKeys) open(ticket []byte) (*pb.TicketState, error) {
+	tk.mu.Lock()
+	keys := slices.Clone(tk.keys)
+	tk.mu.Unlock()
+
+	const headerSize = ticketKeyNameSize + chacha20poly1305.NonceSizeX
+	if len(ticket) < headerSize {
+		return nil, ErrInvalidTicket
+	}
+	name := ticket[:ticketKeyNameSize]
+	nonce := ticket[ticketKeyNameSize:headerSize]
+	ciphertext := ticket[headerSize:]
+	for _, key := range keys {
+		if !slices.Equal(key.name, name) {
+			continue
+		}
+		plaintext, err := key.aead.Open(nil, nonce, ciphertext, name)
+		if err != nil {
+			return nil, ErrInvalidTicket
+		}
+		var state pb.TicketState
+		if err := proto.Unmarshal(plaintext, &state); err != nil {
+			return nil, ErrInvalidTicket
+		}
+		return &state, nil
+	}
+
+	return nil, ErrInvalidTicket
+}
+
+// resumeIntroduce adds what is needed to resume s to the client's
+// introduction.
+func resumeIntroduce(
+	intro *pb.Introduce, s *Session,
+) (ec *exchange.ECDH, nonce []byte, err error) {
+	ec, err = exchange.NewECDH()
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating ECDH keys: %w", err)
+	}
+	nonce = randomBytes(enigma.BaseNonceSize)
+	intro.Ticket = s.ticket
+	intro.Nonce = nonce
+	intro.ECDH = ec.MarshalPublicKey()
+
+	return ec, nonce, nil
+}
+
+// resumable checks whether the client's ticket can be accepted, and returns
+// the resumption secret if so. The ticket must belong to the very identity
+// that the client has introduced, and the negotiated parameters must not
+// have changed since it was issued.
+func (tk *ticketKeys) resumable(intro *introduction, n negotiation) []byte {
+	if tk == nil || len(intro.ticket) == 0 ||
+		len(intro.nonce) != enigma.BaseNonceSize || len(intro.ecdh) == 0 {
+		return nil
+	}
+	state, err := tk.open(intro.ticket)
+	if err != nil {
+		return nil
+	}
+	remote, err := attest.ParsePublicKey(state.GetRemote())
+	switch {
+	case err != nil,
+		!remote.Equal(intro.remote),
+		time.Now().Unix() >= state.GetExpiry(),
+		state.GetVersion() != n.version,
+		state.GetSuite() != uint32(n.suite):
+		return nil
+	}
+
+	return state.GetSecret()
+}
+
+// resumeClient establishes a resumed session. Instead of the handshake, the
+// keys are derived from the stored resumption secret, a fresh X25519
+// exchange and the transcript of the introduction. The finished messages
+// still prove both identities.
+func resumeClient(
+	pt *plainTransport,
+	s *Session,
+	ec *exchange.ECDH,
+	nonce []byte,
+	remote *introduction,
+) (*Transport, error) {
+	if !s.remote.Equal(remote.remote) {
+		return nil, fmt.Errorf(
+			"%w: server identity has changed", ErrVerificationFailed,
+		)
+	}
+	if s.version != pt.negotiation.version || s.suite != pt.negotiation.suite {
+		return nil, ErrDowngrade
+	}
+	if len(remote.nonce) != enigma.BaseNonceSize {
+		return nil, ErrInvalidTicket
+	}
+	ecSecret, err := ec.Exchange(remote.ecdh)
+	if err != nil {
+		return nil, fmt.Errorf("exchanging ECDH keys: %w", err)
+	}
+	th := pt.transcript.sum()
+	secret, err := enigma.Combine(th, resumeLabel, s.secret, ecSecret)
+	if err != nil {
+		return nil, fmt.Errorf("deriving secret: %w", err)
+	}
+	encoder, decoder, err := clientSealers(
+		pt, secret, nonce, remote.nonce, remote.ecdh,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	t := newTransport(pt, resumedSessionID(th), encoder, decoder)
+	t.resumed = true
+	if err := finishHandshake(t, th, secret, true); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// resumeServer is the server's counterpart of resumeClient. ec and nonce are
+// what the server has sent in its introduction.
+func resumeServer(
+	pt *plainTransport,
+	resumption []byte,
+	ec *exchange.ECDH,
+	nonce []byte,
+	remote *introduction,
+) (*Transport, error) {
+	ecSecret, err := ec.Exchange(remote.ecdh)
+	if err != nil {
+		return nil, fmt.Errorf("exchanging ECDH keys: %w", err)
+	}
+	th := pt.transcript.sum()
+	secret, err := enigma.Combine(th, resumeLabel, resumption, ecSecret)
+	if err != nil {
+		return nil, fmt.Errorf("deriving secret: %w", err)
+	}
+	encoder, decoder, err := serverSealers(pt, secret, nonce, remote.nonce, ec)
+	if err != nil {
+		return nil, err
+	}
+
+	t := newTransport(pt, resumedSessionID(th), encoder, decoder)
+	t.resumed = true
+	if err := finishHandshake(t, th, secret, false); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// resumedSessionID derives the session ID from the transcript, as there is
+// no handshake message to carry one.
+func resumedSessionID(th []byte) string {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(
+		th[:16],
+	)
+}
+
+// issueTicket sends a new ticket to the client, to resume t later on.
+func (tk *ticketKeys) issueTicket(t *Transport) error {
+	expiry := time.Now().Add(tk.lifetime)
+	ticket, err := tk.seal(&pb.TicketState{
+		Secret:  t.resumption,
+		Remote:  t.remote.Marshal(),
+		Version: t.negotiation.version,
+		Suite:   uint32(t.negotiation.suite),
+		Expiry:  expiry.Unix(),
+	})
+	if err != nil {
+		return fmt.Errorf("sealing ticket: %w", err)
+	}
+	_, err = t.Send(&pb.Ticket{
+		Ticket:   ticket,
+		Lifetime: uint32(tk.lifetime / time.Second),
+	})
+	if err != nil {
+		return fmt.Errorf("sending ticket: %w", err)
+	}
+
+	return nil
+}
+
+// receiveTicket receives the ticket that the server issues right after the
+// handshake.
+func receiveTicket(t *Transport) (*Session, error) {
+	var ticket pb.Ticket
+	if _, err := t.Receive(&ticket); err != nil {
+		return nil, fmt.Errorf("receiving ticket: %w", err)
+	}
+	lifetime := time.Duration(ticket.GetLifetime()) * time.Second
+
+	return &Session{
+		ticket:  ticket.GetTicket(),
+		secret:  t.resumption,
+		remote:  t.remote,
+		version: t.negotiation.version,
+		suite:   t.negotiation.suite,
+		expiry:  time.Now().Add(lifetime),
+	}, nil
+}
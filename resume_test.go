@@ -0,0 +1,196 @@
+package kamune
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/hossein1376/kamune/internal/attest"
+	"github.com/hossein1376/kamune/internal/box/pb"
+	"github.com/hossein1376/kamune/internal/enigma"
+)
+
+func roundTrip(t *testing.T, tr *Transport, msg string) {
+	t.Helper()
+	a := require.New(t)
+	_, err := tr.Send(Bytes([]byte(msg)))
+	a.NoError(err)
+	b := Bytes(nil)
+	_, err = tr.Receive(b)
+	a.NoError(err)
+	a.Equal(msg, string(b.GetValue()))
+}
+
+func TestResumption(t *testing.T) {
+	a := require.New(t)
+	srv, addr, _ := startServer(t, echo, WithSessionTickets(0))
+	cache := NewMemorySessionCache()
+	clientID, err := attest.New()
+	a.NoError(err)
+
+	var verified atomic.Int32
+	verifier := WithRemoteVerifier(func(*attest.PublicKey) error {
+		verified.Add(1)
+		return nil
+	})
+
+	first := dialServer(
+		t, addr, WithIdentity(clientID), WithSessionCache(cache), verifier,
+	)
+	a.False(first.Resumed())
+	roundTrip(t, first, "full handshake")
+	s, ok := cache.Get(addr)
+	a.True(ok)
+	a.True(s.Expiry().After(time.Now()))
+
+	for i := range 2 {
+		tr := dialServer(
+			t, addr, WithIdentity(clientID), WithSessionCache(cache), verifier,
+		)
+		a.True(tr.Resumed(), "attempt %d", i)
+		a.NotEqual(first.SessionID(), tr.SessionID())
+		roundTrip(t, tr, "resumed")
+	}
+	// Resumed sessions are verified as well.
+	a.EqualValues(3, verified.Load())
+
+	t.Run("rotated keys", func(t *testing.T) {
+		a := require.New(t)
+		srv.RotateTicketKeys()
+		srv.RotateTicketKeys()
+		tr := dialServer(
+			t, addr, WithIdentity(clientID), WithSessionCache(cache),
+		)
+		a.False(tr.Resumed())
+		roundTrip(t, tr, "fell back to the handshake")
+	})
+
+	t.Run("other client", func(t *testing.T) {
+		a := require.New(t)
+		s, ok := cache.Get(addr)
+		a.True(ok)
+		other := NewMemorySessionCache()
+		other.Put(addr, s)
+
+		tr := dialServer(t, addr, WithSessionCache(other))
+		a.False(tr.Resumed())
+		roundTrip(t, tr, "the ticket belongs to someone else")
+	})
+
+	t.Run("server identity changed", func(t *testing.T) {
+		a := require.New(t)
+		impostor, impostorAddr, _ := startServer(t, echo, WithSessionTickets(0))
+		impostor.tickets = srv.tickets
+		s, ok := cache.Get(addr)
+		a.True(ok)
+		stolen := NewMemorySessionCache()
+		stolen.Put(impostorAddr, s)
+
+		_, err := Dial(
+			impostorAddr,
+			WithIdentity(clientID),
+			WithRemoteVerifier(acceptAll),
+			WithSessionCache(stolen),
+		)
+		a.ErrorIs(err, ErrVerificationFailed)
+	})
+}
+
+func TestResumption_Revoked(t *testing.T) {
+	a := require.New(t)
+	clientID, err := attest.New()
+	a.NoError(err)
+	ts := NewMemoryTrustStore()
+	a.NoError(ts.Add("client", clientID.PublicKey(), ""))
+
+	roles := make(chan any, 2)
+	_, addr, _ := startServer(t, func(t *Transport) error {
+		roles <- t.Context().Value(roleKey{})
+		return echo(t)
+	}, WithSessionTickets(0), WithPeerVerifier(func(p *Peer) error {
+		if err := Allowlist(ts)(p); err != nil {
+			return err
+		}
+		p.SetValue(roleKey{}, "admin")
+		return nil
+	}))
+	cache := NewMemorySessionCache()
+	dial := func() (*Transport, error) {
+		return Dial(
+			addr,
+			WithIdentity(clientID),
+			WithSessionCache(cache),
+			WithRemoteVerifier(acceptAll),
+			WithHandshakeTimeout(time.Second),
+		)
+	}
+
+	first, err := dial()
+	a.NoError(err)
+	t.Cleanup(func() { _ = first.Close() })
+	roundTrip(t, first, "full handshake")
+	a.Equal("admin", <-roles)
+
+	resumed, err := dial()
+	a.NoError(err)
+	t.Cleanup(func() { _ = resumed.Close() })
+	a.True(resumed.Resumed())
+	roundTrip(t, resumed, "resumed")
+	// The values set by the verifier are carried by resumed sessions too.
+	a.Equal("admin", <-roles)
+
+	// Once the client is no longer trusted, its ticket is of no use.
+	a.NoError(ts.Remove("client"))
+	_, err = dial()
+	a.Error(err)
+}
+
+func TestTicketKeys(t *testing.T) {
+	a := require.New(t)
+	clientID, err := attest.New()
+	a.NoError(err)
+	tk := newTicketKeys(time.Hour)
+	n := testNegotiation()
+	intro := func(ticket []byte) *introduction {
+		return &introduction{
+			remote: clientID.PublicKey(),
+			ticket: ticket,
+			nonce:  make([]byte, enigma.BaseNonceSize),
+			ecdh:   []byte("share"),
+		}
+	}
+	seal := func(expiry time.Time, suite CipherSuite) []byte {
+		ticket, err := tk.seal(&pb.TicketState{
+			Secret:  []byte("resumption secret"),
+			Remote:  clientID.PublicKey().Marshal(),
+			Version: ProtocolVersion,
+			Suite:   uint32(suite),
+			Expiry:  expiry.Unix(),
+		})
+		a.NoError(err)
+		return ticket
+	}
+
+	valid := seal(time.Now().Add(time.Hour), n.suite)
+	a.Equal([]byte("resumption secret"), tk.resumable(intro(valid), n))
+
+	expired := seal(time.Now().Add(-time.Second), n.suite)
+	a.Nil(tk.resumable(intro(expired), n))
+
+	otherSuite := seal(time.Now().Add(time.Hour), defaultSuites[1])
+	a.Nil(tk.resumable(intro(otherSuite), n))
+
+	tampered := append([]byte(nil), valid...)
+	tampered[len(tampered)-1] ^= 0xFF
+	a.Nil(tk.resumable(intro(tampered), n))
+
+	tk.rotate()
+	a.NotNil(tk.resumable(intro(valid), n))
+	tk.rotate()
+	a.Nil(tk.resumable(intro(valid), n))
+
+	var none *ticketKeys
+	a.Nil(none.resumable(intro(valid), n))
+}
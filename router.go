@@ -0,0 +1,162 @@
+package kamune
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+var (
+	ErrNoRoute      = errors.New("no handler for the message type")
+	ErrHandlerPanic = errors.New("handler panicked")
+)
+
+// RouteHandler handles a message that was dispatched by a Router. msg is of
+// the type that the handler was registered for.
+type RouteHandler func(t *Transport, msg Transferable, md *Metadata) error
+
+// FallbackHandler handles the messages whose type has no handler. The message
+// is left packed, as its type may not even be known to this party.
+type FallbackHandler func(t *Transport, msg *anypb.Any, md *Metadata) error
+
+// Router dispatches the incoming messages to handlers based on their types,
+// so a single Transport can carry messages of many types. The sender must
+// pack the messages with SendTyped, which tells the Router their type.
+type Router struct {
+	mu       sync.RWMutex
+	routes   map[protoreflect.FullName]route
+	fallback FallbackHandler
+	recover  bool
+}
+
+type route struct {
+	typ     protoreflect.MessageType
+	handler RouteHandler
+}
+
+// NewRouter returns a Router with no handlers.
+func NewRouter() *Router {
+	return &Router{routes: make(map[protoreflect.FullName]route)}
+}
+
+// Handle registers h for the messages of the same type as msg. msg is only
+// used for its type, so a nil pointer of that type will do. Registering the
+// same type again replaces its handler.
+func (r *Router) Handle(msg Transferable, h RouteHandler) {
+	typ := msg.ProtoReflect().Type()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes[typ.Descriptor().FullName()] = route{typ: typ, handler: h}
+}
+
+// Route registers a handler for the messages of type T.
+func Route[T Transferable](
+	r *Router, h func(t *Transport, msg T, md *Metadata) error,
+) {
+	var zero T
+	r.Handle(zero, func(t *Transport, msg Transferable, md *Metadata) error {
+		return h(t, msg.(T), md)
+	})
+}
+
+// Fallback sets the handler of the messages whose type has no handler of its
+// own. Without one, such messages fail with ErrNoRoute.
+func (r *Router) Fallback(h FallbackHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fallback = h
+}
+
+// RecoverPanics makes the Router recover from panicking handlers, and report
+// them as errors wrapping ErrHandlerPanic instead.
+func (r *Router) RecoverPanics() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.recover = true
+}
+
+// Serve receives messages from t and dispatches them, until either receiving
+// or a handler fails. It returns nil once the remote party closes the
+// connection. Serve is a HandlerFunc, so a Router can be served directly by a
+// Server.
+func (r *Router) Serve(t *Transport) error {
+	return r.ServeContext(context.Background(), t)
+}
+
+// ServeContext is like Serve, but also stops once ctx is done, in which case
+// the returned error wraps ctx.Err().
+func (r *Router) ServeContext(ctx context.Context, t *Transport) error {
+	for {
+		var msg anypb.Any
+		md, err := t.ReceiveContext(ctx, &msg)
+		switch {
+		case errors.Is(err, ErrConnClosedByRemote):
+			return nil
+		case err != nil:
+			return err
+		}
+		if err := r.Dispatch(t, &msg, md); err != nil {
+			return err
+		}
+	}
+}
+
+// Dispatch unpacks msg and passes it to the handler of its type, or to the
+// fallback if there is none.
+func (r *Router) Dispatch(
+	t *Transport, msg *anypb.Any, md *Metadata,
+) (err error) {
+	r.mu.RLock()
+	rt, ok := r.routes[msg.MessageName()]
+	fallback, recovers := r.fallback, r.recover
+	r.mu.RUnlock()
+
+	if recovers {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf(
+					"%w: %s: %v", ErrHandlerPanic, msg.MessageName(), p,
+				)
+			}
+		}()
+	}
+
+	if !ok {
+		if fallback == nil {
+			return fmt.Errorf("%w: %s", ErrNoRoute, msg.GetTypeUrl())
+		}
+		return fallback(t, msg, md)
+	}
+	dst := rt.typ.New().Interface()
+	if err := msg.UnmarshalTo(dst); err != nil {
+		return fmt.Errorf("unmarshalling %s: %w", msg.MessageName(), err)
+	}
+
+	return rt.handler(t, dst, md)
+}
+
+// SendTyped packs the message along with its type, and sends it. The remote
+// party should receive it with a Router.
+func (t *Transport) SendTyped(message Transferable) (*Metadata, error) {
+	msg, err := anypb.New(message)
+	if err != nil {
+		return nil, fmt.Errorf("packing message: %w", err)
+	}
+	return t.Send(msg)
+}
+
+// SendTypedContext is like SendTyped, but gives up once ctx is done, as with
+// SendContext.
+func (t *Transport) SendTypedContext(
+	ctx context.Context, message Transferable,
+) (*Metadata, error) {
+	msg, err := anypb.New(message)
+	if err != nil {
+		return nil, fmt.Errorf("packing message: %w", err)
+	}
+	return t.SendContext(ctx, msg)
+}
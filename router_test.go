@@ -0,0 +1,110 @@
+package kamune
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestRouter(t *testing.T) {
+	a := require.New(t)
+
+	type dispatched struct {
+		kind  string
+		value any
+	}
+	got := make(chan dispatched, 8)
+	router := NewRouter()
+	Route(router, func(_ *Transport, msg *wrapperspb.StringValue, _ *Metadata) error {
+		got <- dispatched{"string", msg.GetValue()}
+		return nil
+	})
+	Route(router, func(_ *Transport, msg *wrapperspb.Int64Value, _ *Metadata) error {
+		got <- dispatched{"int", msg.GetValue()}
+		return nil
+	})
+	router.Handle(
+		(*wrapperspb.BytesValue)(nil),
+		func(tr *Transport, msg Transferable, _ *Metadata) error {
+			// Echo the bytes back, so both directions are exercised.
+			_, err := tr.SendTyped(msg)
+			return err
+		},
+	)
+	router.Fallback(func(_ *Transport, msg *anypb.Any, _ *Metadata) error {
+		got <- dispatched{"fallback", string(msg.MessageName())}
+		return nil
+	})
+	served := make(chan error, 1)
+	_, addr, _ := startServer(t, func(tr *Transport) error {
+		err := router.Serve(tr)
+		served <- err
+		return err
+	})
+
+	tr := dialServer(t, addr)
+	_, err := tr.SendTyped(wrapperspb.String("hello"))
+	a.NoError(err)
+	_, err = tr.SendTyped(wrapperspb.Int64(42))
+	a.NoError(err)
+	_, err = tr.SendTyped(timestamppb.Now())
+	a.NoError(err)
+	_, err = tr.SendTyped(Bytes([]byte("ping")))
+	a.NoError(err)
+
+	a.Equal(dispatched{"string", "hello"}, <-got)
+	a.Equal(dispatched{"int", int64(42)}, <-got)
+	a.Equal(dispatched{"fallback", "google.protobuf.Timestamp"}, <-got)
+
+	client := NewRouter()
+	echoed := make(chan []byte, 1)
+	Route(client, func(_ *Transport, msg *wrapperspb.BytesValue, _ *Metadata) error {
+		echoed <- msg.GetValue()
+		return nil
+	})
+	ctx, cancel := context.WithCancel(t.Context())
+	clientDone := make(chan error, 1)
+	go func() { clientDone <- client.ServeContext(ctx, tr) }()
+	a.Equal([]byte("ping"), <-echoed)
+	cancel()
+	a.ErrorIs(<-clientDone, context.Canceled)
+
+	a.NoError(tr.Close())
+	a.NoError(<-served)
+}
+
+func TestRouter_Errors(t *testing.T) {
+	a := require.New(t)
+	router := NewRouter()
+	Route(router, func(*Transport, *wrapperspb.StringValue, *Metadata) error {
+		panic("boom")
+	})
+
+	packed := func(m Transferable) *anypb.Any {
+		msg, err := anypb.New(m)
+		a.NoError(err)
+		return msg
+	}
+
+	err := router.Dispatch(nil, packed(durationpb.New(time.Second)), nil)
+	a.ErrorIs(err, ErrNoRoute)
+	a.ErrorContains(err, "google.protobuf.Duration")
+
+	broken := packed(wrapperspb.String("x"))
+	broken.Value = []byte{0xff}
+	a.Error(router.Dispatch(nil, broken, nil))
+
+	a.Panics(func() {
+		_ = router.Dispatch(nil, packed(wrapperspb.String("x")), nil)
+	})
+	router.RecoverPanics()
+	err = router.Dispatch(nil, packed(wrapperspb.String("x")), nil)
+	a.ErrorIs(err, ErrHandlerPanic)
+	a.ErrorContains(err, "boom")
+}
@@ -0,0 +1,401 @@
+package kamune
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/hossein1376/kamune/internal/box/pb"
+)
+
+var ErrRPCClosed = errors.New("rpc is closed")
+
+// ErrorCode classifies the errors that a remote handler returns.
+type ErrorCode uint32
+
+const (
+	// CodeUnknown is the code of the errors that do not carry one.
+	CodeUnknown ErrorCode = iota
+	// CodeNotFound means the remote party has no handler for the request.
+	CodeNotFound
+	// CodeInvalidArgument means the request was rejected as invalid.
+	CodeInvalidArgument
+	// CodeCanceled means the handler was canceled.
+	CodeCanceled
+	// CodeDeadlineExceeded means the handler ran past the call's deadline.
+	CodeDeadlineExceeded
+	// CodeInternal means the handler failed unexpectedly, e.g. it panicked.
+	CodeInternal
+)
+
+func (c ErrorCode) String() string {
+	switch c {
+	case CodeUnknown:
+		return "unknown"
+	case CodeNotFound:
+		return "not found"
+	case CodeInvalidArgument:
+		return "invalid argument"
+	case CodeCanceled:
+		return "canceled"
+	case CodeDeadlineExceeded:
+		return "deadline exceeded"
+	case CodeInternal:
+		return "internal"
+	default:
+		return fmt.Sprintf("code %d", uint32(c))
+	}
+}
+
+// RemoteError is an error that the remote party's handler has returned.
+type RemoteError struct {
+	Code    ErrorCode
+	Message string
+}
+
+// Errorf returns a RemoteError, so a handler can choose the code that its
+// caller receives. Any other error is received with CodeUnknown.
+func Errorf(code ErrorCode, format string, a ...any) error {
+	return &RemoteError{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("remote error: %s: %s", e.Code, e.Message)
+}
+
+// Is reports whether target is a RemoteError with the same code, so that
+// errors.Is(err, &RemoteError{Code: CodeNotFound}) matches any such error.
+// Errors with CodeCanceled and CodeDeadlineExceeded also match the respective
+// context errors, as the call may fail either locally or remotely.
+func (e *RemoteError) Is(target error) bool {
+	switch target {
+	case context.Canceled:
+		return e.Code == CodeCanceled
+	case context.DeadlineExceeded:
+		return e.Code == CodeDeadlineExceeded
+	}
+	t, ok := target.(*RemoteError)
+	return ok && t.Code == e.Code
+}
+
+// CallHandler handles a request, and returns its response. req is of the
+// type that the handler was registered for.
+type CallHandler func(
+	ctx context.Context, req Transferable,
+) (Transferable, error)
+
+// RPC makes and serves calls over a single Transport. Calls are matched with
+// their responses by IDs, so any number of them can be in flight at once.
+// Both parties may call each other, and each one registers the handlers of
+// the requests it serves. Once a Transport is handed to an RPC, it must no
+// longer be used directly.
+type RPC struct {
+	t *Transport
+
+	mu       sync.Mutex
+	handlers map[protoreflect.FullName]callRoute
+	calls    map[uint64]chan *pb.CallFrame
+	running  map[uint64]runningCall
+	nextID   uint64
+	err      error
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type callRoute struct {
+	typ     protoreflect.MessageType
+	handler CallHandler
+}
+
+// NewRPC starts reading the calls and responses from t. Both parties must do
+// so.
+func NewRPC(t *Transport) *RPC {
+	ctx, cancel := context.WithCancel(t.Context())
+	r := &RPC{
+		t:        t,
+		handlers: make(map[protoreflect.FullName]callRoute),
+		calls:    make(map[uint64]chan *pb.CallFrame),
+		running:  make(map[uint64]runningCall),
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	go r.run()
+
+	return r
+}
+
+// Handle registers h for the requests of the same type as req. req is only
+// used for its type, so a nil pointer of that type will do. Registering the
+// same type again replaces its handler.
+//
+// Each request is handled in a goroutine of its own, with a context that is
+// canceled once the caller gives up, its deadline passes, or the RPC stops. A
+// panicking handler is reported to the caller with CodeInternal.
+func (r *RPC) Handle(req Transferable, h CallHandler) {
+	typ := req.ProtoReflect().Type()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[typ.Descriptor().FullName()] = callRoute{typ: typ, handler: h}
+}
+
+// Method registers a handler for the requests of type Req.
+func Method[Req, Resp Transferable](
+	r *RPC, h func(ctx context.Context, req Req) (Resp, error),
+) {
+	var zero Req
+	r.Handle(zero, func(
+		ctx context.Context, req Transferable,
+	) (Transferable, error) {
+		resp, err := h(ctx, req.(Req))
+		if err != nil {
+			return nil, err
+		}
+		return resp, nil
+	})
+}
+
+// Call sends req to the remote party, and waits for the response to be read
+// into resp. The handler is picked by the type of req. The deadline of ctx is
+// passed along to the handler, as the time left, and if ctx is done before
+// the response arrives, the remote party is told to cancel the handler.
+// Errors returned by the handler are of type *RemoteError.
+func (r *RPC) Call(ctx context.Context, req, resp Transferable) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	payload, err := anypb.New(req)
+	if err != nil {
+		return fmt.Errorf("packing request: %w", err)
+	}
+	method := payload.MessageName()
+
+	r.mu.Lock()
+	if r.err != nil {
+		r.mu.Unlock()
+		return r.err
+	}
+	r.nextID++
+	id := r.nextID
+	ch := make(chan *pb.CallFrame, 1)
+	r.calls[id] = ch
+	r.mu.Unlock()
+	defer r.forget(id)
+
+	f := &pb.CallFrame{ID: id, Type: pb.CallType_Request, Payload: payload}
+	if d, ok := ctx.Deadline(); ok {
+		// The time left is sent, rather than the deadline itself, so that the
+		// clocks of the parties need not agree.
+		f.Timeout = durationpb.New(time.Until(d))
+	}
+	if err := r.send(f); err != nil {
+		return fmt.Errorf("calling %s: %w", method, err)
+	}
+
+	select {
+	case f := <-ch:
+		if e := f.GetError(); e != nil {
+			return &RemoteError{
+				Code: ErrorCode(e.GetCode()), Message: e.GetMessage(),
+			}
+		}
+		if err := f.GetPayload().UnmarshalTo(resp); err != nil {
+			return fmt.Errorf("unmarshalling response: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		cancel := &pb.CallFrame{ID: id, Type: pb.CallType_Cancel}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			cancel.Error = &pb.CallError{
+				Code:    uint32(CodeDeadlineExceeded),
+				Message: ctx.Err().Error(),
+			}
+		}
+		go func() { _ = r.send(cancel) }()
+		return fmt.Errorf("calling %s: %w", method, ctx.Err())
+	case <-r.done:
+		return fmt.Errorf("calling %s: %w", method, r.Err())
+	}
+}
+
+// Close stops the RPC, and closes the Transport. Pending calls fail, and the
+// contexts of the running handlers are canceled.
+func (r *RPC) Close() error {
+	r.fail(ErrRPCClosed)
+	return r.t.Close()
+}
+
+// Err returns the reason the RPC has stopped, if it has.
+func (r *RPC) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Done returns a channel that is closed once the RPC has stopped.
+func (r *RPC) Done() <-chan struct{} {
+	return r.done
+}
+
+// run reads the incoming frames, and dispatches them.
+func (r *RPC) run() {
+	for {
+		var f pb.CallFrame
+		if _, err := r.t.Receive(&f); err != nil {
+			r.fail(fmt.Errorf("%w: %w", ErrRPCClosed, err))
+			return
+		}
+		switch f.GetType() {
+		case pb.CallType_Request:
+			r.serve(&f)
+		case pb.CallType_Response:
+			r.mu.Lock()
+			ch, ok := r.calls[f.GetID()]
+			delete(r.calls, f.GetID())
+			r.mu.Unlock()
+			// The call may have already given up.
+			if ok {
+				ch <- &f
+			}
+		case pb.CallType_Cancel:
+			r.mu.Lock()
+			rc, ok := r.running[f.GetID()]
+			r.mu.Unlock()
+			// A handler with a timeout of its own is about to see it expire,
+			// so it is left to do so, rather than being told the call was
+			// canceled. The Cancel only stops the ones that have none.
+			expired := ErrorCode(f.GetError().GetCode()) == CodeDeadlineExceeded
+			if ok && !(expired && rc.timeout) {
+				rc.cancel()
+			}
+		}
+	}
+}
+
+// runningCall is a handler that is being run.
+type runningCall struct {
+	cancel  context.CancelFunc
+	timeout bool
+}
+
+// serve runs the handler of the request in a goroutine, and sends back its
+// response.
+func (r *RPC) serve(f *pb.CallFrame) {
+	id := f.GetID()
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	timeout := f.GetTimeout()
+	if timeout != nil {
+		ctx, cancel = context.WithTimeout(r.ctx, timeout.AsDuration())
+	} else {
+		ctx, cancel = context.WithCancel(r.ctx)
+	}
+
+	r.mu.Lock()
+	rt, ok := r.handlers[f.GetPayload().MessageName()]
+	r.running[id] = runningCall{cancel: cancel, timeout: timeout != nil}
+	r.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		out := &pb.CallFrame{ID: id, Type: pb.CallType_Response}
+		payload, err := r.call(ctx, rt, ok, f.GetPayload())
+		if err != nil {
+			out.Error = callError(ctx, err)
+		} else {
+			out.Payload = payload
+		}
+
+		r.mu.Lock()
+		delete(r.running, id)
+		r.mu.Unlock()
+		// A failed write stops the reader as well, which then fails the RPC.
+		_ = r.send(out)
+	}()
+}
+
+func (r *RPC) call(
+	ctx context.Context, rt callRoute, ok bool, req *anypb.Any,
+) (resp *anypb.Any, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = Errorf(CodeInternal, "handler panicked: %v", p)
+		}
+	}()
+
+	if !ok {
+		return nil, Errorf(
+			CodeNotFound, "no handler for %s", req.GetTypeUrl(),
+		)
+	}
+	dst := rt.typ.New().Interface()
+	if err := req.UnmarshalTo(dst); err != nil {
+		return nil, Errorf(
+			CodeInvalidArgument, "unmarshalling request: %v", err,
+		)
+	}
+	msg, err := rt.handler(ctx, dst)
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil {
+		return nil, Errorf(CodeInternal, "handler returned no response")
+	}
+	resp, err = anypb.New(msg)
+	if err != nil {
+		return nil, Errorf(CodeInternal, "packing response: %v", err)
+	}
+
+	return resp, nil
+}
+
+// callError converts an error returned by a handler to its wire form.
+func callError(ctx context.Context, err error) *pb.CallError {
+	code := CodeUnknown
+	var re *RemoteError
+	switch {
+	case errors.As(err, &re):
+		return &pb.CallError{Code: uint32(re.Code), Message: re.Message}
+	case errors.Is(err, context.DeadlineExceeded):
+		code = CodeDeadlineExceeded
+	case errors.Is(err, context.Canceled) && ctx.Err() != nil:
+		code = CodeCanceled
+	}
+
+	return &pb.CallError{Code: uint32(code), Message: err.Error()}
+}
+
+func (r *RPC) send(f *pb.CallFrame) error {
+	if _, err := r.t.Send(f); err != nil {
+		return fmt.Errorf("sending frame: %w", err)
+	}
+	return nil
+}
+
+func (r *RPC) forget(id uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.calls, id)
+}
+
+// fail stops the RPC with err.
+func (r *RPC) fail(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	r.err = err
+	close(r.done)
+	r.cancel()
+}
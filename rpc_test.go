@@ -0,0 +1,260 @@
+package kamune
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/hossein1376/kamune/internal/box/pb"
+)
+
+func newRPCPair(t *testing.T) (client, server *RPC) {
+	t.Helper()
+	c, s := newTransportPair(t)
+	client, server = NewRPC(c), NewRPC(s)
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	return client, server
+}
+
+func TestRPC_Call(t *testing.T) {
+	a := require.New(t)
+	client, server := newRPCPair(t)
+
+	Method(server, func(
+		_ context.Context, req *wrapperspb.StringValue,
+	) (*wrapperspb.StringValue, error) {
+		return wrapperspb.String("hello, " + req.GetValue()), nil
+	})
+	// Calls work the other way around, too.
+	Method(client, func(
+		_ context.Context, req *wrapperspb.Int64Value,
+	) (*wrapperspb.Int64Value, error) {
+		return wrapperspb.Int64(req.GetValue() * 2), nil
+	})
+
+	const count = 32
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*count)
+	for i := range count {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			var resp wrapperspb.StringValue
+			name := fmt.Sprint("caller ", i)
+			err := client.Call(t.Context(), wrapperspb.String(name), &resp)
+			if err == nil && resp.GetValue() != "hello, "+name {
+				err = fmt.Errorf("got %q for %q", resp.GetValue(), name)
+			}
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			var resp wrapperspb.Int64Value
+			err := server.Call(t.Context(), wrapperspb.Int64(int64(i)), &resp)
+			if err == nil && resp.GetValue() != int64(2*i) {
+				err = fmt.Errorf("got %d for %d", resp.GetValue(), i)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		a.NoError(err)
+	}
+}
+
+func TestRPC_Errors(t *testing.T) {
+	a := require.New(t)
+	client, server := newRPCPair(t)
+
+	Method(server, func(
+		_ context.Context, req *wrapperspb.StringValue,
+	) (*emptypb.Empty, error) {
+		switch req.GetValue() {
+		case "invalid":
+			return nil, Errorf(CodeInvalidArgument, "bad name")
+		case "panic":
+			panic("boom")
+		default:
+			return nil, errors.New("plain failure")
+		}
+	})
+
+	call := func(req Transferable) *RemoteError {
+		err := client.Call(t.Context(), req, &emptypb.Empty{})
+		var re *RemoteError
+		a.ErrorAs(err, &re)
+		return re
+	}
+
+	re := call(wrapperspb.String("invalid"))
+	a.Equal(CodeInvalidArgument, re.Code)
+	a.Equal("bad name", re.Message)
+	a.ErrorIs(re, &RemoteError{Code: CodeInvalidArgument})
+
+	re = call(wrapperspb.String("panic"))
+	a.Equal(CodeInternal, re.Code)
+	a.Contains(re.Message, "boom")
+
+	re = call(wrapperspb.String("other"))
+	a.Equal(CodeUnknown, re.Code)
+	a.Equal("plain failure", re.Message)
+
+	re = call(wrapperspb.Bool(true))
+	a.Equal(CodeNotFound, re.Code)
+
+	// The response does not match the type the caller expects.
+	Method(server, func(
+		context.Context, *wrapperspb.UInt32Value,
+	) (*emptypb.Empty, error) {
+		return &emptypb.Empty{}, nil
+	})
+	err := client.Call(
+		t.Context(), wrapperspb.UInt32(1), &wrapperspb.StringValue{},
+	)
+	a.ErrorContains(err, "unmarshalling response")
+}
+
+func TestRPC_Cancel(t *testing.T) {
+	a := require.New(t)
+	client, server := newRPCPair(t)
+
+	started := make(chan struct{}, 1)
+	canceled := make(chan error, 1)
+	Method(server, func(
+		ctx context.Context, _ *durationpb.Duration,
+	) (*emptypb.Empty, error) {
+		started <- struct{}{}
+		<-ctx.Done()
+		canceled <- ctx.Err()
+		return nil, ctx.Err()
+	})
+
+	// Giving up on a call cancels its handler.
+	ctx, cancel := context.WithCancel(t.Context())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- client.Call(ctx, durationpb.New(0), &emptypb.Empty{})
+	}()
+	<-started
+	cancel()
+	a.ErrorIs(<-errCh, context.Canceled)
+	a.ErrorIs(<-canceled, context.Canceled)
+
+	// The deadline of the call is passed along to the handler, which is not
+	// canceled once it passes, so it always sees the deadline exceeded.
+	ctx, cancel = context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+	err := client.Call(ctx, durationpb.New(0), &emptypb.Empty{})
+	a.ErrorIs(err, context.DeadlineExceeded)
+	<-started
+	err = <-canceled
+	a.ErrorIs(err, context.DeadlineExceeded)
+	a.NotErrorIs(err, context.Canceled)
+}
+
+func TestRPC_Timeout(t *testing.T) {
+	a := require.New(t)
+	c, s := newTransportPair(t)
+	server := NewRPC(s)
+	t.Cleanup(func() { _ = server.Close() })
+
+	type seen struct {
+		deadline time.Time
+		ok       bool
+		err      error
+	}
+	started := make(chan struct{}, 2)
+	handled := make(chan seen, 2)
+	Method(server, func(
+		ctx context.Context, _ *emptypb.Empty,
+	) (*emptypb.Empty, error) {
+		started <- struct{}{}
+		<-ctx.Done()
+		d, ok := ctx.Deadline()
+		handled <- seen{deadline: d, ok: ok, err: ctx.Err()}
+		return nil, ctx.Err()
+	})
+	request := func(id uint64, timeout *durationpb.Duration) {
+		payload, err := anypb.New(&emptypb.Empty{})
+		a.NoError(err)
+		_, err = c.Send(&pb.CallFrame{
+			ID: id, Type: pb.CallType_Request, Payload: payload,
+			Timeout: timeout,
+		})
+		a.NoError(err)
+	}
+	expired := &pb.CallError{Code: uint32(CodeDeadlineExceeded)}
+
+	// The deadline is rebuilt from the time left, on the handler's clock.
+	sent := time.Now()
+	request(1, durationpb.New(time.Hour))
+	<-started
+	// The handler has its own deadline, so it is left to expire.
+	_, err := c.Send(&pb.CallFrame{
+		ID: 1, Type: pb.CallType_Cancel, Error: expired,
+	})
+	a.NoError(err)
+
+	// A handler without a deadline is stopped by the Cancel, though.
+	request(2, nil)
+	<-started
+	_, err = c.Send(&pb.CallFrame{
+		ID: 2, Type: pb.CallType_Cancel, Error: expired,
+	})
+	a.NoError(err)
+	got := <-handled
+	a.False(got.ok)
+	a.ErrorIs(got.err, context.Canceled)
+	var resp pb.CallFrame
+	_, err = c.Receive(&resp)
+	a.NoError(err)
+	a.EqualValues(2, resp.GetID())
+
+	_, err = c.Send(&pb.CallFrame{ID: 1, Type: pb.CallType_Cancel})
+	a.NoError(err)
+	got = <-handled
+	a.True(got.ok)
+	a.WithinDuration(sent.Add(time.Hour), got.deadline, time.Minute)
+	a.ErrorIs(got.err, context.Canceled)
+}
+
+func TestRPC_Close(t *testing.T) {
+	a := require.New(t)
+	client, server := newRPCPair(t)
+
+	started := make(chan struct{})
+	Method(server, func(
+		ctx context.Context, _ *emptypb.Empty,
+	) (*emptypb.Empty, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- client.Call(t.Context(), &emptypb.Empty{}, &emptypb.Empty{})
+	}()
+	<-started
+	a.NoError(server.Close())
+	a.ErrorIs(<-errCh, ErrRPCClosed)
+	<-client.Done()
+
+	err := client.Call(t.Context(), &emptypb.Empty{}, &emptypb.Empty{})
+	a.ErrorIs(err, ErrRPCClosed)
+}
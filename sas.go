@@ -0,0 +1,149 @@
+package kamune
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/hossein1376/kamune/internal/enigma"
+)
+
+var ErrNoSAS = errors.New("short authentication string is not available")
+
+var (
+	sasLabel       = []byte("kamune short authentication string")
+	sasCommitLabel = []byte("kamune sas commitment")
+)
+
+const sasSaltSize = 32
+
+// sasCommit returns the commitment to the client's SAS salt.
+func sasCommit(salt []byte) []byte {
+	sum := sha512.Sum512(slices.Concat(sasCommitLabel, salt))
+	return sum[:]
+}
+
+// SASFormat is the form in which a short authentication string is shown.
+type SASFormat uint8
+
+const (
+	// SASDigits shows the string as four groups of five digits.
+	SASDigits SASFormat = iota + 1
+	// SASWords shows the string as six words.
+	SASWords
+	// SASEmoji shows the string as seven emoji.
+	SASEmoji
+)
+
+func (f SASFormat) String() string {
+	switch f {
+	case SASDigits:
+		return "digits"
+	case SASWords:
+		return "words"
+	case SASEmoji:
+		return "emoji"
+	default:
+		return fmt.Sprintf("SASFormat(%d)", uint8(f))
+	}
+}
+
+// SAS returns the short authentication string of the session. It is derived
+// from the handshake transcript, so both parties get the same string, unless
+// someone stands in the middle. Reading it out to each other over another
+// channel, such as a phone call, proves that nobody does. Once confirmed, the
+// remote key can be recorded with TrustStore.MarkVerified.
+//
+// A salt of the client is mixed in as well. The client commits to it in its
+// introduction, and reveals it only after the server has answered, so that
+// someone in the middle can not try transcripts until the strings of both
+// sessions match. It returns ErrNoSAS if the remote client did not commit to
+// a salt.
+func (t *Transport) SAS(format SASFormat) (string, error) {
+	if len(t.sasSalt) == 0 {
+		return "", ErrNoSAS
+	}
+	sum, err := enigma.Combine(t.sasSalt, sasLabel, t.handshakeHash)
+	if err != nil {
+		return "", fmt.Errorf("deriving SAS: %w", err)
+	}
+
+	var parts []string
+	switch format {
+	case SASDigits:
+		for i := range 4 {
+			n := binary.BigEndian.Uint32(sum[i*4:]) % 100000
+			parts = append(parts, fmt.Sprintf("%05d", n))
+		}
+	case SASWords:
+		for _, b := range sum[:6] {
+			parts = append(parts, sasWords[b])
+		}
+	case SASEmoji:
+		// 7 emoji of 6 bits each, taken from the first 42 bits.
+		bits := binary.BigEndian.Uint64(sum)
+		for i := range 7 {
+			parts = append(parts, sasEmoji[bits>>(58-6*i)&0x3f])
+		}
+	default:
+		return "", fmt.Errorf("unknown SAS format: %s", format)
+	}
+
+	return strings.Join(parts, " "), nil
+}
+
+// sasWords holds 256 short and distinct words, one for each byte.
+var sasWords = [256]string{
+	"acid", "acorn", "actor", "adobe", "agent", "alarm", "album", "alley",
+	"amber", "anchor", "angel", "ankle", "apple", "apron", "arena", "armor",
+	"arrow", "atlas", "attic", "audio", "autumn", "avocado", "badge",
+	"bagel", "baker", "bamboo", "banjo", "barn", "basil", "basket", "beach",
+	"beacon", "beetle", "bell", "bench", "berry", "bicycle", "bison",
+	"blanket", "blossom", "bonfire", "bottle", "boulder", "bracelet",
+	"bramble", "bread", "breeze", "brick", "bridge", "brook", "bubble",
+	"bucket", "buffalo", "bugle", "butter", "button", "cabin", "cactus",
+	"camel", "camera", "candle", "canoe", "canyon", "carpet", "carrot",
+	"castle", "cedar", "cellar", "cereal", "chalk", "cherry", "chess",
+	"chimney", "cider", "cinema", "circus", "citrus", "clover", "cobra",
+	"coconut", "comet", "compass", "copper", "coral", "cotton", "cougar",
+	"coyote", "crane", "crayon", "cricket", "crystal", "cupboard", "curtain",
+	"daisy", "dancer", "desert", "diamond", "dolphin", "donkey", "dragon",
+	"drum", "eagle", "easel", "eclipse", "elbow", "engine", "falcon",
+	"feather", "fern", "ferry", "fiddle", "fig", "flannel", "flute",
+	"forest", "fossil", "fountain", "fox", "galaxy", "garden", "garlic",
+	"gecko", "geyser", "ginger", "giraffe", "glacier", "globe", "goblet",
+	"gondola", "gorilla", "granite", "grape", "gravel", "guitar", "hammer",
+	"harbor", "harp", "hazel", "hedge", "helmet", "heron", "hickory",
+	"honey", "hornet", "husky", "igloo", "iguana", "island", "ivory",
+	"jacket", "jaguar", "jasmine", "jelly", "jigsaw", "jungle", "kayak",
+	"kettle", "kiwi", "koala", "ladder", "lagoon", "lantern", "lemon",
+	"lentil", "lettuce", "lilac", "lily", "lizard", "llama", "lobster",
+	"locket", "lotus", "magnet", "mango", "maple", "marble", "meadow",
+	"melon", "meteor", "mitten", "monkey", "moose", "mosaic", "muffin",
+	"mustard", "napkin", "nectar", "needle", "nickel", "noodle", "nutmeg",
+	"oasis", "ocean", "olive", "onion", "orbit", "orchid", "otter", "owl",
+	"oyster", "paddle", "palace", "panda", "panther", "papaya", "parrot",
+	"peach", "peanut", "pebble", "pelican", "pencil", "pepper", "piano",
+	"pigeon", "pillow", "pine", "pirate", "planet", "plum", "pocket", "pony",
+	"poppy", "potato", "pretzel", "prism", "pumpkin", "puzzle", "quail",
+	"quartz", "quill", "rabbit", "radish", "raft", "rainbow", "raven",
+	"ribbon", "river", "robin", "rocket", "saddle", "salmon", "sandal",
+	"satchel", "scarf", "sequoia", "shovel", "silver", "skate", "sparrow",
+	"spider", "spruce", "squid", "stable", "starfish", "statue", "sunflower",
+}
+
+// sasEmoji holds 64 emoji that are easy to tell apart and to name, the same
+// as the ones used by Matrix's SAS verification.
+var sasEmoji = [64]string{
+	"🐶", "🐱", "🦁", "🐎", "🦄", "🐷", "🐘", "🐰",
+	"🐼", "🐓", "🐧", "🐢", "🐟", "🐙", "🦋", "🌷",
+	"🌳", "🌵", "🍄", "🌏", "🌙", "☁️", "🔥", "🍌",
+	"🍎", "🍓", "🌽", "🍕", "🎂", "❤️", "😀", "🤖",
+	"🎩", "👓", "🔧", "🎅", "👍", "☂️", "⌛", "⏰",
+	"🎁", "💡", "📕", "✏️", "📎", "✂️", "🔒", "🔑",
+	"🔨", "☎️", "🏁", "🚂", "🚲", "✈️", "🚀", "🏆",
+	"⚽", "🎸", "🎺", "🔔", "⚓", "🎧", "📁", "📌",
+}
@@ -0,0 +1,110 @@
+package kamune
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransport_SAS(t *testing.T) {
+	a := require.New(t)
+	client, server := newTransportPair(t)
+	other, _ := newTransportPair(t)
+
+	for _, format := range []SASFormat{SASDigits, SASWords, SASEmoji} {
+		c, err := client.SAS(format)
+		a.NoError(err)
+		s, err := server.SAS(format)
+		a.NoError(err)
+		a.Equal(c, s, format.String())
+		o, err := other.SAS(format)
+		a.NoError(err)
+		a.NotEqual(c, o, format.String())
+	}
+
+	digits, err := client.SAS(SASDigits)
+	a.NoError(err)
+	a.Regexp(regexp.MustCompile(`^\d{5} \d{5} \d{5} \d{5}$`), digits)
+	words, err := client.SAS(SASWords)
+	a.NoError(err)
+	a.Len(strings.Fields(words), 6)
+	emoji, err := client.SAS(SASEmoji)
+	a.NoError(err)
+	a.Len(strings.Fields(emoji), 7)
+
+	_, err = client.SAS(SASFormat(0))
+	a.Error(err)
+}
+
+func TestTransport_SASCommitment(t *testing.T) {
+	a := require.New(t)
+	salt := randomBytes(sasSaltSize)
+
+	// A client that reveals another salt than it committed to is refused.
+	_, _, err := handshakePair(t, randomBytes(sasSaltSize), sasCommit(salt))
+	a.ErrorIs(err, ErrVerificationFailed)
+	_, _, err = handshakePair(t, nil, sasCommit(salt))
+	a.ErrorIs(err, ErrVerificationFailed)
+
+	// Without a commitment, the server has no string to show.
+	client, server, err := handshakePair(t, salt, nil)
+	a.NoError(err)
+	_, err = client.SAS(SASDigits)
+	a.NoError(err)
+	_, err = server.SAS(SASDigits)
+	a.ErrorIs(err, ErrNoSAS)
+}
+
+func TestTransport_SASRelay(t *testing.T) {
+	a := require.New(t)
+	// Someone in the middle runs a session of its own with each party, so
+	// the transcripts of the two differ.
+	client, relayServer := newTransportPair(t)
+	relayClient, server := newTransportPair(t)
+
+	sas := func(t *Transport) string {
+		s, err := t.SAS(SASDigits)
+		a.NoError(err)
+		return s
+	}
+	a.Equal(sas(client), sas(relayServer))
+	a.Equal(sas(relayClient), sas(server))
+	a.NotEqual(sas(client), sas(server))
+
+	// Once the relay has answered the client, the transcript is settled, but
+	// the string is not known until the client reveals its salt. Trying other
+	// salts for the same transcript, as the relay would to steer the string
+	// towards that of the other session, gives strings of its own.
+	seen := map[string]struct{}{sas(client): {}}
+	for range 16 {
+		guess := &Transport{
+			plainTransport: &plainTransport{
+				sasSalt: randomBytes(sasSaltSize),
+			},
+			handshakeHash: client.handshakeHash,
+		}
+		s := sas(guess)
+		a.NotContains(seen, s)
+		seen[s] = struct{}{}
+	}
+}
+
+func TestSASLists(t *testing.T) {
+	a := require.New(t)
+	words := make(map[string]struct{}, len(sasWords))
+	for _, w := range sasWords {
+		a.NotEmpty(w)
+		a.NotContains(w, " ")
+		words[w] = struct{}{}
+	}
+	a.Len(words, len(sasWords))
+
+	emoji := make(map[string]struct{}, len(sasEmoji))
+	for _, e := range sasEmoji {
+		a.NotEmpty(e)
+		emoji[e] = struct{}{}
+	}
+	a.Len(emoji, len(sasEmoji))
+}
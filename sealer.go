@@ -0,0 +1,130 @@
+package kamune
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/hossein1376/kamune/internal/box/pb"
+	"github.com/hossein1376/kamune/internal/enigma"
+	"github.com/hossein1376/kamune/internal/exchange"
+	"github.com/hossein1376/kamune/internal/ratchet"
+)
+
+// sealer encrypts or decrypts the records of a Transport. seq is the
+// sequence number of the record.
+type sealer interface {
+	seal(plaintext []byte, seq uint64) ([]byte, error)
+	open(ciphertext []byte, seq uint64) ([]byte, error)
+	// rekey moves to the next key, when a rekey record is sent or received.
+	rekey() error
+}
+
+// enigmaSealer uses a single key per direction, until it is rekeyed.
+type enigmaSealer struct {
+	e *enigma.Enigma
+}
+
+func (s enigmaSealer) seal(plaintext []byte, seq uint64) ([]byte, error) {
+	return s.e.Encrypt(plaintext, seq), nil
+}
+
+func (s enigmaSealer) open(ciphertext []byte, seq uint64) ([]byte, error) {
+	return s.e.Decrypt(ciphertext, seq)
+}
+
+func (s enigmaSealer) rekey() error {
+	return s.e.Ratchet()
+}
+
+// ratchetSealer uses the double ratchet. The same ratchet serves both
+// directions.
+type ratchetSealer struct {
+	r *ratchet.Ratchet
+}
+
+func (s ratchetSealer) seal(plaintext []byte, seq uint64) ([]byte, error) {
+	h, ct, err := s.r.Encrypt(plaintext, seqBytes(seq))
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(&pb.RatchetRecord{
+		DH: h.DH, PN: h.PN, N: h.N, Ciphertext: ct,
+	})
+}
+
+func (s ratchetSealer) open(ciphertext []byte, seq uint64) ([]byte, error) {
+	var rec pb.RatchetRecord
+	if err := proto.Unmarshal(ciphertext, &rec); err != nil {
+		return nil, fmt.Errorf("unmarshalling ratchet record: %w", err)
+	}
+	h := ratchet.Header{DH: rec.GetDH(), PN: rec.GetPN(), N: rec.GetN()}
+	return s.r.Decrypt(h, rec.GetCiphertext(), seqBytes(seq))
+}
+
+// rekey does nothing, as every record already has a key of its own.
+func (s ratchetSealer) rekey() error {
+	return nil
+}
+
+func seqBytes(seq uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, seq)
+}
+
+// clientSealers creates the sealers of the client, once the session secret is
+// known. remoteECDH is the server's X25519 public key, which the double
+// ratchet starts from.
+func clientSealers(
+	pt *plainTransport, secret, nonce, remoteNonce, remoteECDH []byte,
+) (encoder, decoder sealer, err error) {
+	cipher := suites[pt.negotiation.suite].cipher
+	if pt.negotiation.features&featureDoubleRatchet != 0 {
+		r, err := ratchet.NewInitiator(
+			cipher, secret, remoteECDH, ratchet.DefaultMaxSkip,
+		)
+		if err != nil {
+			return nil, nil, fmt.Errorf("creating ratchet: %w", err)
+		}
+		return ratchetSealer{r}, ratchetSealer{r}, nil
+	}
+
+	enc, err := enigma.NewEnigmaWith(cipher, secret, nonce, enigma.C2S)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating encrypter: %w", err)
+	}
+	dec, err := enigma.NewEnigmaWith(cipher, secret, remoteNonce, enigma.S2C)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating decrypter: %w", err)
+	}
+
+	return enigmaSealer{enc}, enigmaSealer{dec}, nil
+}
+
+// serverSealers creates the sealers of the server. ec is the server's X25519
+// key, which the double ratchet starts from.
+func serverSealers(
+	pt *plainTransport, secret, nonce, remoteNonce []byte, ec *exchange.ECDH,
+) (encoder, decoder sealer, err error) {
+	cipher := suites[pt.negotiation.suite].cipher
+	if pt.negotiation.features&featureDoubleRatchet != 0 {
+		r, err := ratchet.NewResponder(
+			cipher, secret, ec, ratchet.DefaultMaxSkip,
+		)
+		if err != nil {
+			return nil, nil, fmt.Errorf("creating ratchet: %w", err)
+		}
+		return ratchetSealer{r}, ratchetSealer{r}, nil
+	}
+
+	enc, err := enigma.NewEnigmaWith(cipher, secret, nonce, enigma.S2C)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating encrypter: %w", err)
+	}
+	dec, err := enigma.NewEnigmaWith(cipher, secret, remoteNonce, enigma.C2S)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating decrypter: %w", err)
+	}
+
+	return enigmaSealer{enc}, enigmaSealer{dec}, nil
+}
@@ -0,0 +1,57 @@
+package kamune
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func echo(t *Transport) error {
+	for {
+		b := Bytes(nil)
+		if _, err := t.Receive(b); err != nil {
+			return err
+		}
+		if _, err := t.Send(b); err != nil {
+			return err
+		}
+	}
+}
+
+func TestTransport_DoubleRatchet(t *testing.T) {
+	tests := []struct {
+		name   string
+		client []DialOption
+		server []ServerOption
+		want   bool
+	}{
+		{
+			name:   "both",
+			client: []DialOption{WithDoubleRatchet()},
+			server: []ServerOption{WithDoubleRatchet()},
+			want:   true,
+		},
+		{name: "client only", client: []DialOption{WithDoubleRatchet()}},
+		{name: "server only", server: []ServerOption{WithDoubleRatchet()}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			a := require.New(t)
+			_, addr, _ := startServer(t, echo, tc.server...)
+			client := dialServer(t, addr, tc.client...)
+			a.Equal(tc.want, client.DoubleRatchet())
+
+			for i, size := range []int{0, 10, 3 * maxFragmentSize, 100} {
+				msg := bytes.Repeat([]byte(fmt.Sprint(i)), size)
+				_, err := client.Send(Bytes(msg))
+				a.NoError(err)
+				b := Bytes(nil)
+				_, err = client.Receive(b)
+				a.NoError(err)
+				a.Equal(string(msg), string(b.GetValue()))
+			}
+		})
+	}
+}
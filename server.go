@@ -1,24 +1,58 @@
 package kamune
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
 	"net"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/hossein1376/kamune/internal/attest"
+	"github.com/hossein1376/kamune/internal/box/pb"
+	"github.com/hossein1376/kamune/internal/enigma"
+	"github.com/hossein1376/kamune/internal/exchange"
 )
 
+// ErrServerClosed is returned by Serve and ListenAndServe once Shutdown or
+// Close have been called.
+var ErrServerClosed = errors.New("server closed")
+
 type HandlerFunc func(t *Transport) error
 
 type Server struct {
 	Addr           string
 	HandlerFunc    HandlerFunc
 	RemoteVerifier RemoteVerifier
-	attest         *attest.Attest
+	// PeerVerifier takes precedence over RemoteVerifier, if set. If neither
+	// is set, the user is asked, as described in WithPeerVerifier.
+	PeerVerifier     PeerVerifier
+	defaultVerifier  PeerVerifier
+	attest           *attest.Attest
+	logger           *slog.Logger
+	network          string
+	handshakeTimeout time.Duration
+	suites           []CipherSuite
+	rekey            RekeyPolicy
+	features         uint32
+	tickets          *ticketKeys
+	migrationWindow  time.Duration
+
+	mu         sync.Mutex
+	inShutdown bool
+	listeners  map[*net.Listener]struct{}
+	conns      map[net.Conn]struct{}
+	sessions   map[string]*Transport
+	active     sync.WaitGroup
+	ctx        context.Context
+	cancel     context.CancelFunc
 }
 
-func ListenAndServe(addr string, h HandlerFunc) error {
-	s, err := NewServer(addr, h)
+func ListenAndServe(addr string, h HandlerFunc, opts ...ServerOption) error {
+	s, err := NewServer(addr, h, opts...)
 	if err != nil {
 		return fmt.Errorf("creating new server: %w", err)
 	}
@@ -26,21 +60,60 @@ func ListenAndServe(addr string, h HandlerFunc) error {
 }
 
 func (s *Server) ListenAndServe() error {
-	l, err := net.Listen("tcp", s.Addr)
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+	network := s.network
+	if network == "" {
+		network = "tcp"
+	}
+	l, err := net.Listen(network, s.Addr)
 	if err != nil {
 		return fmt.Errorf("listening on %s: %w", s.Addr, err)
 	}
 	return s.Serve(l)
 }
 
+// Serve accepts incoming connections on l, and serves each one of them in a
+// new goroutine. It always returns a non-nil error, and takes ownership of l,
+// closing it on return. After Shutdown or Close, the returned error is
+// ErrServerClosed.
 func (s *Server) Serve(l net.Listener) error {
+	if !s.trackListener(&l, true) {
+		_ = l.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(&l, false)
+	defer l.Close()
+
+	var delay time.Duration
 	for {
 		conn, err := l.Accept()
 		if err != nil {
-			s.log(slog.LevelError, "accept conn", slog.Any("err", err))
-			continue
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+				s.log(
+					slog.LevelError,
+					"accept conn",
+					slog.Any("err", err),
+					slog.Duration("retry_in", delay),
+				)
+				time.Sleep(delay)
+				continue
+			}
+			return fmt.Errorf("accept conn: %w", err)
+		}
+		delay = 0
+		if !s.trackConn(conn, true) {
+			_ = conn.Close()
+			return ErrServerClosed
 		}
 		go func() {
+			defer s.trackConn(conn, false)
 			if err := s.serve(conn); err != nil {
 				s.log(slog.LevelWarn, "serve conn", slog.Any("err", err))
 				return
@@ -49,34 +122,86 @@ func (s *Server) Serve(l net.Listener) error {
 	}
 }
 
+// Shutdown gracefully shuts down the server. It closes all listeners, so no
+// new connections are accepted, and cancels the context of every Transport
+// that is being served. Then, it waits for the handlers to return. If ctx is
+// done first, the remaining connections are forcibly closed and ctx's error is
+// returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.stop()
+
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		s.closeConns()
+		return ctx.Err()
+	}
+}
+
+// Close immediately closes all listeners and connections. For a graceful
+// shutdown, use Shutdown.
+func (s *Server) Close() error {
+	err := s.stop()
+	s.closeConns()
+	return err
+}
+
 func (s *Server) serve(c net.Conn) error {
-	conn := Conn{Conn: c}
+	conn := &Conn{Conn: c}
+	var detached bool
 	defer func() {
 		if err := recover(); err != nil {
 			s.log(slog.LevelError, "serve panic", slog.Any("err", err))
 		}
-		if !conn.isClosed {
-			if err := conn.Close(); err != nil {
+		if !detached {
+			err := conn.Close()
+			if err != nil &&
+				!errors.Is(err, ErrAlreadyClosed) &&
+				!errors.Is(err, net.ErrClosed) {
 				s.log(slog.LevelError, "close conn", slog.Any("err", err))
 			}
 		}
 	}()
+	if s.handshakeTimeout > 0 {
+		deadline := time.Now().Add(s.handshakeTimeout)
+		if err := conn.SetDeadline(deadline); err != nil {
+			return fmt.Errorf("setting deadline: %w", err)
+		}
+	}
 
-	remote, err := receiveIntroduction(conn)
+	t, err := s.accept(conn)
+	if errors.Is(err, errReattached) {
+		// The connection is now owned by the session it was reattached to.
+		detached = true
+		return nil
+	}
 	if err != nil {
-		return fmt.Errorf("receive introduction: %w", err)
+		return err
 	}
-	if err := s.RemoteVerifier(remote); err != nil {
-		return fmt.Errorf("verify remote: %w", err)
+	defer t.cancel()
+	if t.ctx.Err() != nil {
+		return ErrServerClosed
 	}
-	if err := sendIntroduction(conn, s.attest); err != nil {
-		return fmt.Errorf("send introduction: %w", err)
+	if s.handshakeTimeout > 0 {
+		if err := conn.SetDeadline(time.Time{}); err != nil {
+			return fmt.Errorf("clearing deadline: %w", err)
+		}
 	}
-
-	pt := &plainTransport{conn: conn, remote: remote, attest: s.attest}
-	t, err := acceptHandshake(pt)
-	if err != nil {
-		return fmt.Errorf("accept handshake: %w", err)
+	if m := t.migration; m != nil {
+		if s.migrationWindow > 0 {
+			m.window = s.migrationWindow
+		}
+		s.trackSession(t, true)
+		defer s.trackSession(t, false)
+		// The connection may have been replaced in the meantime, so the
+		// Transport closes whichever is current.
+		defer t.Close()
 	}
 	err = s.HandlerFunc(t)
 	if err != nil {
@@ -86,19 +211,312 @@ func (s *Server) serve(c net.Conn) error {
 	return nil
 }
 
+// accept performs the introduction, and either the handshake or the
+// resumption of a previous session.
+func (s *Server) accept(conn *Conn) (*Transport, error) {
+	tr := newTranscript()
+	intro, err := receiveIntroduction(conn, tr)
+	if err != nil {
+		return nil, fmt.Errorf("receive introduction: %w", err)
+	}
+	if intro.reattach != nil {
+		return nil, s.reattach(conn, intro.reattach)
+	}
+	suites := s.suites
+	if suites == nil {
+		suites = defaultSuites
+	}
+	n, err := negotiate(suites, intro, false)
+	if err != nil {
+		return nil, fmt.Errorf("negotiate: %w", err)
+	}
+	features := s.features
+	if s.tickets != nil {
+		features |= featureResumption
+	}
+	n.features = features & intro.features
+
+	local := newIntroduce(s.attest, suites, features)
+	resumption := s.tickets.resumable(intro, n)
+	// Resumed sessions are verified as well, so that a peer that is no
+	// longer trusted can not carry on with an old ticket. The ticket is bound
+	// to the identity that it was issued to.
+	peer := newPeer(intro.remote, conn.Conn, Inbound)
+	if err := s.verify(peer); err != nil {
+		return nil, fmt.Errorf("verify remote: %w", err)
+	}
+	var ec *exchange.ECDH
+	if resumption != nil {
+		if ec, err = exchange.NewECDH(); err != nil {
+			return nil, fmt.Errorf("creating ECDH keys: %w", err)
+		}
+		local.Resumed = true
+		local.Nonce = randomBytes(enigma.BaseNonceSize)
+		local.ECDH = ec.MarshalPublicKey()
+	}
+	if err = sendIntroduction(conn, local, tr); err != nil {
+		return nil, fmt.Errorf("send introduction: %w", err)
+	}
+
+	pt := &plainTransport{
+		ctx:         peer.context(s.baseContext()),
+		conn:        conn,
+		remote:      intro.remote,
+		attest:      s.attest,
+		negotiation: n,
+		transcript:  tr,
+		rekey:       s.rekey,
+
+		sasCommitment: intro.sasCommitment,
+	}
+	var t *Transport
+	if resumption != nil {
+		t, err = resumeServer(pt, resumption, ec, local.Nonce, intro)
+		if err != nil {
+			return nil, fmt.Errorf("resume: %w", err)
+		}
+	} else {
+		t, err = acceptHandshake(pt)
+		if err != nil {
+			return nil, fmt.Errorf("accept handshake: %w", err)
+		}
+	}
+	if err := peer.establish(); err != nil {
+		t.cancel()
+		return nil, fmt.Errorf("verify remote: %w", err)
+	}
+	if n.features&featureResumption != 0 {
+		if err := s.tickets.issueTicket(t); err != nil {
+			t.cancel()
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+func (s *Server) verify(p *Peer) error {
+	switch {
+	case s.PeerVerifier != nil:
+		return s.PeerVerifier(p)
+	case s.RemoteVerifier != nil:
+		return s.RemoteVerifier(p.PublicKey())
+	case s.defaultVerifier != nil:
+		return s.defaultVerifier(p)
+	default:
+		return errors.New("remote verifier is nil")
+	}
+}
+
+// reattach moves the session that the client asks for to conn. It returns
+// errReattached on success.
+func (s *Server) reattach(conn *Conn, req *pb.Reattach) error {
+	s.mu.Lock()
+	t, ok := s.sessions[req.GetSessionID()]
+	s.mu.Unlock()
+	err := ErrMigrationRefused
+	if ok {
+		err = t.adopt(conn, req)
+	}
+	if err != nil {
+		if refuseErr := refuseReattach(conn); refuseErr != nil {
+			err = errors.Join(err, refuseErr)
+		}
+		return fmt.Errorf("reattach: %w", err)
+	}
+
+	return errReattached
+}
+
+// Handshake performs the introduction and handshake as the server, over an
+// already established connection, and gives up once ctx is done. It lets the
+// Server be used by code that manages connections on its own; HandlerFunc is
+// not called. Sessions established this way cannot be reattached, and conn is
+// not closed if the handshake fails.
+func (s *Server) Handshake(
+	ctx context.Context, c net.Conn,
+) (*Transport, error) {
+	conn := &Conn{Conn: c}
+	if s.handshakeTimeout > 0 {
+		deadline := time.Now().Add(s.handshakeTimeout)
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, fmt.Errorf("setting deadline: %w", err)
+		}
+	}
+	stop := watchContext(ctx, conn.SetDeadline)
+	t, err := s.accept(conn)
+	if stop() {
+		if t != nil {
+			t.cancel()
+		}
+		return nil, fmt.Errorf("handshake: %w", ctx.Err())
+	}
+	switch {
+	case errors.Is(err, errReattached):
+		return nil, fmt.Errorf("handshake: %w", ErrMigrationRefused)
+	case err != nil:
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		t.cancel()
+		return nil, fmt.Errorf("clearing deadline: %w", err)
+	}
+
+	return t, nil
+}
+
+// RotateTicketKeys replaces the key that encrypts resumption tickets. Tickets
+// that were issued before the previous rotation are no longer accepted. Keys
+// are rotated automatically as well, once they are as old as the ticket
+// lifetime.
+func (s *Server) RotateTicketKeys() {
+	if s.tickets != nil {
+		s.tickets.rotate()
+	}
+}
+
+// stop marks the server as shutting down, closes the listeners and cancels
+// the context of the Transports.
+func (s *Server) stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inShutdown = true
+	s.initLocked()
+	s.cancel()
+
+	var errs []error
+	for l := range s.listeners {
+		if err := (*l).Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+		delete(s.listeners, l)
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	for c := range s.conns {
+		_ = c.Close()
+	}
+	sessions := slices.Collect(maps.Values(s.sessions))
+	s.mu.Unlock()
+
+	for _, t := range sessions {
+		_ = t.Close()
+	}
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inShutdown
+}
+
+func (s *Server) trackListener(l *net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.initLocked()
+	if !add {
+		delete(s.listeners, l)
+		return true
+	}
+	if s.inShutdown {
+		return false
+	}
+	s.listeners[l] = struct{}{}
+
+	return true
+}
+
+func (s *Server) trackConn(c net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.initLocked()
+	if !add {
+		delete(s.conns, c)
+		s.active.Done()
+		return true
+	}
+	if s.inShutdown {
+		return false
+	}
+	s.conns[c] = struct{}{}
+	s.active.Add(1)
+
+	return true
+}
+
+// trackSession makes the session available to be reattached, as long as its
+// handler is running.
+func (s *Server) trackSession(t *Transport, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.initLocked()
+	if add {
+		s.sessions[t.sessionID] = t
+	} else {
+		delete(s.sessions, t.sessionID)
+	}
+}
+
+func (s *Server) baseContext() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.initLocked()
+	return s.ctx
+}
+
+// initLocked lazily initializes the server's internal state, so that Servers
+// created without NewServer are usable as well. s.mu must be held.
+func (s *Server) initLocked() {
+	if s.ctx != nil {
+		return
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.listeners = make(map[*net.Listener]struct{})
+	s.conns = make(map[net.Conn]struct{})
+	s.sessions = make(map[string]*Transport)
+}
+
 func (s *Server) log(lvl slog.Level, msg string, args ...any) {
-	slog.Log(nil, lvl, msg, args...)
+	logger := s.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger.Log(context.Background(), lvl, msg, args...)
 }
 
-func NewServer(addr string, handler HandlerFunc) (*Server, error) {
-	at, err := attest.LoadFromDisk(privKeyPath)
+func NewServer(
+	addr string, handler HandlerFunc, opts ...ServerOption,
+) (*Server, error) {
+	o, err := serverOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	at, err := o.identity()
 	if err != nil {
 		return nil, err
 	}
+	var tickets *ticketKeys
+	if o.ticketLifetime > 0 {
+		tickets = newTicketKeys(o.ticketLifetime)
+	}
 	return &Server{
-		attest:         at,
-		Addr:           addr,
-		HandlerFunc:    handler,
-		RemoteVerifier: defaultRemoteVerifier,
+		attest:           at,
+		Addr:             addr,
+		HandlerFunc:      handler,
+		RemoteVerifier:   o.remoteVerifier,
+		PeerVerifier:     o.peerVerifier,
+		defaultVerifier:  o.defaultVerifier,
+		logger:           o.logger,
+		network:          o.network,
+		handshakeTimeout: o.handshakeTimeout,
+		suites:           o.suites,
+		rekey:            o.rekey,
+		features:         o.features,
+		tickets:          tickets,
+		migrationWindow:  o.migrationWindow,
 	}, nil
 }
@@ -0,0 +1,162 @@
+package kamune
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/hossein1376/kamune/internal/attest"
+)
+
+func acceptAll(*attest.PublicKey) error { return nil }
+
+func startServer(
+	t *testing.T, h HandlerFunc, opts ...ServerOption,
+) (srv *Server, addr string, served <-chan error) {
+	t.Helper()
+	a := require.New(t)
+
+	opts = append(
+		[]ServerOption{
+			WithKeyStore(NewMemoryKeyStore()),
+			WithRemoteVerifier(acceptAll),
+		},
+		opts...,
+	)
+	srv, err := NewServer("", h, opts...)
+	a.NoError(err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	a.NoError(err)
+
+	ch := make(chan error, 1)
+	go func() { ch <- srv.Serve(l) }()
+	t.Cleanup(func() { _ = srv.Close() })
+
+	return srv, l.Addr().String(), ch
+}
+
+func dialServer(t *testing.T, addr string, opts ...DialOption) *Transport {
+	t.Helper()
+	opts = append(
+		[]DialOption{
+			WithKeyStore(NewMemoryKeyStore()),
+			WithRemoteVerifier(acceptAll),
+		},
+		opts...,
+	)
+	tr, err := Dial(addr, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = tr.Close() })
+
+	return tr
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	a := require.New(t)
+	started := make(chan struct{})
+	handled := make(chan error, 1)
+	srv, addr, served := startServer(t, func(t *Transport) error {
+		close(started)
+		<-t.Context().Done()
+		_, err := t.Send(Bytes([]byte("goodbye")))
+		handled <- err
+		return err
+	})
+
+	client := dialServer(t, addr)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- srv.Shutdown(ctx) }()
+
+	b := Bytes(nil)
+	_, err := client.Receive(b)
+	a.NoError(err)
+	a.Equal("goodbye", string(b.GetValue()))
+	a.NoError(<-handled)
+	a.NoError(<-shutdownErr)
+	a.ErrorIs(<-served, ErrServerClosed)
+
+	_, err = Dial(
+		addr,
+		WithKeyStore(NewMemoryKeyStore()),
+		WithRemoteVerifier(acceptAll),
+	)
+	a.Error(err)
+	a.ErrorIs(srv.ListenAndServe(), ErrServerClosed)
+}
+
+func TestServer_ShutdownDeadline(t *testing.T) {
+	a := require.New(t)
+	started := make(chan struct{})
+	handled := make(chan error, 1)
+	srv, addr, served := startServer(t, func(t *Transport) error {
+		close(started)
+		// Ignores the context, and waits for a message that never comes.
+		_, err := t.Receive(Bytes(nil))
+		handled <- err
+		return err
+	})
+
+	dialServer(t, addr)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	a.ErrorIs(srv.Shutdown(ctx), context.DeadlineExceeded)
+	a.Error(<-handled)
+	a.ErrorIs(<-served, ErrServerClosed)
+}
+
+func TestServer_Close(t *testing.T) {
+	a := require.New(t)
+	started := make(chan struct{})
+	srv, addr, served := startServer(t, func(t *Transport) error {
+		close(started)
+		_, err := t.Receive(Bytes(nil))
+		return err
+	})
+
+	client := dialServer(t, addr)
+	<-started
+
+	a.NoError(srv.Close())
+	a.ErrorIs(<-served, ErrServerClosed)
+	_, err := client.Receive(Bytes(nil))
+	a.Error(err)
+}
+
+func TestServer_RemoteVerifierField(t *testing.T) {
+	a := require.New(t)
+	srv, err := NewServer(
+		"", echo,
+		WithKeyStore(NewMemoryKeyStore()),
+		WithTrustStore(NewMemoryTrustStore()),
+	)
+	a.NoError(err)
+	// Without a terminal, the default verifier would refuse the client.
+	var verified *attest.PublicKey
+	srv.RemoteVerifier = func(key *attest.PublicKey) error {
+		verified = key
+		return nil
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	a.NoError(err)
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(func() { _ = srv.Close() })
+
+	clientID, err := attest.New()
+	a.NoError(err)
+	client := dialServer(t, l.Addr().String(), WithIdentity(clientID))
+	_, err = client.Send(Bytes([]byte("ping")))
+	a.NoError(err)
+	b := Bytes(nil)
+	_, err = client.Receive(b)
+	a.NoError(err)
+	a.True(verified.Equal(clientID.PublicKey()))
+}
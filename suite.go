@@ -0,0 +1,178 @@
+package kamune
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/hossein1376/kamune/internal/enigma"
+)
+
+const (
+	// ProtocolVersion is the latest version of the protocol that is spoken.
+	ProtocolVersion uint32 = 1
+	// minProtocolVersion is the oldest version that is still accepted.
+	minProtocolVersion uint32 = 1
+)
+
+var (
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	ErrNoCommonSuite      = errors.New("no common cipher suite")
+	ErrDowngrade          = errors.New("negotiation has been tampered with")
+)
+
+// CipherSuite identifies the set of algorithms that protect a session: the
+// signature scheme, the key exchange, the key derivation function and the
+// AEAD.
+type CipherSuite uint16
+
+const (
+	Ed25519_X25519MLKEM768_HKDFSHA512_ChaCha20Poly1305 CipherSuite = 0x0001
+	Ed25519_X25519MLKEM768_HKDFSHA512_AES256GCM        CipherSuite = 0x0002
+)
+
+type suiteInfo struct {
+	name      string
+	signature string
+	kem       string
+	kdf       string
+	aead      string
+	cipher    enigma.Cipher
+}
+
+var suites = map[CipherSuite]suiteInfo{
+	Ed25519_X25519MLKEM768_HKDFSHA512_ChaCha20Poly1305: {
+		name:      "Ed25519_X25519-ML-KEM-768_HKDF-SHA512_ChaCha20-Poly1305",
+		signature: "Ed25519",
+		kem:       "X25519-ML-KEM-768",
+		kdf:       "HKDF-SHA512",
+		aead:      "ChaCha20-Poly1305",
+		cipher:    enigma.ChaCha20Poly1305,
+	},
+	Ed25519_X25519MLKEM768_HKDFSHA512_AES256GCM: {
+		name:      "Ed25519_X25519-ML-KEM-768_HKDF-SHA512_AES-256-GCM",
+		signature: "Ed25519",
+		kem:       "X25519-ML-KEM-768",
+		kdf:       "HKDF-SHA512",
+		aead:      "AES-256-GCM",
+		cipher:    enigma.AES256GCM,
+	},
+}
+
+// defaultSuites are the supported suites, in the order of preference.
+var defaultSuites = []CipherSuite{
+	Ed25519_X25519MLKEM768_HKDFSHA512_ChaCha20Poly1305,
+	Ed25519_X25519MLKEM768_HKDFSHA512_AES256GCM,
+}
+
+// CipherSuites returns all supported cipher suites, in the default order of
+// preference.
+func CipherSuites() []CipherSuite {
+	return slices.Clone(defaultSuites)
+}
+
+func (c CipherSuite) String() string {
+	if info, ok := suites[c]; ok {
+		return info.name
+	}
+	return fmt.Sprintf("CipherSuite(0x%04x)", uint16(c))
+}
+
+// Signature returns the name of the signature scheme.
+func (c CipherSuite) Signature() string { return suites[c].signature }
+
+// KEM returns the name of the key exchange mechanism.
+func (c CipherSuite) KEM() string { return suites[c].kem }
+
+// KDF returns the name of the key derivation function.
+func (c CipherSuite) KDF() string { return suites[c].kdf }
+
+// AEAD returns the name of the authenticated cipher.
+func (c CipherSuite) AEAD() string { return suites[c].aead }
+
+func (c CipherSuite) supported() bool {
+	_, ok := suites[c]
+	return ok
+}
+
+// Optional features, advertised during the introduction as a bit set. A
+// feature is only used if both parties advertise it.
+const (
+	featureDoubleRatchet uint32 = 1 << iota
+	featureResumption
+	featureMigration
+)
+
+// negotiation holds what both parties have advertised during the
+// introduction, and what they have agreed upon.
+type negotiation struct {
+	version  uint32
+	suite    CipherSuite
+	local    []CipherSuite
+	remote   []uint32
+	features uint32
+}
+
+// negotiate picks the protocol version and the cipher suite. The suite is the
+// first one in the client's list that the server supports as well, so both
+// sides reach the same result independently.
+func negotiate(
+	local []CipherSuite, remote *introduction, isClient bool,
+) (negotiation, error) {
+	version := min(ProtocolVersion, remote.version)
+	if version < minProtocolVersion {
+		return negotiation{}, fmt.Errorf(
+			"%w: %d", ErrUnsupportedVersion, remote.version,
+		)
+	}
+	client, server := local, suitesFromWire(remote.suites)
+	if !isClient {
+		client, server = server, client
+	}
+	for _, s := range client {
+		if s.supported() && slices.Contains(server, s) {
+			return negotiation{
+				version: version,
+				suite:   s,
+				local:   local,
+				remote:  remote.suites,
+			}, nil
+		}
+	}
+
+	return negotiation{}, ErrNoCommonSuite
+}
+
+// verify checks that the handshake message of the remote party is in
+// agreement with what was negotiated. As handshake messages are signed, this
+// detects any tampering with the unsigned introduction.
+func (n negotiation) verify(version, suite uint32, offered []uint32) error {
+	if version != n.version ||
+		suite != uint32(n.suite) ||
+		!slices.Equal(offered, n.remote) {
+		return ErrDowngrade
+	}
+	return nil
+}
+
+func suitesToWire(s []CipherSuite) []uint32 {
+	out := make([]uint32, len(s))
+	for i, c := range s {
+		out[i] = uint32(c)
+	}
+	return out
+}
+
+// suitesFromWire converts the advertised suites, skipping the values that
+// cannot possibly be a CipherSuite.
+func suitesFromWire(s []uint32) []CipherSuite {
+	out := make([]CipherSuite, 0, len(s))
+	for _, c := range s {
+		if c > math.MaxUint16 {
+			continue
+		}
+		out = append(out, CipherSuite(c))
+	}
+	return out
+}
@@ -0,0 +1,115 @@
+package kamune
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/hossein1376/kamune/internal/attest"
+	"github.com/hossein1376/kamune/internal/box/pb"
+)
+
+const (
+	chacha = Ed25519_X25519MLKEM768_HKDFSHA512_ChaCha20Poly1305
+	aesgcm = Ed25519_X25519MLKEM768_HKDFSHA512_AES256GCM
+)
+
+func TestNegotiate(t *testing.T) {
+	intro := func(version uint32, s ...CipherSuite) *introduction {
+		return &introduction{version: version, suites: suitesToWire(s)}
+	}
+
+	t.Run("client preference", func(t *testing.T) {
+		a := require.New(t)
+		client := []CipherSuite{aesgcm, chacha}
+		server := []CipherSuite{chacha, aesgcm}
+
+		c, err := negotiate(client, intro(ProtocolVersion, server...), true)
+		a.NoError(err)
+		s, err := negotiate(server, intro(ProtocolVersion, client...), false)
+		a.NoError(err)
+		a.Equal(aesgcm, c.suite)
+		a.Equal(aesgcm, s.suite)
+		a.Equal(ProtocolVersion, c.version)
+	})
+	t.Run("no common suite", func(t *testing.T) {
+		a := require.New(t)
+		_, err := negotiate(
+			[]CipherSuite{chacha}, intro(ProtocolVersion, aesgcm, 0xBEEF), true,
+		)
+		a.ErrorIs(err, ErrNoCommonSuite)
+	})
+	t.Run("unsupported version", func(t *testing.T) {
+		a := require.New(t)
+		_, err := negotiate(defaultSuites, intro(0, defaultSuites...), true)
+		a.ErrorIs(err, ErrUnsupportedVersion)
+	})
+	t.Run("newer remote", func(t *testing.T) {
+		a := require.New(t)
+		n, err := negotiate(
+			defaultSuites, intro(ProtocolVersion+1, defaultSuites...), true,
+		)
+		a.NoError(err)
+		a.Equal(ProtocolVersion, n.version)
+	})
+}
+
+func TestCipherSuite_Negotiated(t *testing.T) {
+	a := require.New(t)
+	suite := make(chan CipherSuite, 1)
+	_, addr, _ := startServer(
+		t,
+		func(t *Transport) error {
+			suite <- t.CipherSuite()
+			_, err := t.Receive(Bytes(nil))
+			return err
+		},
+		WithCipherSuites(aesgcm),
+	)
+
+	client := dialServer(t, addr)
+	a.Equal(aesgcm, client.CipherSuite())
+	a.Equal(aesgcm, <-suite)
+	a.Equal("AES-256-GCM", client.CipherSuite().AEAD())
+
+	_, err := client.Send(Bytes([]byte("over AES-GCM")))
+	a.NoError(err)
+}
+
+func TestCipherSuite_Downgrade(t *testing.T) {
+	a := require.New(t)
+	clientConn, clientProxy := net.Pipe()
+	serverConn, serverProxy := net.Pipe()
+
+	// The attacker strips the client's preferred suite from its introduction.
+	go relay(clientProxy, serverProxy, func(rec []byte) ([]byte, error) {
+		var intro pb.Introduce
+		if err := proto.Unmarshal(rec, &intro); err != nil {
+			return nil, err
+		}
+		intro.Suites = []uint32{uint32(aesgcm)}
+		return proto.Marshal(&intro)
+	})
+	go relay(serverProxy, clientProxy, nil)
+
+	srv, err := NewServer(
+		"",
+		func(*Transport) error { return nil },
+		WithKeyStore(NewMemoryKeyStore()),
+		WithRemoteVerifier(acceptAll),
+	)
+	a.NoError(err)
+	served := make(chan error, 1)
+	go func() { served <- srv.serve(serverConn) }()
+
+	clientID, err := attest.New()
+	a.NoError(err)
+	o, err := dialOptions([]DialOption{WithRemoteVerifier(acceptAll)})
+	a.NoError(err)
+	d := newDialer(clientConn, "", clientID, o)
+	_, err = d.dial()
+	a.Error(err)
+	a.ErrorIs(<-served, ErrDowngrade)
+}
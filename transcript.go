@@ -0,0 +1,34 @@
+package kamune
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"hash"
+)
+
+// transcript is a running hash over every message of the introduction and
+// the handshake, exactly as they were written to or read from the wire. Both
+// parties add the messages in the same order, so they end up with the same
+// hash only if they have seen the very same conversation.
+type transcript struct {
+	h hash.Hash
+}
+
+func newTranscript() *transcript {
+	return &transcript{h: sha512.New()}
+}
+
+// add appends a message to the transcript. Each message is prefixed with its
+// length, so message boundaries are part of the hash as well.
+func (t *transcript) add(msg []byte) {
+	var size [8]byte
+	binary.BigEndian.PutUint64(size[:], uint64(len(msg)))
+	t.h.Write(size[:])
+	t.h.Write(msg)
+}
+
+// sum returns the hash of the transcript so far. It does not change the
+// transcript's state.
+func (t *transcript) sum() []byte {
+	return t.h.Sum(nil)
+}
@@ -1,17 +1,21 @@
 package kamune
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
 	"github.com/hossein1376/kamune/internal/attest"
 	"github.com/hossein1376/kamune/internal/box/pb"
-	"github.com/hossein1376/kamune/internal/enigma"
 )
 
 const (
@@ -19,6 +23,19 @@ const (
 	introducePadding = 512
 	messagePadding   = 128
 	handshakePadding = 32
+
+	// closeTimeout bounds the time that Close spends telling the remote
+	// party that the session is over.
+	closeTimeout = time.Second
+
+	// maxFragmentSize is the largest chunk of a message that is placed in a
+	// single record. The rest of the record is reserved for the signature,
+	// metadata, padding and the AEAD overhead.
+	maxFragmentSize = maxTransportSize - 1024
+
+	// DefaultMaxMessageSize is the default upper bound of a single message,
+	// after all of its fragments are put back together.
+	DefaultMaxMessageSize = 16 * 1024 * 1024
 )
 
 var (
@@ -26,80 +43,521 @@ var (
 	ErrInvalidSeqNumber   = errors.New("invalid message sequence number")
 	ErrVerificationFailed = errors.New("verification failed")
 	ErrConnClosedByRemote = errors.New("peer has closed the connection")
+	ErrMessageTooLarge    = errors.New("message exceeds the maximum size")
+	ErrInvalidFragment    = errors.New("invalid message fragment")
+	ErrUnknownRecordKind  = errors.New("unknown record kind")
 )
 
+// Transport is an established session.
+//
+// A Transport is safe for concurrent use. Senders are serialized, so each
+// message is written as a whole, with its sequence numbers assigned along with
+// the write. Likewise, receivers take turns, each one reading a whole message.
+// Close may be called at any time, from any goroutine, and interrupts the
+// pending calls. The order in which messages of concurrent senders are
+// written is unspecified; a single dedicated reader, and senders that do not
+// depend on each other's order, are the expected usage.
 type Transport struct {
 	*plainTransport
-	sessionID string
-	encoder   *enigma.Enigma
-	decoder   *enigma.Enigma
+	sessionID      string
+	encoder        sealer
+	decoder        sealer
+	maxMessageSize atomic.Int64
+	reader         *recordReader
+	pending        reassembly
+	writeErr       error
+	rmu, wmu       sync.Mutex
+	deadlines      deadlines
+	ctx            context.Context
+	cancel         context.CancelFunc
+	handshakeHash  []byte
+	handshakeTime  time.Time
+	resumption     []byte
+	resumed        bool
+	client         bool
+	usage          keyUsage
+	migration      *migration
+
+	// sending and receiving serialize whole messages, while wmu and rmu
+	// serialize single records, as Close and migration write and read records
+	// too. They are semaphores rather than mutexes, so that waiting for them
+	// can be cut short by a context.
+	sending, receiving chan struct{}
 }
 
 func newTransport(
 	pt *plainTransport,
 	sessionID string,
-	encoder, decoder *enigma.Enigma,
+	encoder, decoder sealer,
 ) *Transport {
-	return &Transport{
+	parent := pt.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithCancel(parent)
+	t := &Transport{
 		plainTransport: pt,
 		sessionID:      sessionID,
 		encoder:        encoder,
 		decoder:        decoder,
+		reader:         &recordReader{r: pt.conn},
+		usage:          newKeyUsage(),
+		sending:        make(chan struct{}, 1),
+		receiving:      make(chan struct{}, 1),
+		ctx:            ctx,
+		cancel:         cancel,
 	}
+	t.maxMessageSize.Store(DefaultMaxMessageSize)
+
+	return t
 }
 
+// Receive reads the next message into dst. Messages that were split into
+// fragments by the sender are put back together before being verified.
+//
+// If Receive fails because of a deadline, it can be called again and will
+// continue from where it stopped.
 func (t *Transport) Receive(dst Transferable) (*Metadata, error) {
-	seqNum := t.received.Load()
-	payload, err := read(t.conn)
-	switch {
-	case err == nil:
-	case errors.Is(err, io.EOF):
-		return nil, ErrConnClosedByRemote
-	default:
-		return nil, fmt.Errorf("reading payload: %w", err)
+	t.receiving <- struct{}{}
+	defer func() { <-t.receiving }()
+	return t.receive(dst)
+}
+
+func (t *Transport) receive(dst Transferable) (*Metadata, error) {
+	for {
+		st, err := t.receiveRecord()
+		if err != nil {
+			return nil, err
+		}
+		data, meta, done, err := t.pending.add(
+			st, int(t.maxMessageSize.Load()),
+		)
+		switch {
+		case err != nil:
+			t.pending = reassembly{}
+			return nil, err
+		case !done:
+			continue
+		}
+		return t.open(data, st.GetSignature(), dst, meta)
 	}
-	decrypted, err := t.decoder.Decrypt(payload, seqNum)
-	if err != nil {
-		return nil, fmt.Errorf("decrypting: %w", err)
+}
+
+// ReceiveContext is like Receive, but gives up once ctx is done. The returned
+// error then wraps ctx.Err(), and the Transport remains usable.
+func (t *Transport) ReceiveContext(
+	ctx context.Context, dst Transferable,
+) (*Metadata, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	meta, err := t.deserialize(decrypted, dst, seqNum)
-	if err != nil {
-		return nil, fmt.Errorf("deserializing: %w", err)
+	if err := acquire(ctx, t.receiving); err != nil {
+		return nil, fmt.Errorf("receiving: %w", err)
+	}
+	defer func() { <-t.receiving }()
+	stop := watchContext(ctx, t.setConnReadDeadline)
+	meta, err := t.receive(dst)
+	if stop() {
+		if err := t.setConnReadDeadline(t.deadlines.read()); err != nil {
+			return nil, fmt.Errorf("restoring deadline: %w", err)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("receiving: %w", ctx.Err())
+		}
 	}
-	t.received.Add(1)
 
-	return meta, nil
+	return meta, err
 }
 
+// Send signs and encrypts the message, and writes it to the underlying
+// connection. Messages larger than a single record are split into fragments,
+// each one encrypted and sequenced on its own.
+//
+// Once writing to the connection fails, for example because of a deadline,
+// the Transport can no longer send and all future calls return the same error.
 func (t *Transport) Send(message Transferable) (*Metadata, error) {
-	seqNum := t.sent.Load()
-	payload, metadata, err := t.serialize(message, seqNum)
+	data, sig, err := t.sign(message)
 	if err != nil {
-		return nil, fmt.Errorf("serializing: %w", err)
+		return nil, err
+	}
+	t.sending <- struct{}{}
+	defer func() { <-t.sending }()
+	return t.send(data, sig)
+}
+
+func (t *Transport) sign(message Transferable) (data, sig []byte, err error) {
+	data, err = proto.Marshal(message)
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshalling message: %w", err)
 	}
-	encrypted := t.encoder.Encrypt(payload, seqNum)
-	if _, err := t.conn.Write(encrypted); err != nil {
-		return nil, fmt.Errorf("writing: %w", err)
+	if len(data) > int(t.maxMessageSize.Load()) {
+		return nil, nil, ErrMessageTooLarge
+	}
+	sig, err = t.attest.Sign(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("signing: %w", err)
+	}
+
+	return data, sig, nil
+}
+
+// send writes the fragments of a signed message. The caller must hold the
+// sending semaphore.
+func (t *Transport) send(data, sig []byte) (*Metadata, error) {
+	chunks := fragment(data)
+	var metadata *Metadata
+	for i, chunk := range chunks {
+		var (
+			frag      *pb.Fragment
+			signature []byte
+		)
+		if len(chunks) > 1 {
+			frag = &pb.Fragment{Index: uint32(i), Total: uint32(len(chunks))}
+		}
+		if i == len(chunks)-1 {
+			signature = sig
+		}
+		md, err := t.sendRecord(chunk, signature, frag)
+		if err != nil {
+			return nil, err
+		}
+		if metadata == nil {
+			metadata = md
+		}
 	}
-	t.sent.Add(1)
 
 	return metadata, nil
 }
 
+// SendContext is like Send, but gives up once ctx is done. The returned error
+// then wraps ctx.Err(). If ctx interrupted an ongoing write, the Transport can
+// no longer send, as with any other write failure.
+func (t *Transport) SendContext(
+	ctx context.Context, message Transferable,
+) (*Metadata, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	data, sig, err := t.sign(message)
+	if err != nil {
+		return nil, err
+	}
+	if err := acquire(ctx, t.sending); err != nil {
+		return nil, fmt.Errorf("sending: %w", err)
+	}
+	defer func() { <-t.sending }()
+	stop := watchContext(ctx, t.setConnWriteDeadline)
+	meta, err := t.send(data, sig)
+	if stop() {
+		if err := t.setConnWriteDeadline(t.deadlines.write()); err != nil {
+			return nil, fmt.Errorf("restoring deadline: %w", err)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("sending: %w", ctx.Err())
+		}
+	}
+
+	return meta, err
+}
+
+// SetDeadline sets the read and write deadlines of the underlying connection.
+// See net.Conn for the details.
+func (t *Transport) SetDeadline(d time.Time) error {
+	t.deadlines.setRead(d)
+	t.deadlines.setWrite(d)
+	conn, _ := t.connection()
+	return conn.SetDeadline(d)
+}
+
+// SetReadDeadline sets the read deadline of the underlying connection.
+func (t *Transport) SetReadDeadline(d time.Time) error {
+	t.deadlines.setRead(d)
+	return t.setConnReadDeadline(d)
+}
+
+// SetWriteDeadline sets the write deadline of the underlying connection.
+func (t *Transport) SetWriteDeadline(d time.Time) error {
+	t.deadlines.setWrite(d)
+	return t.setConnWriteDeadline(d)
+}
+
+func (t *Transport) setConnReadDeadline(d time.Time) error {
+	conn, _ := t.connection()
+	return conn.SetReadDeadline(d)
+}
+
+func (t *Transport) setConnWriteDeadline(d time.Time) error {
+	conn, _ := t.connection()
+	return conn.SetWriteDeadline(d)
+}
+
+// SetMaxMessageSize sets the upper bound of a single message, in bytes, for
+// both directions. Incoming messages that would grow beyond it are rejected
+// with ErrMessageTooLarge before being fully buffered.
+func (t *Transport) SetMaxMessageSize(size int) {
+	t.maxMessageSize.Store(int64(size))
+}
+
+// Close closes the Transport and its underlying connection. If the session
+// can migrate, the remote party is told that the session is over, so it does
+// not wait for it to be reattached.
 func (t *Transport) Close() error {
+	t.cancel()
+	if m := t.migration; m != nil {
+		m.fail(net.ErrClosed)
+		_ = t.setConnWriteDeadline(time.Now().Add(closeTimeout))
+		_, _ = t.writeRecord(&pb.SignedTransport{Kind: pb.Kind_Close})
+		m.mu.Lock()
+		defer m.mu.Unlock()
+	}
 	return t.conn.Close()
 }
 
+// Context returns the context of the Transport. It is cancelled once the
+// Transport is closed, or, for Transports handed out by a Server, once the
+// server starts shutting down.
+func (t *Transport) Context() context.Context {
+	return t.ctx
+}
+
 func (t *Transport) SessionID() string {
 	return t.sessionID
 }
 
+// RemotePublicKey returns the verified public key of the remote party.
+func (t *Transport) RemotePublicKey() *attest.PublicKey {
+	return t.remote
+}
+
+// Fingerprint returns the fingerprint of the remote party's public key. See
+// the Fingerprint function.
+func (t *Transport) Fingerprint() string {
+	return Fingerprint(t.remote)
+}
+
+// LocalAddr returns the local address of the underlying connection.
+func (t *Transport) LocalAddr() net.Addr {
+	conn, _ := t.connection()
+	return conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the underlying connection. It may
+// change over the life of the session, if it migrates.
+func (t *Transport) RemoteAddr() net.Addr {
+	conn, _ := t.connection()
+	return conn.RemoteAddr()
+}
+
+// HandshakeTime returns the time at which the handshake, or the resumption,
+// was completed.
+func (t *Transport) HandshakeTime() time.Time {
+	return t.handshakeTime
+}
+
+// CipherSuite returns the cipher suite that was negotiated for the session.
+func (t *Transport) CipherSuite() CipherSuite {
+	return t.negotiation.suite
+}
+
+// Version returns the protocol version that was negotiated for the session.
+func (t *Transport) Version() uint32 {
+	return t.negotiation.version
+}
+
+// Resumed reports whether the session was resumed with a ticket, rather than
+// established through a full handshake.
+func (t *Transport) Resumed() bool {
+	return t.resumed
+}
+
+// Migration reports whether the session can be reattached to a new
+// connection. See WithMigration.
+func (t *Transport) Migration() bool {
+	return t.migration != nil
+}
+
+// DoubleRatchet reports whether the session uses the double ratchet. See
+// WithDoubleRatchet.
+func (t *Transport) DoubleRatchet() bool {
+	return t.negotiation.features&featureDoubleRatchet != 0
+}
+
+// sendRecord encrypts and writes a single record. If the key has reached the
+// limits of the rekey policy, a rekey record is sent first and the encoder
+// moves to the next key.
+func (t *Transport) sendRecord(
+	data, sig []byte, frag *pb.Fragment,
+) (*Metadata, error) {
+	if !t.DoubleRatchet() && t.rekey.due(t.usage) {
+		_, err := t.writeRecord(&pb.SignedTransport{Kind: pb.Kind_Rekey})
+		if err != nil {
+			return nil, err
+		}
+		t.usage = newKeyUsage()
+	}
+	md, err := t.writeRecord(&pb.SignedTransport{
+		Data: data, Signature: sig, Fragment: frag, Kind: pb.Kind_Message,
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.usage.add(len(data))
+
+	return md, nil
+}
+
+// writeRecord encrypts and writes a single record. If the session can
+// migrate, the record is also kept until the remote party acknowledges it,
+// and a lost connection is recovered from before giving up.
+func (t *Transport) writeRecord(st *pb.SignedTransport) (*Metadata, error) {
+	t.wmu.Lock()
+	if t.writeErr != nil {
+		defer t.wmu.Unlock()
+		return nil, t.writeErr
+	}
+	seqNum := t.sent.Load()
+	if seqNum == math.MaxUint64 {
+		t.wmu.Unlock()
+		return nil, ErrSequenceExhausted
+	}
+	if t.migration != nil {
+		st.Ack = t.received.Load()
+	}
+	payload, metadata, err := t.wrap(st, seqNum)
+	if err != nil {
+		t.wmu.Unlock()
+		return nil, fmt.Errorf("serializing: %w", err)
+	}
+	encrypted, err := t.encoder.seal(payload, seqNum)
+	if err != nil {
+		t.wmu.Unlock()
+		return nil, fmt.Errorf("encrypting: %w", err)
+	}
+	if st.GetKind() == pb.Kind_Rekey {
+		// No other record may be sealed with the old key after this one.
+		if err := t.encoder.rekey(); err != nil {
+			t.wmu.Unlock()
+			return nil, t.failWrite(fmt.Errorf("rekeying: %w", err))
+		}
+	}
+	conn, gen := t.connection()
+	if t.migration != nil {
+		// From now on, the record is delivered either on this connection or
+		// retransmitted on the next one.
+		t.migration.buffer.add(seqNum, encrypted)
+		t.sent.Add(1)
+	}
+	err = writeRecord(conn, encrypted)
+	if err == nil && t.migration == nil {
+		t.sent.Add(1)
+	}
+	t.wmu.Unlock()
+
+	if err != nil && t.recoverable(err) {
+		err = t.recover(gen, err)
+	}
+	if err != nil {
+		return nil, t.failWrite(fmt.Errorf("writing: %w", err))
+	}
+
+	return metadata, nil
+}
+
+// failWrite stops the Transport from sending, and returns the error that all
+// future calls to Send will return.
+func (t *Transport) failWrite(err error) error {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	if t.writeErr == nil {
+		t.writeErr = err
+	}
+	return t.writeErr
+}
+
+// receiveRecord reads and decrypts the next record that carries a message.
+// Rekey and close records are handled along the way. If the session can
+// migrate, a lost connection is recovered from before giving up.
+func (t *Transport) receiveRecord() (*pb.SignedTransport, error) {
+	for {
+		if t.received.Load() == math.MaxUint64 {
+			return nil, ErrSequenceExhausted
+		}
+		t.rmu.Lock()
+		_, gen := t.connection()
+		payload, err := t.reader.next()
+		if err != nil {
+			t.rmu.Unlock()
+			switch {
+			case t.recoverable(err):
+				if err := t.recover(gen, err); err != nil {
+					return nil, err
+				}
+				continue
+			case errors.Is(err, io.EOF):
+				return nil, ErrConnClosedByRemote
+			default:
+				return nil, fmt.Errorf("reading payload: %w", err)
+			}
+		}
+		st, err := t.openRecord(payload)
+		t.rmu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		if t.migration != nil {
+			t.migration.buffer.ack(st.GetAck())
+		}
+
+		switch st.GetKind() {
+		case pb.Kind_Message:
+			return st, nil
+		case pb.Kind_Rekey:
+			if err := t.decoder.rekey(); err != nil {
+				return nil, fmt.Errorf("rekeying: %w", err)
+			}
+		case pb.Kind_Close:
+			if t.migration == nil {
+				return nil, fmt.Errorf("%w: %d", ErrUnknownRecordKind, st.GetKind())
+			}
+			t.migration.fail(ErrConnClosedByRemote)
+			return nil, ErrConnClosedByRemote
+		default:
+			return nil, fmt.Errorf("%w: %d", ErrUnknownRecordKind, st.GetKind())
+		}
+	}
+}
+
+// openRecord decrypts and verifies the sequence number of the next record.
+func (t *Transport) openRecord(payload []byte) (*pb.SignedTransport, error) {
+	seqNum := t.received.Load()
+	decrypted, err := t.decoder.open(payload, seqNum)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting: %w", err)
+	}
+	st, err := t.unwrap(decrypted, seqNum)
+	if err != nil {
+		return nil, fmt.Errorf("deserializing: %w", err)
+	}
+	t.received.Add(1)
+
+	return st, nil
+}
+
 type plainTransport struct {
-	conn     Conn
-	sent     atomic.Uint64
-	received atomic.Uint64
-	attest   *attest.Attest
-	remote   *attest.PublicKey
+	ctx         context.Context
+	conn        *Conn
+	sent        atomic.Uint64
+	received    atomic.Uint64
+	attest      *attest.Attest
+	remote      *attest.PublicKey
+	negotiation negotiation
+	transcript  *transcript
+	rekey       RekeyPolicy
+	// sasSalt is the client's secret contribution to the SAS. The client
+	// commits to it in its introduction, and reveals it in its finished
+	// message. sasCommitment is that commitment, as the server received it.
+	sasSalt       []byte
+	sasCommitment []byte
 }
 
 func (pt *plainTransport) serialize(
@@ -113,13 +571,20 @@ func (pt *plainTransport) serialize(
 	if err != nil {
 		return nil, nil, fmt.Errorf("signing: %w", err)
 	}
-	md := &pb.Metadata{Sequence: seq, Timestamp: timestamppb.Now()}
+
 	st := &pb.SignedTransport{
-		Data:      message,
-		Signature: sig,
-		Metadata:  md,
-		Padding:   padding(messagePadding),
+		Data: message, Signature: sig, Kind: pb.Kind_Message,
 	}
+	return pt.wrap(st, seq)
+}
+
+// wrap adds the metadata and padding to st, and marshals it.
+func (pt *plainTransport) wrap(
+	st *pb.SignedTransport, seq uint64,
+) ([]byte, *Metadata, error) {
+	md := &pb.Metadata{Sequence: seq, Timestamp: timestamppb.Now()}
+	st.Metadata = md
+	st.Padding = padding(messagePadding)
 	payload, err := proto.Marshal(st)
 	if err != nil {
 		return nil, nil, fmt.Errorf("marshalling transport: %w", err)
@@ -131,6 +596,23 @@ func (pt *plainTransport) serialize(
 func (pt *plainTransport) deserialize(
 	payload []byte, dst Transferable, seq uint64,
 ) (*Metadata, error) {
+	st, err := pt.unwrap(payload, seq)
+	if err != nil {
+		return nil, err
+	}
+	if st.GetFragment() != nil {
+		return nil, ErrInvalidFragment
+	}
+	if st.GetKind() != pb.Kind_Message {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownRecordKind, st.GetKind())
+	}
+
+	return pt.open(st.GetData(), st.GetSignature(), dst, st.GetMetadata())
+}
+
+func (pt *plainTransport) unwrap(
+	payload []byte, seq uint64,
+) (*pb.SignedTransport, error) {
 	var st pb.SignedTransport
 	if err := proto.Unmarshal(payload, &st); err != nil {
 		return nil, fmt.Errorf("unmarshalling transport: %w", err)
@@ -138,22 +620,109 @@ func (pt *plainTransport) deserialize(
 	if st.GetMetadata().GetSequence() != seq {
 		return nil, ErrInvalidSeqNumber
 	}
-	msg := st.GetData()
-	if !attest.Verify(pt.remote, msg, st.Signature) {
+
+	return &st, nil
+}
+
+func (pt *plainTransport) open(
+	msg, sig []byte, dst Transferable, md *pb.Metadata,
+) (*Metadata, error) {
+	if !attest.Verify(pt.remote, msg, sig) {
 		return nil, ErrInvalidSignature
 	}
 	if err := proto.Unmarshal(msg, dst); err != nil {
 		return nil, fmt.Errorf("unmarshalling message: %w", err)
 	}
 
-	return &Metadata{st.GetMetadata()}, nil
+	return &Metadata{md}, nil
 }
 
-func read(c Conn) ([]byte, error) {
-	buf := make([]byte, maxTransportSize)
-	n, err := c.Read(buf)
-	if err != nil {
-		return nil, err
+type reassembly struct {
+	data        []byte
+	meta        *pb.Metadata
+	next, total uint32
+}
+
+// add appends the record to the message being reassembled. Once the message
+// is complete, done is true and its data, alongside the metadata of its first
+// record, are returned.
+func (r *reassembly) add(
+	st *pb.SignedTransport, limit int,
+) (data []byte, meta *pb.Metadata, done bool, err error) {
+	frag := st.GetFragment()
+	if frag == nil {
+		if r.next != 0 {
+			return nil, nil, false, ErrInvalidFragment
+		}
+		if len(st.GetData()) > limit {
+			return nil, nil, false, ErrMessageTooLarge
+		}
+		return st.GetData(), st.GetMetadata(), true, nil
 	}
-	return buf[:n], nil
+
+	if r.next == 0 {
+		r.total = frag.GetTotal()
+		r.meta = st.GetMetadata()
+	}
+	switch {
+	case frag.GetIndex() != r.next, frag.GetTotal() != r.total, r.total < 2:
+		return nil, nil, false, ErrInvalidFragment
+	case uint64(r.total-1)*maxFragmentSize >= uint64(limit):
+		return nil, nil, false, ErrMessageTooLarge
+	case len(r.data)+len(st.GetData()) > limit:
+		return nil, nil, false, ErrMessageTooLarge
+	}
+	r.data = append(r.data, st.GetData()...)
+	if r.next++; r.next < r.total {
+		return nil, nil, false, nil
+	}
+	data, meta = r.data, r.meta
+	*r = reassembly{}
+
+	return data, meta, true, nil
+}
+
+type deadlines struct {
+	mu         sync.Mutex
+	rDue, wDue time.Time
+}
+
+func (d *deadlines) read() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.rDue
+}
+
+func (d *deadlines) write() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.wDue
+}
+
+func (d *deadlines) setRead(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rDue = t
+}
+
+func (d *deadlines) setWrite(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.wDue = t
+}
+
+// fragment splits data into chunks that each fit into a single record. It
+// always returns at least one chunk, even for empty data.
+func fragment(data []byte) [][]byte {
+	if len(data) <= maxFragmentSize {
+		return [][]byte{data}
+	}
+	chunks := make([][]byte, 0, (len(data)+maxFragmentSize-1)/maxFragmentSize)
+	for len(data) > 0 {
+		n := min(len(data), maxFragmentSize)
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+
+	return chunks
 }
@@ -0,0 +1,342 @@
+package kamune
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/hossein1376/kamune/internal/attest"
+)
+
+// testNegotiation is what both parties agree upon when they both use the
+// default options.
+func testNegotiation() negotiation {
+	return negotiation{
+		version: ProtocolVersion,
+		suite:   defaultSuites[0],
+		local:   defaultSuites,
+		remote:  suitesToWire(defaultSuites),
+	}
+}
+
+func newTransportPair(t *testing.T) (client, server *Transport) {
+	t.Helper()
+	salt := randomBytes(sasSaltSize)
+	client, server, err := handshakePair(t, salt, sasCommit(salt))
+	require.NoError(t, err)
+
+	return client, server
+}
+
+// handshakePair runs a handshake over a pipe, in which the client reveals
+// salt, and the server expects it to match commitment.
+func handshakePair(
+	t *testing.T, salt, commitment []byte,
+) (client, server *Transport, err error) {
+	t.Helper()
+	a := require.New(t)
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+
+	clientID, err := attest.New()
+	a.NoError(err)
+	serverID, err := attest.New()
+	a.NoError(err)
+
+	type result struct {
+		t   *Transport
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		pt := &plainTransport{
+			conn:        &Conn{Conn: c2},
+			attest:      serverID,
+			remote:      clientID.PublicKey(),
+			negotiation: testNegotiation(),
+			transcript:  newTranscript(),
+
+			sasCommitment: commitment,
+		}
+		st, err := acceptHandshake(pt)
+		if err != nil {
+			// Let the client give up as well.
+			c2.Close()
+		}
+		ch <- result{st, err}
+	}()
+
+	pt := &plainTransport{
+		conn:        &Conn{Conn: c1},
+		attest:      clientID,
+		remote:      serverID.PublicKey(),
+		negotiation: testNegotiation(),
+		transcript:  newTranscript(),
+		sasSalt:     salt,
+	}
+	client, clientErr := requestHandshake(pt)
+	res := <-ch
+	if res.err != nil {
+		return nil, nil, res.err
+	}
+	if clientErr != nil {
+		return nil, nil, clientErr
+	}
+
+	return client, res.t, nil
+}
+
+func TestTransport_BackToBack(t *testing.T) {
+	a := require.New(t)
+	client, server := newTransportPair(t)
+
+	const count = 100
+	errCh := make(chan error, 1)
+	go func() {
+		for i := range count {
+			msg := Bytes([]byte(fmt.Sprintf("message %d", i)))
+			if _, err := client.Send(msg); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		errCh <- nil
+	}()
+
+	for i := range count {
+		b := Bytes(nil)
+		meta, err := server.Receive(b)
+		a.NoError(err)
+		a.Equal(fmt.Sprintf("message %d", i), string(b.GetValue()))
+		a.NotNil(meta)
+	}
+	a.NoError(<-errCh)
+}
+
+func TestTransport_Fragmentation(t *testing.T) {
+	a := require.New(t)
+	client, server := newTransportPair(t)
+
+	sizes := []int{
+		0, maxFragmentSize - 1, maxFragmentSize, 5 * maxFragmentSize, 1 << 20,
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		for _, size := range sizes {
+			msg := Bytes(bytes.Repeat([]byte{'k'}, size))
+			if _, err := client.Send(msg); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		errCh <- nil
+	}()
+
+	for _, size := range sizes {
+		b := Bytes(nil)
+		_, err := server.Receive(b)
+		a.NoError(err)
+		a.Len(b.GetValue(), size)
+	}
+	a.NoError(<-errCh)
+
+	go func() {
+		_, err := server.Send(Bytes([]byte("still in sync")))
+		errCh <- err
+	}()
+	b := Bytes(nil)
+	_, err := client.Receive(b)
+	a.NoError(err)
+	a.Equal("still in sync", string(b.GetValue()))
+	a.NoError(<-errCh)
+}
+
+func TestTransport_MaxMessageSize(t *testing.T) {
+	a := require.New(t)
+	client, server := newTransportPair(t)
+
+	client.SetMaxMessageSize(1024)
+	_, err := client.Send(Bytes(make([]byte, 2048)))
+	a.ErrorIs(err, ErrMessageTooLarge)
+
+	server.SetMaxMessageSize(3 * maxFragmentSize)
+	client.SetMaxMessageSize(DefaultMaxMessageSize)
+	go func() {
+		_, _ = client.Send(Bytes(make([]byte, 10*maxFragmentSize)))
+	}()
+	_, err = server.Receive(Bytes(nil))
+	a.ErrorIs(err, ErrMessageTooLarge)
+}
+
+func TestTransport_Context(t *testing.T) {
+	a := require.New(t)
+	client, server := newTransportPair(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := server.ReceiveContext(ctx, Bytes(nil))
+	a.ErrorIs(err, context.DeadlineExceeded)
+	a.NotErrorIs(err, ErrConnClosedByRemote)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = client.SendContext(ctx, Bytes([]byte("never sent")))
+	a.ErrorIs(err, context.Canceled)
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := client.SendContext(context.Background(), Bytes([]byte("hi")))
+		errCh <- err
+	}()
+	b := Bytes(nil)
+	_, err = server.ReceiveContext(context.Background(), b)
+	a.NoError(err)
+	a.Equal("hi", string(b.GetValue()))
+	a.NoError(<-errCh)
+
+	a.NoError(server.SetReadDeadline(time.Now().Add(20 * time.Millisecond)))
+	_, err = server.Receive(Bytes(nil))
+	a.ErrorIs(err, os.ErrDeadlineExceeded)
+}
+
+func TestTransport_ConcurrentSend(t *testing.T) {
+	a := require.New(t)
+	client, server := newTransportPair(t)
+
+	const senders, count = 8, 16
+	// Every other message is large enough to be fragmented, so that the
+	// fragments of concurrent messages would interleave if senders were not
+	// serialized.
+	payload := func(sender, i int) []byte {
+		size := 64
+		if i%2 == 1 {
+			size = 2*maxFragmentSize + sender
+		}
+		return bytes.Repeat([]byte{byte(sender), byte(i)}, size/2)
+	}
+	hammer := func(tr *Transport) <-chan error {
+		errs := make(chan error, senders)
+		for s := range senders {
+			go func() {
+				for i := range count {
+					if _, err := tr.Send(Bytes(payload(s, i))); err != nil {
+						errs <- err
+						return
+					}
+				}
+				errs <- nil
+			}()
+		}
+		return errs
+	}
+	drain := func(tr *Transport) error {
+		next := make([]int, senders)
+		for range senders * count {
+			b := Bytes(nil)
+			if _, err := tr.Receive(b); err != nil {
+				return err
+			}
+			s := int(b.GetValue()[0])
+			want := payload(s, next[s])
+			if !bytes.Equal(want, b.GetValue()) {
+				return fmt.Errorf("sender %d: message %d mangled", s, next[s])
+			}
+			next[s]++
+		}
+		return nil
+	}
+
+	// Both parties send and receive at the same time.
+	fromClient, fromServer := hammer(client), hammer(server)
+	drained := make(chan error, 1)
+	go func() { drained <- drain(client) }()
+	a.NoError(drain(server))
+	a.NoError(<-drained)
+	for range senders {
+		a.NoError(<-fromClient)
+		a.NoError(<-fromServer)
+	}
+	a.Equal(client.sent.Load(), server.received.Load())
+	a.Equal(server.sent.Load(), client.received.Load())
+}
+
+func TestTransport_ConcurrentClose(t *testing.T) {
+	a := require.New(t)
+	client, server := newTransportPair(t)
+
+	go func() {
+		for {
+			if _, err := server.Receive(Bytes(nil)); err != nil {
+				return
+			}
+		}
+	}()
+	for range 4 {
+		go func() {
+			for {
+				if _, err := client.Send(Bytes([]byte("hi"))); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	const closers = 8
+	errs := make(chan error, closers)
+	for range closers {
+		go func() { errs <- client.Close() }()
+	}
+	var closed int
+	for range closers {
+		if err := <-errs; err == nil {
+			closed++
+		} else {
+			a.ErrorIs(err, ErrAlreadyClosed)
+		}
+	}
+	a.Equal(1, closed)
+	<-client.Context().Done()
+}
+
+func TestTransport_SendContextWaits(t *testing.T) {
+	a := require.New(t)
+	client, server := newTransportPair(t)
+
+	// Nobody reads yet, so this Send blocks while holding its turn.
+	first := make(chan error, 1)
+	go func() {
+		_, err := client.Send(Bytes([]byte("first")))
+		first <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// Giving up while waiting for the turn leaves the pending write intact.
+	ctx, cancel := context.WithTimeout(t.Context(), 20*time.Millisecond)
+	defer cancel()
+	_, err := client.SendContext(ctx, Bytes([]byte("second")))
+	a.ErrorIs(err, context.DeadlineExceeded)
+
+	b := Bytes(nil)
+	_, err = server.Receive(b)
+	a.NoError(err)
+	a.Equal("first", string(b.GetValue()))
+	a.NoError(<-first)
+
+	go func() {
+		_, err := client.Send(Bytes([]byte("third")))
+		first <- err
+	}()
+	_, err = server.Receive(b)
+	a.NoError(err)
+	a.Equal("third", string(b.GetValue()))
+	a.NoError(<-first)
+}
@@ -0,0 +1,495 @@
+package kamune
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hossein1376/kamune/internal/attest"
+)
+
+const (
+	knownHostsName = "known_hosts"
+	// legacyKnownName is the file in which older versions kept the keys of
+	// the trusted peers.
+	legacyKnownName = "known"
+
+	// hashedHostPrefix marks a hashed host, as in "|1|salt|hash".
+	hashedHostPrefix = "|1|"
+	hostSaltSize     = 20
+
+	// verifiedMarker precedes the entries whose key was verified out of
+	// band, such as by comparing the short authentication string.
+	verifiedMarker = "@verified"
+)
+
+var (
+	ErrKeyChanged  = errors.New("remote identity has changed")
+	ErrUnknownHost = errors.New("host is not known")
+	ErrHostKnown   = errors.New("host is already known")
+)
+
+// TrustEntry pins the public key of a host.
+type TrustEntry struct {
+	// Host is the address or alias that the key belongs to. For hashed
+	// entries, it is the hashed form, which does not reveal the host.
+	Host      string
+	Hashed    bool
+	Key       *attest.PublicKey
+	FirstSeen time.Time
+	Comment   string
+	// Verified reports whether the user has confirmed the key out of band,
+	// rather than merely trusting it on first use.
+	Verified bool
+}
+
+// matches reports whether the entry belongs to host.
+func (e *TrustEntry) matches(host string) bool {
+	if !e.Hashed {
+		return e.Host == host
+	}
+	salt, sum, ok := splitHashedHost(e.Host)
+	return ok && hmac.Equal(sum, hashHost(salt, host))
+}
+
+// TrustStore pins the public keys of known hosts, much like SSH's
+// known_hosts file. A host is first trusted on the user's say-so, and from
+// then on, a different key for the same host is refused with ErrKeyChanged.
+//
+// Each line of the file holds a single entry:
+//
+//	[@verified] host base64-key first-seen [comment]
+//
+// where first-seen is in RFC 3339 format, and the marker is set once the key
+// has been verified out of band. Hashed hosts take the form
+// "|1|salt|hash", so that the file does not reveal whom the user talks to.
+// Lines starting with '#' are ignored, and dropped once the file is written.
+type TrustStore struct {
+	path string
+
+	mu      sync.Mutex
+	hash    bool
+	entries []TrustEntry
+}
+
+// OpenTrustStore reads the trust store at path. A missing file is treated as
+// empty, and is only created once an entry is added.
+func OpenTrustStore(path string) (*TrustStore, error) {
+	ts := &TrustStore{path: path}
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return ts, nil
+	case err != nil:
+		return nil, fmt.Errorf("reading trust store: %w", err)
+	}
+
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		e, err := parseTrustEntry(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		ts.entries = append(ts.entries, e)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("reading trust store: %w", err)
+	}
+
+	return ts, nil
+}
+
+// DefaultTrustStore opens the trust store in $XDG_CONFIG_HOME/kamune, or in
+// ~/.config/kamune if the variable is not set. The keys trusted by older
+// versions, kept in the "known" file of the same directory, are imported the
+// first time, and the file is then renamed to "known.old".
+func DefaultTrustStore() (*TrustStore, error) {
+	dir, err := configDir()
+	if err != nil {
+		return nil, err
+	}
+	ts, err := OpenTrustStore(filepath.Join(dir, knownHostsName))
+	if err != nil {
+		return nil, err
+	}
+	if err := ts.importLegacy(filepath.Join(dir, legacyKnownName)); err != nil {
+		return nil, fmt.Errorf("importing trusted peers: %w", err)
+	}
+	return ts, nil
+}
+
+// NewMemoryTrustStore returns a TrustStore that is never written to disk.
+func NewMemoryTrustStore() *TrustStore {
+	return &TrustStore{}
+}
+
+// HashHosts sets whether the hosts of new entries are hashed. Existing
+// entries are left as they are.
+func (ts *TrustStore) HashHosts(enabled bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.hash = enabled
+}
+
+// Check reports whether key is pinned for host. It returns ErrUnknownHost if
+// host has no entries, and ErrKeyChanged if none of them hold key.
+func (ts *TrustStore) Check(host string, key *attest.PublicKey) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	var pinned *attest.PublicKey
+	for _, e := range ts.entries {
+		if !e.matches(host) {
+			continue
+		}
+		if e.Key.Equal(key) {
+			return nil
+		}
+		pinned = e.Key
+	}
+	if pinned == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownHost, host)
+	}
+
+	return fmt.Errorf(
+		"%w: %s was pinned to %s, but presented %s",
+		ErrKeyChanged, host, Fingerprint(pinned), Fingerprint(key),
+	)
+}
+
+// Known reports whether key is pinned for any host.
+func (ts *TrustStore) Known(key *attest.PublicKey) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return slices.ContainsFunc(ts.entries, func(e TrustEntry) bool {
+		return e.Key.Equal(key)
+	})
+}
+
+// Lookup returns the entries of host.
+func (ts *TrustStore) Lookup(host string) []TrustEntry {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	var entries []TrustEntry
+	for _, e := range ts.entries {
+		if e.matches(host) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// List returns all entries, in the order they were added.
+func (ts *TrustStore) List() []TrustEntry {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return slices.Clone(ts.entries)
+}
+
+// Add pins key for host. It returns ErrHostKnown if host already has an
+// entry; Replace should be used to change its key.
+func (ts *TrustStore) Add(
+	host string, key *attest.PublicKey, comment string,
+) error {
+	if err := checkEntry(host, comment); err != nil {
+		return err
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if slices.ContainsFunc(ts.entries, func(e TrustEntry) bool {
+		return e.matches(host)
+	}) {
+		return fmt.Errorf("%w: %s", ErrHostKnown, host)
+	}
+	return ts.add(host, key, comment)
+}
+
+// Replace pins key for host, in place of the keys it had before, if any.
+func (ts *TrustStore) Replace(
+	host string, key *attest.PublicKey, comment string,
+) error {
+	if err := checkEntry(host, comment); err != nil {
+		return err
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.entries = slices.DeleteFunc(ts.entries, func(e TrustEntry) bool {
+		return e.matches(host)
+	})
+	return ts.add(host, key, comment)
+}
+
+// MarkVerified records that key has been verified for host out of band, such
+// as by comparing the short authentication string of a session. If host has
+// no entries, key is pinned for it. It returns ErrKeyChanged if host is
+// pinned to another key; Replace should be used first to change it.
+func (ts *TrustStore) MarkVerified(host string, key *attest.PublicKey) error {
+	if err := checkEntry(host, ""); err != nil {
+		return err
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	var found, changed bool
+	for i := range ts.entries {
+		e := &ts.entries[i]
+		if !e.matches(host) {
+			continue
+		}
+		if !e.Key.Equal(key) {
+			changed = true
+			continue
+		}
+		e.Verified = true
+		found = true
+	}
+	switch {
+	case found:
+		return ts.save()
+	case changed:
+		return fmt.Errorf("%w: %s", ErrKeyChanged, host)
+	}
+
+	e := ts.newEntry(host, key, "")
+	e.Verified = true
+	ts.entries = append(ts.entries, e)
+	return ts.save()
+}
+
+// Remove removes all entries of host. It returns ErrUnknownHost if there were
+// none.
+func (ts *TrustStore) Remove(host string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	n := len(ts.entries)
+	ts.entries = slices.DeleteFunc(ts.entries, func(e TrustEntry) bool {
+		return e.matches(host)
+	})
+	if len(ts.entries) == n {
+		return fmt.Errorf("%w: %s", ErrUnknownHost, host)
+	}
+	return ts.save()
+}
+
+func (ts *TrustStore) add(
+	host string, key *attest.PublicKey, comment string,
+) error {
+	ts.entries = append(ts.entries, ts.newEntry(host, key, comment))
+	return ts.save()
+}
+
+// newEntry returns an entry for host, hashing it if enabled.
+func (ts *TrustStore) newEntry(
+	host string, key *attest.PublicKey, comment string,
+) TrustEntry {
+	e := TrustEntry{
+		Host:      host,
+		Key:       key,
+		FirstSeen: time.Now().UTC().Truncate(time.Second),
+		Comment:   comment,
+	}
+	if ts.hash {
+		salt := make([]byte, hostSaltSize)
+		_, _ = rand.Read(salt)
+		e.Host = joinHashedHost(salt, hashHost(salt, host))
+		e.Hashed = true
+	}
+	return e
+}
+
+// importLegacy pins the keys in the file at path, which holds a base64
+// encoded key per line, and renames it once done. Those keys were trusted
+// regardless of the host, so they are pinned by their fingerprints.
+func (ts *TrustStore) importLegacy(path string) error {
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return nil
+	case err != nil:
+		return fmt.Errorf("reading file: %w", err)
+	}
+
+	var keys []*attest.PublicKey
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: decoding key: %w", path, n, err)
+		}
+		key, err := attest.ParsePublicKey(raw)
+		if err != nil {
+			return fmt.Errorf("%s:%d: parsing key: %w", path, n, err)
+		}
+		keys = append(keys, key)
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("reading file: %w", err)
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	comment := "imported from " + legacyKnownName
+	for _, key := range keys {
+		if slices.ContainsFunc(ts.entries, func(e TrustEntry) bool {
+			return e.Key.Equal(key)
+		}) {
+			continue
+		}
+		ts.entries = append(
+			ts.entries, ts.newEntry(Fingerprint(key), key, comment),
+		)
+	}
+	if err := ts.save(); err != nil {
+		return err
+	}
+	if err := os.Rename(path, path+".old"); err != nil {
+		return fmt.Errorf("renaming file: %w", err)
+	}
+
+	return nil
+}
+
+// save writes the entries to the file, replacing it as a whole.
+func (ts *TrustStore) save() error {
+	if ts.path == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, e := range ts.entries {
+		if e.Verified {
+			fmt.Fprintf(&buf, "%s ", verifiedMarker)
+		}
+		fmt.Fprintf(
+			&buf, "%s %s %s",
+			e.Host,
+			base64.StdEncoding.EncodeToString(e.Key.Marshal()),
+			e.FirstSeen.Format(time.RFC3339),
+		)
+		if e.Comment != "" {
+			fmt.Fprintf(&buf, " %s", e.Comment)
+		}
+		buf.WriteByte('\n')
+	}
+
+	dir := filepath.Dir(ts.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("MkdirAll: %w", err)
+	}
+	f, err := os.CreateTemp(dir, knownHostsName+".*")
+	if err != nil {
+		return fmt.Errorf("creating file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("writing to file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("closing file: %w", err)
+	}
+	if err := os.Rename(f.Name(), ts.path); err != nil {
+		return fmt.Errorf("replacing file: %w", err)
+	}
+
+	return nil
+}
+
+// checkEntry makes sure that the entry can be written as a single line.
+func checkEntry(host, comment string) error {
+	if host == "" ||
+		strings.HasPrefix(host, "|") ||
+		strings.ContainsAny(host, " \t\r\n#") {
+		return fmt.Errorf("invalid host: %q", host)
+	}
+	if strings.ContainsAny(comment, "\r\n") {
+		return fmt.Errorf("invalid comment: %q", comment)
+	}
+	return nil
+}
+
+func parseTrustEntry(line string) (TrustEntry, error) {
+	fields := strings.Fields(line)
+	verified := len(fields) > 0 && fields[0] == verifiedMarker
+	if verified {
+		fields = fields[1:]
+	}
+	if len(fields) < 3 {
+		return TrustEntry{}, errors.New("malformed entry")
+	}
+	raw, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return TrustEntry{}, fmt.Errorf("decoding key: %w", err)
+	}
+	key, err := attest.ParsePublicKey(raw)
+	if err != nil {
+		return TrustEntry{}, fmt.Errorf("parsing key: %w", err)
+	}
+	seen, err := time.Parse(time.RFC3339, fields[2])
+	if err != nil {
+		return TrustEntry{}, fmt.Errorf("parsing first seen: %w", err)
+	}
+	_, _, hashed := splitHashedHost(fields[0])
+	if strings.HasPrefix(fields[0], hashedHostPrefix) && !hashed {
+		return TrustEntry{}, errors.New("malformed hashed host")
+	}
+
+	return TrustEntry{
+		Host:      fields[0],
+		Hashed:    hashed,
+		Key:       key,
+		FirstSeen: seen,
+		Comment:   strings.Join(fields[3:], " "),
+		Verified:  verified,
+	}, nil
+}
+
+func hashHost(salt []byte, host string) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(host))
+	return mac.Sum(nil)
+}
+
+func joinHashedHost(salt, sum []byte) string {
+	enc := base64.StdEncoding
+	return hashedHostPrefix +
+		enc.EncodeToString(salt) + "|" + enc.EncodeToString(sum)
+}
+
+func splitHashedHost(host string) (salt, sum []byte, ok bool) {
+	rest, found := strings.CutPrefix(host, hashedHostPrefix)
+	if !found {
+		return nil, nil, false
+	}
+	encSalt, encSum, found := strings.Cut(rest, "|")
+	if !found {
+		return nil, nil, false
+	}
+	salt, err := base64.StdEncoding.DecodeString(encSalt)
+	if err != nil {
+		return nil, nil, false
+	}
+	sum, err = base64.StdEncoding.DecodeString(encSum)
+	if err != nil {
+		return nil, nil, false
+	}
+	return salt, sum, true
+}
@@ -0,0 +1,182 @@
+package kamune
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/hossein1376/kamune/internal/attest"
+)
+
+func newPublicKey(t *testing.T) *attest.PublicKey {
+	t.Helper()
+	at, err := attest.New()
+	require.NoError(t, err)
+	return at.PublicKey()
+}
+
+func TestTrustStore(t *testing.T) {
+	a := require.New(t)
+	path := filepath.Join(t.TempDir(), "kamune", knownHostsName)
+	ts, err := OpenTrustStore(path)
+	a.NoError(err)
+	a.Empty(ts.List())
+
+	key, other := newPublicKey(t), newPublicKey(t)
+	a.ErrorIs(ts.Check("example.com:4000", key), ErrUnknownHost)
+	a.NoError(ts.Add("example.com:4000", key, "work laptop"))
+	a.NoError(ts.Add("laptop", key, ""))
+	a.NoError(ts.Check("example.com:4000", key))
+	a.NoError(ts.Check("laptop", key))
+	a.True(ts.Known(key))
+	a.False(ts.Known(other))
+
+	err = ts.Check("example.com:4000", other)
+	a.ErrorIs(err, ErrKeyChanged)
+	a.ErrorContains(err, Fingerprint(key))
+	a.ErrorContains(err, Fingerprint(other))
+	a.ErrorIs(ts.Add("example.com:4000", other, ""), ErrHostKnown)
+	a.Error(ts.Add("bad host", key, ""))
+	a.Error(ts.Add("host", key, "multi\nline"))
+
+	// The store survives a reopen.
+	reopened, err := OpenTrustStore(path)
+	a.NoError(err)
+	entries := reopened.List()
+	a.Len(entries, 2)
+	a.Equal("example.com:4000", entries[0].Host)
+	a.True(entries[0].Key.Equal(key))
+	a.Equal("work laptop", entries[0].Comment)
+	a.False(entries[0].FirstSeen.IsZero())
+	a.Equal(ts.List()[0].FirstSeen, entries[0].FirstSeen)
+
+	a.NoError(reopened.Replace("example.com:4000", other, "rotated"))
+	a.NoError(reopened.Check("example.com:4000", other))
+	a.ErrorIs(reopened.Check("example.com:4000", key), ErrKeyChanged)
+	a.NoError(reopened.Remove("laptop"))
+	a.ErrorIs(reopened.Remove("laptop"), ErrUnknownHost)
+
+	reopened, err = OpenTrustStore(path)
+	a.NoError(err)
+	entries = reopened.List()
+	a.Len(entries, 1)
+	a.Equal("rotated", entries[0].Comment)
+
+	info, err := os.Stat(path)
+	a.NoError(err)
+	a.Equal(os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestTrustStore_Hashed(t *testing.T) {
+	a := require.New(t)
+	path := filepath.Join(t.TempDir(), knownHostsName)
+	ts, err := OpenTrustStore(path)
+	a.NoError(err)
+	ts.HashHosts(true)
+
+	key := newPublicKey(t)
+	a.NoError(ts.Add("secret.example:4000", key, ""))
+	a.ErrorIs(ts.Add("secret.example:4000", key, ""), ErrHostKnown)
+	data, err := os.ReadFile(path)
+	a.NoError(err)
+	a.NotContains(string(data), "secret.example")
+	a.True(strings.HasPrefix(string(data), hashedHostPrefix))
+
+	reopened, err := OpenTrustStore(path)
+	a.NoError(err)
+	a.NoError(reopened.Check("secret.example:4000", key))
+	a.ErrorIs(reopened.Check("other.example:4000", key), ErrUnknownHost)
+	entries := reopened.Lookup("secret.example:4000")
+	a.Len(entries, 1)
+	a.True(entries[0].Hashed)
+	a.NoError(reopened.Remove("secret.example:4000"))
+	a.Empty(reopened.List())
+}
+
+func TestTrustStore_Malformed(t *testing.T) {
+	a := require.New(t)
+	path := filepath.Join(t.TempDir(), knownHostsName)
+	lines := "# comment\n\nhost not-a-key 2025-01-01T00:00:00Z\n"
+	a.NoError(os.WriteFile(path, []byte(lines), 0600))
+	_, err := OpenTrustStore(path)
+	a.ErrorContains(err, knownHostsName+":3:")
+}
+
+func TestTrustStore_Verified(t *testing.T) {
+	a := require.New(t)
+	path := filepath.Join(t.TempDir(), knownHostsName)
+	ts, err := OpenTrustStore(path)
+	a.NoError(err)
+
+	key, other := newPublicKey(t), newPublicKey(t)
+	a.NoError(ts.Add("example.com:4000", key, "work laptop"))
+	a.False(ts.Lookup("example.com:4000")[0].Verified)
+	a.NoError(ts.MarkVerified("example.com:4000", key))
+	a.ErrorIs(ts.MarkVerified("example.com:4000", other), ErrKeyChanged)
+	a.NoError(ts.MarkVerified("laptop", other))
+
+	reopened, err := OpenTrustStore(path)
+	a.NoError(err)
+	entries := reopened.List()
+	a.Len(entries, 2)
+	a.True(entries[0].Verified)
+	a.Equal("work laptop", entries[0].Comment)
+	a.True(entries[1].Verified)
+	a.NoError(reopened.Check("laptop", other))
+
+	// A new key is not verified, even for a verified host.
+	a.NoError(reopened.Replace("laptop", key, ""))
+	a.False(reopened.Lookup("laptop")[0].Verified)
+}
+
+func TestDefaultTrustStore_Legacy(t *testing.T) {
+	a := require.New(t)
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	dir, err := configDir()
+	a.NoError(err)
+	a.NoError(os.MkdirAll(dir, 0700))
+
+	key, other := newPublicKey(t), newPublicKey(t)
+	legacy := filepath.Join(dir, legacyKnownName)
+	var lines string
+	for _, k := range []*attest.PublicKey{key, other, key} {
+		lines += base64.StdEncoding.EncodeToString(k.Marshal()) + "\n"
+	}
+	a.NoError(os.WriteFile(legacy, []byte(lines), 0600))
+
+	ts, err := DefaultTrustStore()
+	a.NoError(err)
+	a.True(ts.Known(key))
+	a.True(ts.Known(other))
+	a.Len(ts.List(), 2)
+	a.NoError(ts.Check(Fingerprint(key), key))
+	a.NoFileExists(legacy)
+	a.FileExists(legacy + ".old")
+
+	// The keys are only imported once.
+	ts, err = DefaultTrustStore()
+	a.NoError(err)
+	a.Len(ts.List(), 2)
+
+	a.NoError(os.WriteFile(legacy, []byte("not a key\n"), 0600))
+	_, err = DefaultTrustStore()
+	a.ErrorContains(err, legacyKnownName+":1:")
+}
+
+func TestTrustStore_KeyChanged(t *testing.T) {
+	a := require.New(t)
+	_, addr, _ := startServer(t, echo)
+
+	// The default verifier refuses a host whose key has changed, without
+	// asking the user.
+	ts := NewMemoryTrustStore()
+	a.NoError(ts.Add(addr, newPublicKey(t), ""))
+	_, err := Dial(
+		addr, WithKeyStore(NewMemoryKeyStore()), WithTrustStore(ts),
+	)
+	a.ErrorIs(err, ErrKeyChanged)
+}
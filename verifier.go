@@ -0,0 +1,229 @@
+package kamune
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// RejectReason tells why a verifier has refused the remote party.
+type RejectReason uint8
+
+const (
+	// ReasonUnknown means the remote party's key is not trusted.
+	ReasonUnknown RejectReason = iota + 1
+	// ReasonKeyChanged means the host has presented a different key than the
+	// one pinned for it.
+	ReasonKeyChanged
+	// ReasonDeclined means the user did not confirm the remote party.
+	ReasonDeclined
+)
+
+func (r RejectReason) String() string {
+	switch r {
+	case ReasonUnknown:
+		return "unknown key"
+	case ReasonKeyChanged:
+		return "key changed"
+	case ReasonDeclined:
+		return "declined"
+	default:
+		return fmt.Sprintf("RejectReason(%d)", uint8(r))
+	}
+}
+
+// RejectionError is returned by the verifiers of this package when they
+// refuse the remote party. It matches ErrVerificationFailed, as well as the
+// error that caused it, if any.
+type RejectionError struct {
+	Reason      RejectReason
+	Fingerprint string
+	Direction   Direction
+	Err         error
+}
+
+func reject(p *Peer, reason RejectReason, err error) error {
+	return &RejectionError{
+		Reason:      reason,
+		Fingerprint: p.Fingerprint(),
+		Direction:   p.Direction(),
+		Err:         err,
+	}
+}
+
+func (e *RejectionError) Error() string {
+	msg := fmt.Sprintf(
+		"%s peer %s rejected: %s", e.Direction, e.Fingerprint, e.Reason,
+	)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *RejectionError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{ErrVerificationFailed}
+	}
+	return []error{ErrVerificationFailed, e.Err}
+}
+
+// AcceptAll trusts every remote party. It is only meant for tests, and for
+// setups where the peers are authenticated by other means.
+func AcceptAll() PeerVerifier {
+	return func(*Peer) error { return nil }
+}
+
+// Allowlist only trusts the keys that are pinned in ts. Outbound peers must
+// present the key that is pinned for the dialed host, while inbound peers,
+// having no stable address, may present any pinned key.
+func Allowlist(ts *TrustStore) PeerVerifier {
+	return func(p *Peer) error {
+		return checkPinned(ts, p)
+	}
+}
+
+// TOFU trusts a host on first use, and pins its key in ts, so that a
+// different key for the same host is refused from then on. Inbound peers
+// connect from ephemeral ports, so they are pinned by their fingerprints, and
+// recognized by their keys alone.
+//
+// The key is only pinned once the handshake has succeeded, so a peer that is
+// rejected by another verifier, or fails to prove that it holds the key, is
+// not remembered.
+func TOFU(ts *TrustStore) PeerVerifier {
+	return func(p *Peer) error {
+		err := checkPinned(ts, p)
+		var re *RejectionError
+		if !errors.As(err, &re) || re.Reason != ReasonUnknown {
+			return err
+		}
+		host, key := pinHost(p), p.PublicKey()
+		p.onEstablished(func() error {
+			err := ts.Replace(host, key, "trusted on first use")
+			if err != nil {
+				return fmt.Errorf("pinning key: %w", err)
+			}
+			return nil
+		})
+		return nil
+	}
+}
+
+// pinHost returns the host under which the key of p is pinned. Inbound peers
+// have no stable address, so their fingerprints are used instead.
+func pinHost(p *Peer) string {
+	if p.Direction() == Inbound || p.Host() == "" {
+		return p.Fingerprint()
+	}
+	return p.Host()
+}
+
+// checkPinned reports whether p's key is pinned in ts.
+func checkPinned(ts *TrustStore, p *Peer) error {
+	if p.Direction() == Inbound || p.Host() == "" {
+		if ts.Known(p.PublicKey()) {
+			return nil
+		}
+		return reject(p, ReasonUnknown, nil)
+	}
+
+	err := ts.Check(p.Host(), p.PublicKey())
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ErrKeyChanged):
+		return reject(p, ReasonKeyChanged, err)
+	case errors.Is(err, ErrUnknownHost):
+		return reject(p, ReasonUnknown, err)
+	default:
+		return err
+	}
+}
+
+// AllowFingerprints only trusts the keys with the given fingerprints, as
+// returned by Fingerprint.
+func AllowFingerprints(fingerprints ...string) PeerVerifier {
+	allowed := make(map[string]struct{}, len(fingerprints))
+	for _, fp := range fingerprints {
+		allowed[fp] = struct{}{}
+	}
+	return func(p *Peer) error {
+		if _, ok := allowed[p.Fingerprint()]; ok {
+			return nil
+		}
+		return reject(p, ReasonUnknown, nil)
+	}
+}
+
+// LoadFingerprints reads the fingerprints of the trusted keys from the file at
+// path, and returns a verifier that only trusts them. Each line holds a
+// single fingerprint, optionally followed by a comment. Empty lines and the
+// ones starting with '#' are ignored. The file is only read once.
+func LoadFingerprints(path string) (PeerVerifier, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening file: %w", err)
+	}
+	defer f.Close()
+
+	var fingerprints []string
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fp := strings.Fields(line)[0]
+		if !strings.HasPrefix(fp, "SHA256:") {
+			return nil, fmt.Errorf(
+				"%s:%d: invalid fingerprint %q", path, n, fp,
+			)
+		}
+		fingerprints = append(fingerprints, fp)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("reading file: %w", err)
+	}
+
+	return AllowFingerprints(fingerprints...), nil
+}
+
+// And trusts the remote party only if all verifiers do. They are called in
+// order, and the first rejection is returned. With no verifiers, nobody is
+// trusted.
+func And(verifiers ...PeerVerifier) PeerVerifier {
+	return func(p *Peer) error {
+		if len(verifiers) == 0 {
+			return reject(p, ReasonUnknown, nil)
+		}
+		for _, v := range verifiers {
+			if err := v(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Or trusts the remote party if any of the verifiers does. They are called in
+// order until one accepts; if none does, all of their rejections are
+// returned, joined together. With no verifiers, nobody is trusted.
+func Or(verifiers ...PeerVerifier) PeerVerifier {
+	return func(p *Peer) error {
+		errs := make([]error, 0, len(verifiers))
+		for _, v := range verifiers {
+			err := v(p)
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err)
+		}
+		if len(errs) == 0 {
+			return reject(p, ReasonUnknown, nil)
+		}
+		return errors.Join(errs...)
+	}
+}
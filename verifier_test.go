@@ -0,0 +1,243 @@
+package kamune
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/hossein1376/kamune/internal/attest"
+)
+
+func testPeer(
+	t *testing.T, key *attest.PublicKey, dir Direction, host string,
+) *Peer {
+	t.Helper()
+	return &Peer{
+		key:    key,
+		host:   host,
+		dir:    dir,
+		local:  &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4000},
+		remote: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000},
+	}
+}
+
+func rejectReason(t *testing.T, err error) RejectReason {
+	t.Helper()
+	a := require.New(t)
+	a.ErrorIs(err, ErrVerificationFailed)
+	var re *RejectionError
+	a.ErrorAs(err, &re)
+	return re.Reason
+}
+
+func TestAllowlist(t *testing.T) {
+	a := require.New(t)
+	key, other := newPublicKey(t), newPublicKey(t)
+	ts := NewMemoryTrustStore()
+	a.NoError(ts.Add("example.com:4000", key, ""))
+	v := Allowlist(ts)
+
+	a.NoError(v(testPeer(t, key, Outbound, "example.com:4000")))
+	a.NoError(v(testPeer(t, key, Inbound, "")))
+
+	err := v(testPeer(t, other, Outbound, "example.com:4000"))
+	a.Equal(ReasonKeyChanged, rejectReason(t, err))
+	a.ErrorIs(err, ErrKeyChanged)
+	a.ErrorContains(err, "outbound")
+
+	err = v(testPeer(t, key, Outbound, "other.example:4000"))
+	a.Equal(ReasonUnknown, rejectReason(t, err))
+	err = v(testPeer(t, other, Inbound, ""))
+	a.Equal(ReasonUnknown, rejectReason(t, err))
+}
+
+// establish runs v on p, and completes the connection if p is trusted, as
+// if the handshake had succeeded.
+func establish(v PeerVerifier, p *Peer) error {
+	if err := v(p); err != nil {
+		return err
+	}
+	return p.establish()
+}
+
+func TestTOFU(t *testing.T) {
+	a := require.New(t)
+	key, other := newPublicKey(t), newPublicKey(t)
+	ts := NewMemoryTrustStore()
+	v := TOFU(ts)
+
+	// Nothing is pinned until the handshake succeeds.
+	a.NoError(v(testPeer(t, key, Outbound, "example.com:4000")))
+	a.Empty(ts.List())
+
+	a.NoError(establish(v, testPeer(t, key, Outbound, "example.com:4000")))
+	a.NoError(ts.Check("example.com:4000", key))
+	a.NoError(establish(v, testPeer(t, key, Outbound, "example.com:4000")))
+	err := establish(v, testPeer(t, other, Outbound, "example.com:4000"))
+	a.Equal(ReasonKeyChanged, rejectReason(t, err))
+
+	a.NoError(establish(v, testPeer(t, other, Inbound, "")))
+	a.NoError(ts.Check(Fingerprint(other), other))
+	a.Len(ts.List(), 2)
+
+	// A client that reconnects from another port is recognized, rather than
+	// pinned once more.
+	p := testPeer(t, other, Inbound, "")
+	p.remote = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50001}
+	a.NoError(establish(v, p))
+	a.Len(ts.List(), 2)
+	a.Empty(ts.Lookup("192.0.2.1:50000"))
+}
+
+func TestTOFU_And(t *testing.T) {
+	a := require.New(t)
+	key, other := newPublicKey(t), newPublicKey(t)
+	ts := NewMemoryTrustStore()
+
+	// A peer that TOFU would trust, but the next verifier rejects, is not
+	// pinned, so a later Allowlist does not trust it either.
+	v := And(TOFU(ts), AllowFingerprints(Fingerprint(other)))
+	err := establish(v, testPeer(t, key, Outbound, "example.com:4000"))
+	a.Equal(ReasonUnknown, rejectReason(t, err))
+	a.Empty(ts.List())
+	err = Allowlist(ts)(testPeer(t, key, Outbound, "example.com:4000"))
+	a.Equal(ReasonUnknown, rejectReason(t, err))
+
+	a.NoError(establish(v, testPeer(t, other, Outbound, "example.com:4000")))
+	a.NoError(ts.Check("example.com:4000", other))
+}
+
+func TestFingerprints(t *testing.T) {
+	a := require.New(t)
+	key, other := newPublicKey(t), newPublicKey(t)
+
+	path := filepath.Join(t.TempDir(), "allowed")
+	content := "# trusted peers\n\n" + Fingerprint(key) + " alice\n"
+	a.NoError(os.WriteFile(path, []byte(content), 0600))
+	v, err := LoadFingerprints(path)
+	a.NoError(err)
+	a.NoError(v(testPeer(t, key, Inbound, "")))
+	err = v(testPeer(t, other, Inbound, ""))
+	a.Equal(ReasonUnknown, rejectReason(t, err))
+
+	a.NoError(os.WriteFile(path, []byte("alice\n"), 0600))
+	_, err = LoadFingerprints(path)
+	a.ErrorContains(err, "allowed:1")
+	_, err = LoadFingerprints(filepath.Join(t.TempDir(), "missing"))
+	a.ErrorIs(err, os.ErrNotExist)
+}
+
+func TestCombinators(t *testing.T) {
+	a := require.New(t)
+	key, other := newPublicKey(t), newPublicKey(t)
+	allowKey := AllowFingerprints(Fingerprint(key))
+	allowOther := AllowFingerprints(Fingerprint(other))
+	outboundOnly := func(p *Peer) error {
+		if p.Direction() != Outbound {
+			return errors.New("outbound only")
+		}
+		return nil
+	}
+
+	and := And(allowKey, outboundOnly)
+	a.NoError(and(testPeer(t, key, Outbound, "h")))
+	a.EqualError(and(testPeer(t, key, Inbound, "")), "outbound only")
+	err := and(testPeer(t, other, Outbound, "h"))
+	a.Equal(ReasonUnknown, rejectReason(t, err))
+	err = And()(testPeer(t, key, Inbound, ""))
+	a.Equal(ReasonUnknown, rejectReason(t, err))
+
+	or := Or(allowKey, allowOther)
+	a.NoError(or(testPeer(t, key, Inbound, "")))
+	a.NoError(or(testPeer(t, other, Inbound, "")))
+	err = Or(allowKey, outboundOnly)(testPeer(t, other, Inbound, ""))
+	a.ErrorIs(err, ErrVerificationFailed)
+	a.ErrorContains(err, "outbound only")
+	err = Or()(testPeer(t, key, Inbound, ""))
+	a.Equal(ReasonUnknown, rejectReason(t, err))
+
+	a.NoError(AcceptAll()(testPeer(t, other, Inbound, "")))
+}
+
+func TestVerifier_Direction(t *testing.T) {
+	a := require.New(t)
+	clientID, err := attest.New()
+	a.NoError(err)
+
+	ts := NewMemoryTrustStore()
+	a.NoError(ts.Add("client", clientID.PublicKey(), ""))
+	directions := make(chan Direction, 3)
+	record := func(p *Peer) error {
+		directions <- p.Direction()
+		return nil
+	}
+	_, addr, _ := startServer(
+		t, echo, WithPeerVerifier(And(record, Allowlist(ts))),
+	)
+
+	dialServer(
+		t, addr,
+		WithIdentity(clientID),
+		WithPeerVerifier(And(record, TOFU(ts))),
+	)
+	a.ElementsMatch([]Direction{Inbound, Outbound}, []Direction{
+		<-directions, <-directions,
+	})
+	a.Len(ts.Lookup(addr), 1)
+
+	// A client that is not on the list is refused.
+	_, err = Dial(
+		addr,
+		WithKeyStore(NewMemoryKeyStore()),
+		WithPeerVerifier(AcceptAll()),
+		WithHandshakeTimeout(time.Second),
+	)
+	a.Error(err)
+}
+
+func TestTOFU_Handshake(t *testing.T) {
+	a := require.New(t)
+	clientID, err := attest.New()
+	a.NoError(err)
+	ts := NewMemoryTrustStore()
+	_, addr, _ := startServer(t, echo, WithPeerVerifier(
+		And(TOFU(ts), AllowFingerprints(Fingerprint(clientID.PublicKey()))),
+	))
+
+	// A client refused by the server is not pinned.
+	_, err = Dial(
+		addr,
+		WithKeyStore(NewMemoryKeyStore()),
+		WithRemoteVerifier(acceptAll),
+		WithHandshakeTimeout(time.Second),
+	)
+	a.Error(err)
+	a.Empty(ts.List())
+
+	tr := dialServer(t, addr, WithIdentity(clientID))
+	roundTrip(t, tr, "hello")
+	a.True(ts.Known(clientID.PublicKey()))
+}
+
+func TestTOFU_Reconnect(t *testing.T) {
+	a := require.New(t)
+	clientID, err := attest.New()
+	a.NoError(err)
+	ts := NewMemoryTrustStore()
+	_, addr, _ := startServer(t, echo, WithPeerVerifier(TOFU(ts)))
+
+	// Each connection comes from another port, yet the client is pinned
+	// only once.
+	for range 3 {
+		tr := dialServer(t, addr, WithIdentity(clientID))
+		roundTrip(t, tr, "hello")
+	}
+	entries := ts.List()
+	a.Len(entries, 1)
+	a.Equal(Fingerprint(clientID.PublicKey()), entries[0].Host)
+}